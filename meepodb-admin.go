@@ -0,0 +1,397 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+    "text/tabwriter"
+    "time"
+    "./meepodb"
+)
+
+/* Time between polls while following a rebalance */
+const POLL_INTERVAL time.Duration = 2 * time.Second
+
+/* Time between polls of a subscription with nothing new */
+const TAIL_INTERVAL time.Duration = 200 * time.Millisecond
+
+/*
+ *  meepodb-admin runs one command against the servers of the config and
+ *  exits, with status 1 if the command failed or found the cluster unwell.
+ *  Unlike meepodb-cli it deals with servers rather than records.
+ */
+func help() {
+    println("PLEASE RUN:\tmeepodb-admin [-config file] [options] COMMAND")
+    println("commands:")
+    println("  status              servers, their states and what they keep")
+    println("  node SERVER         everything a server tells of itself")
+    println("  tables              tables of the cluster and their sizes")
+    println("  health (TABLE)      ranges short of copies or zones")
+    println("  rebalance           reallocate on every server and follow it")
+    println("  rebalance status    how the last rebalance of every server went")
+    println("  compact (TABLE)     compact tables on every server")
+    println("  verify              check every server runs for the tag of the config")
+    println("  subscribe TABLE (FILE)")
+    println("                      print changes of a table as they come, resuming from")
+    println("                      the position kept in FILE, or \"oldest\" in it; a")
+    println("                      change may be printed again after a rerun")
+}
+
+/* Servers of the config, sorted as the servers sort them */
+func servers() []string {
+    var list = append([]string(nil), meepodb.SERVERS...)
+    sort.Strings(list)
+    return list
+}
+
+/* One request to one server on a connection of its own. */
+func call(addr string, request []byte) ([]byte, error) {
+    peer, err := meepodb.DialPeer(addr)
+    if err != nil {
+        return nil, err
+    }
+    defer peer.Close()
+    return peer.Call(request)
+}
+
+/* Send a request to the first server that answers. */
+func callAny(request []byte) ([]byte, error) {
+    var err error
+    for _, addr := range servers() {
+        var v []byte
+        v, err = call(addr, request)
+        if err == nil {
+            return v, nil
+        }
+        fmt.Fprintln(os.Stderr, "*", addr, "\b:", err)
+    }
+    if err == nil {
+        err = fmt.Errorf("no server configured")
+    }
+    return nil, err
+}
+
+/* Pairs of a STAT reply */
+func stat(addr string) (map[string]string, error) {
+    v, err := call(addr, meepodb.EncodeSym(meepodb.STAT_CODE))
+    if err != nil {
+        return nil, err
+    }
+    var result = make(map[string]string)
+    for _, line := range strings.Split(strings.TrimSpace(string(v)), "\n") {
+        name, value, _ := strings.Cut(line, " ")
+        result[name] = value
+    }
+    return result, nil
+}
+
+func status() bool {
+    var ok = true
+    var out = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(out, "SERVER\tSTATE\tZONE\tUPTIME\tRECORDS\tHINTS\tREBALANCE")
+    for _, addr := range servers() {
+        st, err := stat(addr)
+        if err != nil {
+            fmt.Fprintf(out, "%s\tdown\t\t\t\t\t%s\n", addr, err)
+            ok = false
+            continue
+        }
+        var state = st["state"]
+        if st["booting"] == "true" {
+            state += ",booting"
+        }
+        fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", addr, state, st["zone"], st["uptime"],
+                    st["records"], st["hints"], st["rebalance"])
+    }
+    out.Flush()
+    /* How the servers see each other */
+    v, err := callAny(meepodb.EncodeSym(meepodb.TOPO_CODE))
+    if err != nil {
+        return false
+    }
+    fmt.Printf("\ngossip:\n%s", v)
+    return ok
+}
+
+func node(addr string) bool {
+    v, err := call(addr, meepodb.EncodeSym(meepodb.STAT_CODE))
+    if err != nil {
+        fmt.Println("*", addr, "\b:", err)
+        return false
+    }
+    fmt.Printf("%s", v)
+    return true
+}
+
+/* Tables kept by any server, with the copies each keeps and the records of
+   the table counted once. */
+func tables() bool {
+    var ok = true
+    var kinds = make(map[string]string)
+    var copies = make(map[string]uint64)
+    for _, addr := range servers() {
+        v, err := call(addr, meepodb.EncodeSym(meepodb.TABS_CODE))
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "*", addr, "\b:", err)
+            ok = false
+            continue
+        }
+        for _, line := range strings.Split(strings.TrimSpace(string(v)), "\n") {
+            var name, kind, replicas string
+            var records uint64
+            _, err = fmt.Sscan(line, &name, &kind, &replicas, &records)
+            if err != nil {
+                continue
+            }
+            kinds[name] = kind + "\t" + replicas
+            copies[name] += records
+        }
+    }
+    var names = make([]string, 0, len(kinds))
+    for name := range kinds {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var out = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(out, "TABLE\tKIND\tREPLICAS\tRECORDS\tCOPIES")
+    for _, name := range names {
+        var size = "?"
+        v, err := callAny(meepodb.EncodeRequest(meepodb.SIZE_CODE, []byte(name), nil, nil))
+        if err == nil {
+            size = fmt.Sprint(meepodb.BytesToUint64(v))
+        } else {
+            ok = false
+        }
+        fmt.Fprintf(out, "%s\t%s\t%s\t%d\n", name, kinds[name], size, copies[name])
+    }
+    out.Flush()
+    return ok
+}
+
+func health(table string) bool {
+    v, err := callAny(meepodb.EncodeRequest(meepodb.HLTH_CODE, []byte(table), nil, nil))
+    if err != nil {
+        fmt.Println("*", err)
+        return false
+    }
+    fmt.Printf("%s", v)
+    /* Tables are well with no range short of anything */
+    for _, line := range strings.Split(strings.TrimSpace(string(v)), "\n") {
+        if !strings.HasSuffix(line, " 0 short, 0 sharing zones, 0 down") {
+            return false
+        }
+    }
+    return true
+}
+
+/* Rebalance lines of every server; the result tells whether some still
+   run and whether all could be asked. */
+func rebalanceStatus() (bool, bool) {
+    var running bool
+    var ok = true
+    for _, addr := range servers() {
+        st, err := stat(addr)
+        if err != nil {
+            fmt.Println(addr, "down:", err)
+            ok = false
+            continue
+        }
+        fmt.Println(addr, st["rebalance"])
+        running = running || strings.HasPrefix(st["rebalance"], "running")
+        ok = ok && !strings.HasPrefix(st["rebalance"], "failed")
+    }
+    return running, ok
+}
+
+/* Every server hands over the records it no longer owns, so all of them
+   are asked, then followed until none runs. */
+func rebalance() bool {
+    var ok = true
+    for _, addr := range servers() {
+        _, err := call(addr, meepodb.EncodeSym(meepodb.RBAL_CODE))
+        if err != nil {
+            fmt.Println("*", addr, "\b:", err)
+            ok = false
+        }
+    }
+    for {
+        time.Sleep(POLL_INTERVAL)
+        running, done := rebalanceStatus()
+        if !running {
+            return ok && done
+        }
+        fmt.Println()
+    }
+}
+
+func compact(table string) bool {
+    var ok = true
+    for _, addr := range servers() {
+        v, err := call(addr, meepodb.EncodeRequest(meepodb.CMPT_CODE, []byte(table), nil, nil))
+        if err != nil {
+            fmt.Println("*", addr, "\b:", err)
+            ok = false
+            continue
+        }
+        fmt.Printf("%s:\n%s", addr, v)
+    }
+    return ok
+}
+
+/* Servers run for the tag of their config and have placed their data for
+   it once they are done reallocating; both should be the tag of this one. */
+func verify() bool {
+    var tag = fmt.Sprint(meepodb.ClusterTag())
+    var ok = true
+    fmt.Println("cluster tag:", tag)
+    for _, addr := range servers() {
+        st, err := stat(addr)
+        switch {
+            case err != nil:
+                fmt.Println(addr, "down:", err)
+            case st["tag"] != tag:
+                fmt.Println(addr, "runs for tag", st["tag"], "\b, its config differs")
+            case st["placed"] != tag:
+                fmt.Println(addr, "has data placed for tag", st["placed"], "\b, rebalance it")
+            default:
+                fmt.Println(addr, "ok")
+                continue
+        }
+        ok = false
+    }
+    return ok
+}
+
+/* Print the changes of table until killed, one per line, keeping the position
+   after them in file so that a rerun goes on from there. A rerun may print
+   again changes of which the other replicas had copies, see Subscription. */
+func subscribe(table, file string) bool {
+    var position string
+    if file != "" {
+        data, err := os.ReadFile(file)
+        if err != nil && !os.IsNotExist(err) {
+            fmt.Println("*", err)
+            return false
+        }
+        position = strings.TrimSpace(string(data))
+    }
+    sub, err := meepodb.Subscribe(servers(), table, position)
+    if err != nil {
+        fmt.Println("*", err)
+        return false
+    }
+    defer sub.Close()
+    var saved = position
+    for {
+        events, err := sub.Next()
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "*", err)
+        }
+        for _, event := range events {
+            var when = event.Time().Format("2006-01-02T15:04:05.000")
+            switch {
+                case event.Dropped:
+                    fmt.Println(when, event.Version, "DROP", table, "by", event.Server)
+                case event.Deleted():
+                    fmt.Println(when, event.Version, "DEL", string(event.Key))
+                default:
+                    fmt.Println(when, event.Version, "SET", string(event.Key), string(event.Value))
+            }
+        }
+        if file != "" && sub.Position() != saved {
+            saved = sub.Position()
+            /* Replaced whole, so that a kill leaves one position or the other */
+            var temp = file + ".tmp"
+            err = os.WriteFile(temp, []byte(saved + "\n"), 0644)
+            if err == nil {
+                err = os.Rename(temp, file)
+            }
+            if err != nil {
+                fmt.Println("*", err)
+                return false
+            }
+        }
+        if len(events) == 0 {
+            time.Sleep(TAIL_INTERVAL)
+        }
+    }
+}
+
+func main() {
+    err := meepodb.ParseConfig()
+    if err != nil {
+        println("config:", err.Error())
+        help()
+        os.Exit(2)
+    }
+    var args = flag.Args()
+    if len(args) == 0 {
+        help()
+        os.Exit(2)
+    }
+    var ok bool
+    switch {
+        case args[0] == "status" && len(args) == 1:
+            ok = status()
+        case args[0] == "node" && len(args) == 2:
+            ok = node(args[1])
+        case args[0] == "tables" && len(args) == 1:
+            ok = tables()
+        case args[0] == "health" && len(args) <= 2:
+            var table string
+            if len(args) == 2 {
+                table = args[1]
+            }
+            ok = health(table)
+        case args[0] == "rebalance" && len(args) == 1:
+            ok = rebalance()
+        case args[0] == "rebalance" && len(args) == 2 && args[1] == "status":
+            _, ok = rebalanceStatus()
+        case args[0] == "compact" && len(args) <= 2:
+            var table string
+            if len(args) == 2 {
+                table = args[1]
+            }
+            ok = compact(table)
+        case args[0] == "verify" && len(args) == 1:
+            ok = verify()
+        case args[0] == "subscribe" && (len(args) == 2 || len(args) == 3):
+            var file string
+            if len(args) == 3 {
+                file = args[2]
+            }
+            ok = subscribe(args[1], file)
+        default:
+            help()
+            os.Exit(2)
+    }
+    if !ok {
+        os.Exit(1)
+    }
+}
@@ -9,20 +9,36 @@ import (
     "./meepodb"
 )
 
+var growth = flag.Uint64("growth", 2, "growth factor of COLA levels")
+var tiered = flag.Bool("tiered", false, "use tiered merge policy")
+
 func main() {
-    flag.Parse()
-    if flag.NArg() != 1 {
-        println("PLEASE RUN: meepodb-bench [number]")
+    err := meepodb.ParseConfig()
+    if err != nil {
+        println("config:", err.Error())
+    }
+    if err != nil || flag.NArg() != 1 {
+        println("PLEASE RUN: meepodb-bench [-config file] [-growth g] [-tiered] [number]")
         return
     }
     ops, err := strconv.Atoi(flag.Arg(0))
     if err != nil {
-        println("PLEASE RUN: meepodb-bench [number]")
+        println("PLEASE RUN: meepodb-bench [-config file] [-growth g] [-tiered] [number]")
+        return
+    }
+    /* Next to the database rather than in it, so that servers never see it */
+    var path = meepodb.DB_DIR + "_bench_" + strconv.Itoa(int(time.Now().Unix()))
+    var policy = meepodb.Policy{ Growth: *growth, Merge: meepodb.MERGE_LEVELED }
+    if *tiered {
+        policy.Merge = meepodb.MERGE_TIERED
+    }
+    cola, err := meepodb.NewCOLA(path, &meepodb.Options{ Policy: policy, Sync: meepodb.SYNC })
+    if err != nil {
+        println("cannot create", path, "\b:", err.Error())
         return
     }
-    var path = ("/home/wiza/ssd/mpdb_" + strconv.Itoa(int(time.Now().Unix())))
-    cola, _ := meepodb.NewCOLA(path)
     fmt.Printf("db dir:\t\t%s\n", path)
+    fmt.Printf("policy:\t\t%s\n", policy.String())
     v := bytes.Repeat([]byte("JAVAPYTHON"), 10)
     fmt.Println("key size:\t16 bytes")
     fmt.Printf("value size:\t%d bytes\n", len(v))
@@ -40,7 +56,7 @@ func main() {
     beg = time.Now().UnixNano()
     for i := 1000000001; i <= 1000000000 + ops; i++ {
         k := []byte(strconv.Itoa(i) + "Erlang")
-        v := cola.Get(k)
+        v, _ := cola.Get(k)
         if len(v) == 100 {
             count++
         }
@@ -25,16 +25,16 @@ package main
 import (
     "bufio"
     "bytes"
+    "errors"
+    "flag"
     "fmt"
-    "net"
     "os"
-    "sort"
-    . "syscall"
+    "strconv"
     "./meepodb"
 )
 
-var numberOfServers = uint64(len(meepodb.SERVERS[:]))
-var servers = make([]int, numberOfServers)
+var versions = flag.Bool("versions", false, "show versions of values")
+var sessions = flag.Bool("session", false, "read your own writes whichever server serves them")
 var stdin = bufio.NewReader(os.Stdin)
 var lineNumber int = 1
 
@@ -67,37 +67,47 @@ func ReadTokensInLine() []([]byte) {
     return result[:count]
 }
 
-func sendRequest(i uint64, request []byte) bool {
-    if servers[i] != -1 {
-        n, err := Write(servers[i], request)
-        if err == nil && n == len(request) {
+/* Versions written and read, if -session is given */
+var session *meepodb.Session
+
+/* The server requests are sent to; any of them serves any key */
+var server *meepodb.Peer
+var next int
+
+/* Connect to the first server that answers, trying them in turn. */
+func connect() bool {
+    for tries := 0; tries < len(meepodb.SERVERS); tries++ {
+        var addr = meepodb.SERVERS[next]
+        next = (next + 1) % len(meepodb.SERVERS)
+        peer, err := meepodb.DialPeer(addr)
+        if err == nil {
+            println("connected to", addr)
+            server = peer
             return true
         }
-        fmt.Println("* cannot send request to", meepodb.SERVERS[i], "\b:", err)
-        /* Reset the connection */
-        servers[i] = -1
-    }
-    /* Try dialing again */
-    println("* dialing", meepodb.SERVERS[i], "\b...")
-    addr, err := net.ResolveTCPAddr("tcp", meepodb.SERVERS[i])
-    conn, err := net.DialTCP("tcp", nil, addr)
-    if err != nil {
         fmt.Println("*", err)
-        return false
-    }
-    file, _ := conn.File()
-    conn.Close()
-    servers[i] = int(file.Fd())
-    meepodb.SetKeepAlive(servers[i], 0)
-    n, err := Write(servers[i], request)
-    if err == nil && n == len(request) {
-        return true
-    }
-    fmt.Println("* cannot send request to", meepodb.SERVERS[i], "\b:", err)
-    servers[i] = -1
+    }
     return false
 }
 
+/* Send a request, moving on to another server if the current one is gone. */
+func call(request []byte) ([]byte, error) {
+    for tries := 0; tries < len(meepodb.SERVERS); tries++ {
+        if server == nil && !connect() {
+            break
+        }
+        v, err := server.Call(request)
+        var remote *meepodb.RemoteError
+        if err == nil || errors.As(err, &remote) {
+            return v, err
+        }
+        fmt.Println("* cannot send request to", server.Addr, "\b:", err)
+        server.Close()
+        server = nil
+    }
+    return nil, errors.New("no server available")
+}
+
 func nonvoidPrint(str []byte) {
     if len(str) == 0 {
         fmt.Println("<nil>")
@@ -106,150 +116,246 @@ func nonvoidPrint(str []byte) {
     fmt.Printf("%s\n", str)
 }
 
-func getFrom(i uint64, request []byte) ([]byte, bool) {
-    var ok bool = sendRequest(i, request)
-    if !ok {
-        return nil, false
+/* Consistency given after the arguments of a command, if any */
+func options(tokens [][]byte, n int) (meepodb.RequestOptions, bool) {
+    var opts meepodb.RequestOptions
+    if len(tokens) == n {
+        return opts, true
     }
-    var head = make([]byte, 8)
-    n, err := Read(servers[i], head)
-    if err != nil || n != 8 {
-        return nil, false
+    level, err := meepodb.ParseConsistency(string(tokens[n]))
+    if err != nil {
+        println("*", "consistency is ONE, QUORUM or ALL")
+        return opts, false
     }
-    code, _, _, vlen := meepodb.DecodeHead(head)
-    if code == meepodb.ERR_CODE {
-        return nil, false
+    opts.Consistency = level
+    return opts, true
+}
+
+func get(table, key []byte, opts meepodb.RequestOptions) {
+    opts.Version = *versions
+    var v []byte
+    var err error
+    if session != nil {
+        v, err = session.Read(call, table, key, opts)
+        if err == nil && !*versions {
+            _, v = meepodb.Unstamp(v)
+        }
+    } else {
+        v, err = call(meepodb.WithOptions(meepodb.EncodeGet(table, key), opts))
     }
-    if vlen == 0 {
-        return []byte(""), true
+    if err != nil {
+        fmt.Println("*", err)
+        return
     }
-    var value = make([]byte, vlen)
-    n, err = Read(servers[i], value)
-    if err != nil || n != int(vlen) {
-        return nil, false
+    if !*versions {
+        nonvoidPrint(v)
+        return
     }
-    return value, true
+    version, v := meepodb.Unstamp(v)
+    if version == 0 {
+        nonvoidPrint(v)
+        return
+    }
+    if len(v) == 0 {
+        v = []byte("<nil>")
+    }
+    fmt.Printf("%s\t(version %d at %s)\n", v, version,
+               meepodb.VersionTime(version).Format("2006-01-02 15:04:05.000"))
 }
 
-func get(table, key []byte) {
-    var ok bool
-    var v1, v2, v3 []byte
-    var request []byte = meepodb.EncodeGet(table, key)
-    var i uint64 = meepodb.HashTableKey(table, key)
-    println("* hash location:", i)
-    i = i % numberOfServers
-    var i2 = (i + 1) % numberOfServers
-    var i3 = (i + 2) % numberOfServers
-    v1, ok = getFrom(i, request)
-    if ok {
-        /* If v1 ok... */
-        if meepodb.REPLICA == false {
-            nonvoidPrint(v1)
-        } else {
-            v2, ok = getFrom(i2, request)
-            if ok {
-                /* If v1 == v2... */
-                if bytes.Compare(v1, v2) == 0 {
-                    nonvoidPrint(v1)
-                } else {
-                    v3, ok = getFrom(i3, request)
-                    if ok {
-                        if bytes.Compare(v1, v3) == 0 || bytes.Compare(v2, v3) == 0 {
-                            nonvoidPrint(v3)
-                        } else {
-                            nonvoidPrint(v1)
-                        }
-                    } else {
-                        /* If v3 not ok... */
-                        println("* cannot GET from", meepodb.SERVERS[i3])
-                        nonvoidPrint(v1)
-                    }
-                }
-            } else {
-                /* If v2 not ok... */
-                println("* cannot GET from", meepodb.SERVERS[i2])
-                nonvoidPrint(v1)
-            }
+func set(table, key, value []byte, opts meepodb.RequestOptions) {
+    var request = meepodb.WithOptions(meepodb.EncodeSet(table, key, value), opts)
+    if session != nil {
+        request = session.EncodeSet(table, key, value, opts)
+    }
+    v, err := call(request)
+    if err != nil {
+        fmt.Println("*", err)
+        return
+    }
+    if session != nil && len(v) == 8 {
+        session.Observe(table, key, meepodb.BytesToUint64(v))
+    }
+}
+
+func drop(table []byte) {
+    _, err := call(meepodb.EncodeDrop(table))
+    if err != nil {
+        fmt.Println("*", err)
+    }
+}
+
+/* Servers as seen by the one connected to */
+func topology() {
+    v, err := call(meepodb.EncodeSym(meepodb.TOPO_CODE))
+    if err != nil {
+        fmt.Println("*", err)
+        return
+    }
+    fmt.Printf("%s", v)
+}
+
+/* State of the Raft group of a table on the server connected to */
+func raft(table []byte) {
+    var request = meepodb.EncodeRequest(meepodb.RAFT_CODE, table, nil,
+                                        []byte{ meepodb.RAFT_STATUS })
+    v, err := call(request)
+    if err != nil {
+        fmt.Println("*", err)
+        return
+    }
+    fmt.Printf("%s: %s", server.Addr, v)
+}
+
+/* Last SCAN or KEYS, which NEXT goes on with */
+var lastScan []byte
+
+/* Records or keys of [start, end), "-" leaving either side open */
+func scan(code byte, table, start, end []byte, limit []byte) {
+    var n uint64
+    if limit != nil {
+        var err error
+        n, err = strconv.ParseUint(string(limit), 10, 64)
+        if err != nil || n == 0 {
+            println("*", "LIMIT must be a positive number")
+            return
         }
-    } else {
-        /* If v1 not ok... */
-        println("* cannot GET from", meepodb.SERVERS[i])
-        if meepodb.REPLICA {
-            v2, ok = getFrom(i2, request)
-            if ok {
-                /* If v2 ok... */
-                nonvoidPrint(v2)
-            } else {
-                println("* cannot GET from", meepodb.SERVERS[i2])
-                v3, ok = getFrom(i3, request)
-                if ok {
-                    /* If v3 ok... */
-                    nonvoidPrint(v3)
-                } else {
-                    println("* cannot GET from", meepodb.SERVERS[i3])
-                }
-            }
+    }
+    if string(start) == "-" {
+        start = nil
+    }
+    if string(end) == "-" {
+        end = nil
+    }
+    lastScan = meepodb.EncodeScan(code, table, start, end, int(n))
+    nextPage()
+}
+
+/* Page after the one SCAN, KEYS or NEXT showed last */
+func nextPage() {
+    if lastScan == nil {
+        println("*", "no more records")
+        return
+    }
+    v, err := call(lastScan)
+    if err != nil {
+        fmt.Println("*", err)
+        return
+    }
+    page, err := meepodb.DecodeScanPage(v)
+    if err != nil {
+        fmt.Println("*", err)
+        return
+    }
+    code, tlen, klen, vlen := meepodb.DecodeHead(lastScan[:8])
+    for i, k := range page.Keys {
+        if code == meepodb.KEYS_CODE {
+            fmt.Printf("%s\n", k)
+        } else {
+            fmt.Printf("%s: %s\n", k, page.Values[i])
         }
     }
+    if page.Next == nil {
+        fmt.Println(len(page.Keys), "records")
+        lastScan = nil
+        return
+    }
+    fmt.Println(len(page.Keys), "records, NEXT for more")
+    var table = lastScan[8 : 8 + tlen]
+    var value = lastScan[8 + tlen + klen : 8 + tlen + klen + vlen]
+    lastScan = meepodb.EncodeRequest(code, table, page.Next, value)
 }
 
-func set(table, key, value []byte) {
-    var request []byte = meepodb.EncodeSet(table, key, value)
-    var i uint64 = meepodb.HashTableKey(table, key)
-    println("* hash location:", i)
-    i = i % numberOfServers
-    sendRequest(i, request)
-    if meepodb.REPLICA == false {
+/* Live records of a table in the whole cluster */
+func size(table []byte) {
+    v, err := call(meepodb.EncodeRequest(meepodb.SIZE_CODE, table, nil, nil))
+    if err != nil {
+        fmt.Println("*", err)
         return
     }
-    /* Replica 1 */
-    i = (i + 1) % numberOfServers
-    sendRequest(i, request)
-    /* Replica 2 */
-    i = (i + 1) % numberOfServers
-    sendRequest(i, request)
+    fmt.Println(meepodb.BytesToUint64(v))
 }
 
-func drop(table []byte) {
-    var request []byte = meepodb.EncodeDrop(table)
-    for i := range servers {
-        sendRequest(uint64(i), request)
+/* Ranges of a table and the servers holding them */
+func ranges(table []byte) {
+    v, err := call(meepodb.EncodeRequest(meepodb.RGET_CODE, table, nil, nil))
+    if err != nil {
+        fmt.Println("*", err)
+        return
     }
+    fmt.Printf("%s", v)
+}
+
+/* Give the range of a table starting at start to a list of servers */
+func move(table, start, servers []byte) {
+    var value = meepodb.Stamp(0, servers)
+    _, err := call(meepodb.EncodeRequest(meepodb.RSET_CODE, table, start, value))
+    if err != nil {
+        fmt.Println("*", err)
+    }
+}
+
+/* Drain a server so that it can be taken out, or show how it goes */
+func drain(addr []byte) {
+    v, err := call(meepodb.EncodeRequest(meepodb.DRAN_CODE, nil, addr, nil))
+    if err != nil {
+        fmt.Println("*", err)
+        return
+    }
+    fmt.Printf("%s", v)
+}
+
+/* Ranges of every table, or of one, short of copies or zones */
+func health(table []byte) {
+    v, err := call(meepodb.EncodeRequest(meepodb.HLTH_CODE, table, nil, nil))
+    if err != nil {
+        fmt.Println("*", err)
+        return
+    }
+    fmt.Printf("%s", v)
+}
+
+/* Hints the server keeps for servers it could not reach */
+func hints() {
+    v, err := call(meepodb.EncodeSym(meepodb.HINT_CODE))
+    if err != nil {
+        fmt.Println("*", err)
+        return
+    }
+    if len(v) == 0 {
+        fmt.Println("no hints pending on", server.Addr)
+        return
+    }
+    fmt.Printf("%s", v)
+}
+
+/* How far a follower is behind the servers it follows */
+func lag() {
+    v, err := call(meepodb.EncodeSym(meepodb.LAG_CODE))
+    if err != nil {
+        fmt.Println("*", err)
+        return
+    }
+    fmt.Printf("%s", v)
 }
 
 func quit() {
-    var request []byte = meepodb.EncodeSym(meepodb.QUIT_CODE)
-    for _, fd := range servers {
-        if fd != - 1 {
-            Write(fd, request)
-            Close(fd)
-        }
+    if server != nil {
+        server.Close()
     }
 }
 
 func main() {
-    sort.Sort(sort.StringSlice(meepodb.SERVERS[:]))
-    /* Disable replica if the number of servers is less than 3 */
-    if meepodb.REPLICA && numberOfServers < 3 {
-        meepodb.REPLICA = false
-    }
-    println("replica:", meepodb.REPLICA)
-    /* Connect to servers */
-    for i, _ := range servers {
-        addr, err := net.ResolveTCPAddr("tcp", meepodb.SERVERS[i])
-        conn, err := net.DialTCP("tcp", nil, addr)
-        if err == nil {
-            println("connected to", meepodb.SERVERS[i])
-            file, _ := conn.File()
-            conn.Close()
-            servers[i] = int(file.Fd())
-            meepodb.SetKeepAlive(servers[i], 0)
-        } else {
-            fmt.Println(err)
-            /* Set server socket to -1 if connection fails */
-            servers[i] = -1
-        }
+    err := meepodb.ParseConfig()
+    if err != nil {
+        println("config:", err.Error())
+        println("PLEASE RUN:\tmeepodb-cli [-config file] [options]")
+        return
     }
+    if *sessions {
+        session = meepodb.NewSession()
+    }
+    connect()
     /* Start shell */
     println("\nMeepoDB Shell")
     for {
@@ -267,18 +373,18 @@ func main() {
         /* Check command format */
         switch string(tokens[0]) {
             case "GET":
-                if len(tokens) != 3 {
-                    println("*", "GET [TABLE] [KEY]")
+                if len(tokens) != 3 && len(tokens) != 4 {
+                    println("*", "GET [TABLE] [KEY] (ONE|QUORUM|ALL)")
                     continue
                 }
             case "SET":
-                if len(tokens) != 4 {
-                    println("*", "SET [TABLE] [KEY] [VALUE]")
+                if len(tokens) != 4 && len(tokens) != 5 {
+                    println("*", "SET [TABLE] [KEY] [VALUE] (ONE|QUORUM|ALL)")
                     continue
                 }
             case "DEL":
-                if len(tokens) != 3 {
-                    println("*", "DEL [TABLE] [KEY]")
+                if len(tokens) != 3 && len(tokens) != 4 {
+                    println("*", "DEL [TABLE] [KEY] (ONE|QUORUM|ALL)")
                     continue
                 }
             case "DROP":
@@ -286,6 +392,61 @@ func main() {
                     println("*", "DROP [TABLE]")
                     continue
                 }
+            case "TOPO":
+                if len(tokens) != 1 {
+                    println("*", "TOPO")
+                    continue
+                }
+            case "RAFT":
+                if len(tokens) != 2 {
+                    println("*", "RAFT [TABLE]")
+                    continue
+                }
+            case "SCAN", "KEYS":
+                if len(tokens) != 4 && len(tokens) != 5 {
+                    println("*", string(tokens[0]), "[TABLE] [START|-] [END|-] (LIMIT)")
+                    continue
+                }
+            case "SIZE":
+                if len(tokens) != 2 {
+                    println("*", "SIZE [TABLE]")
+                    continue
+                }
+            case "NEXT":
+                if len(tokens) != 1 {
+                    println("*", "NEXT")
+                    continue
+                }
+            case "RANGES":
+                if len(tokens) != 2 {
+                    println("*", "RANGES [TABLE]")
+                    continue
+                }
+            case "MOVE":
+                if len(tokens) != 4 {
+                    println("*", "MOVE [TABLE] [START] [SERVER,...]")
+                    continue
+                }
+            case "DRAIN":
+                if len(tokens) != 2 {
+                    println("*", "DRAIN [SERVER]")
+                    continue
+                }
+            case "HEALTH":
+                if len(tokens) > 2 {
+                    println("*", "HEALTH (TABLE)")
+                    continue
+                }
+            case "HINTS":
+                if len(tokens) != 1 {
+                    println("*", "HINTS")
+                    continue
+                }
+            case "LAG":
+                if len(tokens) != 1 {
+                    println("*", "LAG")
+                    continue
+                }
             case "QUIT":
                 if len(tokens) != 1 {
                     println("*", "QUIT")
@@ -295,13 +456,47 @@ func main() {
                 println("*", "unknown command")
                 continue
         }
+        var opts meepodb.RequestOptions
+        var ok bool = true
+        switch string(tokens[0]) {
+            case "GET", "DEL" : opts, ok = options(tokens, 3)
+            case "SET"        : opts, ok = options(tokens, 4)
+        }
+        if !ok {
+            continue
+        }
         /* Send command */
         switch string(tokens[0]) {
-            case "GET"  : get(tokens[1], tokens[2])
-            case "SET"  : set(tokens[1], tokens[2], tokens[3])
-            case "DEL"  : set(tokens[1], tokens[2], []byte(""))
-            case "DROP" : drop(tokens[1])
-            case "QUIT" : quit()
+            case "GET"   : get(tokens[1], tokens[2], opts)
+            case "SET"   : set(tokens[1], tokens[2], tokens[3], opts)
+            case "DEL"   : set(tokens[1], tokens[2], []byte(""), opts)
+            case "DROP"  : drop(tokens[1])
+            case "TOPO"  : topology()
+            case "RAFT"  : raft(tokens[1])
+            case "SCAN", "KEYS":
+                var code = meepodb.SCAN_CODE
+                if string(tokens[0]) == "KEYS" {
+                    code = meepodb.KEYS_CODE
+                }
+                var limit []byte
+                if len(tokens) == 5 {
+                    limit = tokens[4]
+                }
+                scan(code, tokens[1], tokens[2], tokens[3], limit)
+            case "NEXT"  : nextPage()
+            case "SIZE"  : size(tokens[1])
+            case "RANGES": ranges(tokens[1])
+            case "MOVE"  : move(tokens[1], tokens[2], tokens[3])
+            case "DRAIN" : drain(tokens[1])
+            case "HEALTH":
+                var table []byte
+                if len(tokens) == 2 {
+                    table = tokens[1]
+                }
+                health(table)
+            case "HINTS" : hints()
+            case "LAG"   : lag()
+            case "QUIT"  : quit()
         }
         /* Exit the client */
         if string(tokens[0]) == "QUIT" {
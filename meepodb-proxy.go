@@ -0,0 +1,320 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package main
+
+import (
+    "bufio"
+    "errors"
+    "flag"
+    "io"
+    "net"
+    "os"
+    "os/signal"
+    "strings"
+    "sync"
+    . "syscall"
+    "time"
+    "./meepodb"
+)
+
+/* Idle connections kept to each server */
+const IDLE_CONNS int = 64
+
+/* Time between polls of the topology for servers that are down */
+const TOPO_INTERVAL time.Duration = 5 * time.Second
+
+var listen = flag.String("listen", ":6630", "address to accept clients on")
+
+/*
+ *  The proxy takes requests from clients and sends each one to a server
+ *  owning its key, which coordinates it as any server would. Requests
+ *  without a consistency level get the levels of the proxy's config, so
+ *  clients behind it share one read and write policy. Servers reported down
+ *  by TOPO are tried last.
+ *
+ *  On SIGHUP the config is read again and the new servers take effect from
+ *  the next request on, while client connections stay open.
+ */
+
+/* Guards the settings of meepodb, which a reload changes */
+var config sync.RWMutex
+
+/* Servers down according to the last TOPO */
+var down sync.Map
+
+/* Idle connections to the servers, safe for concurrent use unlike
+   meepodb.Pool. */
+type backends struct {
+    lock  sync.Mutex
+    idle  map[string][]*meepodb.Peer
+}
+
+func (b *backends) get(addr string) (*meepodb.Peer, error) {
+    b.lock.Lock()
+    var peers = b.idle[addr]
+    if len(peers) > 0 {
+        var peer = peers[len(peers) - 1]
+        b.idle[addr] = peers[:len(peers) - 1]
+        b.lock.Unlock()
+        return peer, nil
+    }
+    b.lock.Unlock()
+    return meepodb.DialPeer(addr)
+}
+
+func (b *backends) put(peer *meepodb.Peer) {
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    if len(b.idle[peer.Addr]) >= IDLE_CONNS {
+        peer.Close()
+        return
+    }
+    b.idle[peer.Addr] = append(b.idle[peer.Addr], peer)
+}
+
+/* Send a request to the first server that answers, relaying its reply. A
+   kept connection may have been closed by the server, so one failing is
+   not held against the server. */
+func (b *backends) call(servers []string, request []byte) (byte, []byte, error) {
+    var err error
+    for _, addr := range servers {
+        for tries := 0; tries < 2; tries++ {
+            var peer *meepodb.Peer
+            var code byte
+            var value []byte
+            peer, err = b.get(addr)
+            if err != nil {
+                break
+            }
+            err = peer.Send(request)
+            if err == nil {
+                code, value, err = peer.Reply()
+                if err == nil {
+                    b.put(peer)
+                    return code, value, nil
+                }
+            }
+            peer.Close()
+        }
+        println("cannot send request to", addr)
+    }
+    if err == nil {
+        err = errors.New("no server configured")
+    }
+    return meepodb.ERR_CODE, nil, err
+}
+
+var pool = &backends{ idle: make(map[string][]*meepodb.Peer) }
+
+/* Servers to try for a request, owners of the key first. */
+func route(code byte, table, key []byte) []string {
+    config.RLock()
+    defer config.RUnlock()
+    var servers []string
+    switch code {
+        case meepodb.GET_CODE, meepodb.SET_CODE:
+            servers = meepodb.Owners(table, key)
+            /* Any server serves any key, should all owners be down */
+            for _, s := range meepodb.CurrentRing().Servers() {
+                if !contains(servers, s) {
+                    servers = append(servers, s)
+                }
+            }
+        default:
+            servers = append(servers, meepodb.CurrentRing().Servers()...)
+    }
+    var up, later []string
+    for _, s := range servers {
+        if _, ok := down.Load(s); ok {
+            later = append(later, s)
+        } else {
+            up = append(up, s)
+        }
+    }
+    return append(up, later...)
+}
+
+func contains(list []string, s string) bool {
+    for _, x := range list {
+        if x == s {
+            return true
+        }
+    }
+    return false
+}
+
+/* Add the levels of the config to a request that gives none. */
+func withPolicy(code byte, opts *meepodb.RequestOptions, request []byte) []byte {
+    if opts != nil && opts.Consistency != meepodb.DEFAULT_LEVEL {
+        return request
+    }
+    var policy meepodb.RequestOptions
+    if opts != nil {
+        policy = *opts
+    }
+    config.RLock()
+    switch code {
+        case meepodb.GET_CODE:
+            policy.Consistency = meepodb.READ_LEVEL
+        case meepodb.SET_CODE:
+            policy.Consistency = meepodb.WRITE_LEVEL
+    }
+    config.RUnlock()
+    if opts != nil {
+        /* Replace the options word in place */
+        copy(request[8:16], meepodb.Uint64ToBytes(policy.Encode()))
+        return request
+    }
+    return meepodb.WithOptions(request, policy)
+}
+
+/* Read a request as sent by a client, head, options and body. */
+func readRequest(reader *bufio.Reader) (byte, *meepodb.RequestOptions, []byte, []byte, []byte, error) {
+    var head = make([]byte, 16)
+    _, err := io.ReadFull(reader, head[:8])
+    if err != nil {
+        return 0, nil, nil, nil, nil, err
+    }
+    code, tlen, klen, vlen := meepodb.DecodeHead(head[:8])
+    var opts *meepodb.RequestOptions
+    if code & meepodb.OPTS_FLAG != 0 {
+        code &^= meepodb.OPTS_FLAG
+        _, err = io.ReadFull(reader, head[8:])
+        if err != nil {
+            return 0, nil, nil, nil, nil, err
+        }
+        var o = meepodb.DecodeOptions(meepodb.BytesToUint64(head[8:]))
+        opts = &o
+    } else {
+        head = head[:8]
+    }
+    var request = make([]byte, uint64(len(head)) + tlen + klen + vlen)
+    copy(request, head)
+    _, err = io.ReadFull(reader, request[len(head):])
+    if err != nil {
+        return 0, nil, nil, nil, nil, err
+    }
+    var body = request[len(head):]
+    return code, opts, request, body[:tlen], body[tlen : tlen + klen], nil
+}
+
+func reply(conn net.Conn, code byte, value []byte) error {
+    var buffer = make([]byte, 8 + len(value))
+    copy(buffer, meepodb.EncodeHead(code, 0, 0, uint64(len(value))))
+    copy(buffer[8:], value)
+    _, err := conn.Write(buffer)
+    return err
+}
+
+func serve(conn net.Conn) {
+    defer conn.Close()
+    var reader = bufio.NewReader(conn)
+    for {
+        code, opts, request, table, key, err := readRequest(reader)
+        if err != nil || code == meepodb.QUIT_CODE {
+            return
+        }
+        switch code {
+            case meepodb.GET_CODE, meepodb.SET_CODE:
+                request = withPolicy(code, opts, request)
+            case meepodb.DROP_CODE, meepodb.TOPO_CODE:
+            case meepodb.SCAN_CODE, meepodb.KEYS_CODE, meepodb.SIZE_CODE:
+            default:
+                /* The rest of the stream cannot be framed any more */
+                reply(conn, meepodb.ERR_CODE, []byte("request not served by the proxy"))
+                return
+        }
+        rcode, value, err := pool.call(route(code, table, key), request)
+        if err != nil {
+            value = []byte(meepodb.ErrUnavailable.Error() + ": " + err.Error())
+        }
+        if reply(conn, rcode, value) != nil {
+            return
+        }
+    }
+}
+
+/* Mark the servers TOPO reports down, asking any server that answers. */
+func pollTopology() {
+    for {
+        code, value, err := pool.call(route(meepodb.TOPO_CODE, nil, nil),
+                                      meepodb.EncodeSym(meepodb.TOPO_CODE))
+        if err == nil && code == meepodb.OK_CODE {
+            for _, line := range strings.Split(string(value), "\n") {
+                var fields = strings.Fields(line)
+                if len(fields) < 2 {
+                    continue
+                }
+                if fields[1] == "down" {
+                    down.Store(fields[0], true)
+                } else {
+                    down.Delete(fields[0])
+                }
+            }
+        }
+        time.Sleep(TOPO_INTERVAL)
+    }
+}
+
+func reload(hup chan os.Signal) {
+    for range hup {
+        config.Lock()
+        err := meepodb.ReloadConfig()
+        var servers = meepodb.SERVERS
+        config.Unlock()
+        if err != nil {
+            println("cannot reload config:", err.Error())
+            continue
+        }
+        println("reloaded config, servers:", strings.Join(servers, ","))
+    }
+}
+
+func main() {
+    err := meepodb.ParseConfig()
+    if err != nil {
+        println("config:", err.Error())
+        println("PLEASE RUN:\tmeepodb-proxy [-config file] [-listen addr] [options]")
+        return
+    }
+    listener, err := net.Listen("tcp", *listen)
+    if err != nil {
+        println("cannot listen on", *listen, "\b:", err.Error())
+        return
+    }
+    println("MeepoDB proxy on", listener.Addr().String(), "for",
+            strings.Join(meepodb.SERVERS, ","))
+    var hup = make(chan os.Signal, 1)
+    signal.Notify(hup, SIGHUP)
+    go reload(hup)
+    go pollTopology()
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            println("cannot accept:", err.Error())
+            continue
+        }
+        go serve(conn)
+    }
+}
@@ -26,33 +26,46 @@ package main
 import (
     "flag"
     "fmt"
-    "hash/fnv"
     "net"
-    "os"
     "sort"
     "strconv"
     "strings"
     . "syscall"
+    "time"
     "./meepodb"
 )
 
 func help() {
-    println("PLEASE RUN:\tmeepodb-server [port]")
+    println("PLEASE RUN:\tmeepodb-server [-config file] [options] [port]")
 }
 
 func main() {
-    /* Get port number from args */
-    flag.Parse()
-    if flag.NArg() != 1 {
+    err := meepodb.ParseConfig()
+    if err != nil {
+        println("config:", err.Error())
         help()
         return
     }
-    _, err := strconv.Atoi(flag.Arg(0))
-    if err != nil {
+    /* Get port number from args, or from the config */
+    var port = strconv.Itoa(meepodb.PORT)
+    if flag.NArg() > 1 {
         help()
         return
     }
-    /* Check whether the address is defined in config.go */
+    if flag.NArg() == 1 {
+        _, err = strconv.Atoi(flag.Arg(0))
+        if err != nil {
+            help()
+            return
+        }
+        port = flag.Arg(0)
+    }
+    /* A follower is none of the servers */
+    if len(meepodb.FOLLOW) > 0 {
+        follow(port)
+        return
+    }
+    /* Check whether the address is one of the configured servers */
     addrs, err := net.InterfaceAddrs()
     if err != nil {
         println("Check network interfaces.")
@@ -60,7 +73,7 @@ func main() {
     }
     var self string
     for _, addr := range addrs {
-        s := strings.Split(addr.String(), "/")[0] + ":" + flag.Arg(0)
+        s := strings.Split(addr.String(), "/")[0] + ":" + port
         for _, svr := range meepodb.SERVERS {
             if s == svr {
                 self = svr
@@ -73,12 +86,8 @@ func main() {
         return
     }
     /* Calculate cluster tag */
-    sort.Sort(sort.StringSlice(meepodb.SERVERS[:]))
-    hash := fnv.New64a()
-    for _, s := range meepodb.SERVERS {
-        hash.Write([]byte(s + "&"))
-    }
-    meepodb.CLUSTER_TAG = hash.Sum64()
+    sort.Strings(meepodb.SERVERS)
+    meepodb.CLUSTER_TAG = meepodb.ClusterTag()
     println("cluster tag:", meepodb.CLUSTER_TAG)
 
     var dir string = meepodb.DB_DIR
@@ -93,7 +102,7 @@ func main() {
             return
         }
         /* Create tag */
-        fd, err := Open(dir + "/tag", O_RDWR | O_CREAT, perm)
+        fd, err := Open(dir + "/" + meepodb.TAG_FILE, O_RDWR | O_CREAT, perm)
         if err != nil {
             fmt.Println("create tag:", err)
             return
@@ -104,33 +113,67 @@ func main() {
             return
         }
         Close(fd)
+        err = meepodb.WriteServers(dir)
+        if err != nil {
+            fmt.Println("write servers:", err)
+            return
+        }
     }
     /* If database exists... */
-    fd, err := Open(dir + "/tag", O_RDWR, perm)
+    fd, err := Open(dir + "/" + meepodb.TAG_FILE, O_RDWR, perm)
     if err != nil {
         fmt.Println("open tag:", err)
         return
     }
     var buffer = make([]byte, 8)
     n, err := Read(fd, buffer)
+    Close(fd)
     if err != nil || n != 8 {
         fmt.Println("read tag:", err)
-        Close(fd)
         return
     }
     var oldtag = meepodb.BytesToUint64(buffer)
-    /* If SERVERS in config.go changes... */
+    strg, err := meepodb.NewStorage(dir, &meepodb.Options{ Sync: meepodb.SYNC })
+    if err != nil {
+        fmt.Println("open storage:", err)
+        return
+    }
+    /* If the configured servers change, reallocate once the server is up,
+       since the other servers are reallocating to this one as well */
     if oldtag != meepodb.CLUSTER_TAG {
-        println("reallocating...")
-        meepodb.Reallocate(self)
-        Seek(fd, 0, os.SEEK_SET)
-        n, err = Write(fd, meepodb.Uint64ToBytes(meepodb.CLUSTER_TAG))
-        if err != nil || n != 8 {
-            println("update tag:", err)
-            Close(fd)
-            return
+        go reallocate(strg, self)
+    }
+    meepodb.NewServer(self, strg).Serve()
+}
+
+/* Keep read-only copies of the tables of the servers followed. */
+func follow(port string) {
+    println("Hi, MeepoDB follower of", strings.Join(meepodb.FOLLOW, ","), "on port", port)
+    var dir string = meepodb.DB_DIR
+    println("db dir:", dir)
+    err := Mkdir(dir, meepodb.S_IRWXA)
+    if err != nil && err != EEXIST {
+        fmt.Println("mkdir:", err)
+        return
+    }
+    strg, err := meepodb.NewStorage(dir, &meepodb.Options{ Sync: meepodb.SYNC })
+    if err != nil {
+        fmt.Println("open storage:", err)
+        return
+    }
+    meepodb.NewServer(":" + port, strg).Follow()
+}
+
+/* Retry until every record is where it belongs, which updates the tag. */
+func reallocate(strg *meepodb.Storage, self string) {
+    println("reallocating...")
+    for {
+        err := meepodb.Rebalance(strg, self)
+        if err == nil {
+            break
         }
+        println("cannot reallocate:", err.Error())
+        time.Sleep(5 * time.Second)
     }
-    Close(fd)
-    meepodb.StartServer(self)
+    println("reallocated")
 }
@@ -0,0 +1,171 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+)
+
+/*
+ *  Admin requests tell how a server is doing and have it do the work that
+ *  would otherwise take a restart, so that meepodb-admin can run a cluster
+ *  without reading the output of its servers. Replies are lines of text,
+ *  one "name value" pair per line for STAT and one table per line for TABS.
+ */
+
+/* State of a server as printed in reports */
+func stateName(state byte) string {
+    switch state {
+        case MEMBER_LEAVING:
+            return "leaving"
+        case MEMBER_LEFT:
+            return "left"
+    }
+    return "active"
+}
+
+/* How this server is doing. */
+func (srv *Server) status() ([]byte, error) {
+    tables, err := srv.strg.Tables()
+    if err != nil {
+        return nil, err
+    }
+    var records uint64
+    for _, table := range tables {
+        records += srv.strg.Size([]byte(table))
+    }
+    var hints int
+    if srv.hints != nil {
+        for _, n := range srv.hints.Pending() {
+            hints += n
+        }
+    }
+    var state = stateName(srv.members.State(srv.Addr))
+    if srv.follows != nil {
+        state = "follower"
+    }
+    var zone = ZoneOf(srv.Addr)
+    if _, ok := ZONES[srv.Addr]; !ok {
+        zone = "-"
+    }
+    var report strings.Builder
+    fmt.Fprintf(&report, "addr %s\n", srv.Addr)
+    fmt.Fprintf(&report, "state %s\n", state)
+    fmt.Fprintf(&report, "zone %s\n", zone)
+    fmt.Fprintf(&report, "uptime %s\n", time.Since(srv.started).Round(time.Second))
+    fmt.Fprintf(&report, "booting %t\n", srv.booting.Load())
+    fmt.Fprintf(&report, "tag %d\n", CLUSTER_TAG)
+    fmt.Fprintf(&report, "placed %d\n", placedTag(srv.strg.Dir()))
+    fmt.Fprintf(&report, "tables %d\n", len(tables))
+    fmt.Fprintf(&report, "records %d\n", records)
+    fmt.Fprintf(&report, "hints %d\n", hints)
+    fmt.Fprintf(&report, "rebalance %s\n", reallocReport())
+    if srv.changes != nil {
+        oldest, head := srv.changes.Bounds()
+        fmt.Fprintf(&report, "changes %d to %d\n", oldest, head)
+    }
+    if srv.follows != nil {
+        for _, line := range strings.Split(strings.TrimSpace(string(srv.follows.Report())), "\n") {
+            fmt.Fprintf(&report, "follow %s\n", line)
+        }
+    }
+    return []byte(report.String()), nil
+}
+
+/* Lines of "table kind replicas records" for the tables this server keeps
+   copies of, counting its own copies only. */
+func (srv *Server) tableList() ([]byte, error) {
+    tables, err := srv.strg.Tables()
+    if err != nil {
+        return nil, err
+    }
+    sort.Strings(tables)
+    var result []byte
+    for _, table := range tables {
+        var kind = "hashed"
+        switch {
+            case RangeTable([]byte(table)):
+                kind = "ranges"
+            case RaftTable([]byte(table)):
+                kind = "raft"
+        }
+        result = fmt.Appendf(result, "%s %s %d %d\n", table, kind, TableReplicas(table),
+                             srv.strg.Size([]byte(table)))
+    }
+    return result, nil
+}
+
+/* Compact every table, or one, into a single run each. */
+func (srv *Server) compact(table string) ([]byte, error) {
+    var tables = []string{ table }
+    if table == "" {
+        var err error
+        tables, err = srv.strg.Tables()
+        if err != nil {
+            return nil, err
+        }
+        sort.Strings(tables)
+    }
+    var result []byte
+    for _, name := range tables {
+        cola, err := srv.strg.ExistentCOLA([]byte(name))
+        if errors.Is(err, ErrNotFound) && table == "" {
+            continue
+        }
+        if err != nil {
+            return result, err
+        }
+        var start = time.Now()
+        runs, dropped, err := cola.Compact()
+        if err != nil {
+            return result, fmt.Errorf("%s: %w", name, err)
+        }
+        println("compacted", name, "\b:", runs, "runs,", dropped, "records dropped")
+        result = fmt.Appendf(result, "%s: %d runs into 1, %d records dropped in %s\n",
+                             name, runs, dropped, time.Since(start).Round(time.Millisecond))
+    }
+    return result, nil
+}
+
+/* Reallocate in the background, unless a reallocation is running. */
+func (srv *Server) startRebalance() error {
+    reallocs.lock.Lock()
+    defer reallocs.lock.Unlock()
+    if reallocs.running {
+        return fmt.Errorf("%w: a rebalance is running", ErrUnavailable)
+    }
+    /* Running from here, so that a second request is turned away */
+    reallocs.start()
+    go func() {
+        err := Rebalance(srv.strg, srv.Addr)
+        if err != nil {
+            println("cannot rebalance:", err.Error())
+        }
+    }()
+    return nil
+}
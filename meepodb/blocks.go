@@ -51,82 +51,123 @@ func (recs RecordSlice) Swap(i, j int) {
 type Blocks struct {
     fd       int
     compact  bool
-    count    uint64
-    records  RecordSlice
+    sync     bool           /* Fsync after every record */
+    count    uint64         /* Number of used slots */
+    list     *SkipList
     path     string
-    dict     map[string]uint64
 }
 
-func (blx *Blocks) Close() bool {
-    return Close(blx.fd) == nil
+func (blx *Blocks) Close() error {
+    err := Close(blx.fd)
+    if err != nil {
+        return pathError("close", blx.path, err)
+    }
+    return nil
 }
 
+/* Records in key order. */
 func (blx *Blocks) Records() RecordSlice {
-    return blx.records
+    var records = make(RecordSlice, 0, blx.list.Len())
+    for node := blx.list.First(); node != nil; node = node.Next() {
+        records = append(records, Record{ node.Key(), node.Value() })
+    }
+    return records
+}
+
+func (blx *Blocks) List() *SkipList {
+    return blx.list
 }
 
 func (blx *Blocks) Get(key []byte) []byte {
-    i, ok := blx.dict[string(key)]
-    if ok {
-        return blx.records[i].value
+    node := blx.list.Find(key)
+    if node != nil {
+        return node.Value()
     }
     return nil
 }
 
-func (blx *Blocks) Set(key, value []byte) bool {
-    i, ok := blx.dict[string(key)]
-    if ok {
-        ok = writeRecord(blx.fd, i, key, value)
-        if !ok {
-            return false
+func (blx *Blocks) Set(key, value []byte) error {
+    var v = make([]byte, len(value))
+    copy(v, value)
+    node := blx.list.Find(key)
+    if node != nil {
+        err := blx.writeRecord(node.index, key, value)
+        if err != nil {
+            return err
         }
-        blx.records[i].value = make([]byte, len(value))
-        copy(blx.records[i].value, value)
-        return true
+        blx.list.Put(node.key, v, node.index)
+        return nil
     }
     if blx.count < MAX_RECORDS {
-        i = blx.count
-        ok = writeRecord(blx.fd, i, key, value)
-        if !ok {
-            return false
+        var i uint64 = blx.count
+        err := blx.writeRecord(i, key, value)
+        if err != nil {
+            return err
         }
-        blx.records[i].key = make([]byte, len(key))
-        blx.records[i].value = make([]byte, len(value))
-        copy(blx.records[i].key, key)
-        copy(blx.records[i].value, value)
-        blx.dict[string(key)] = i
+        var k = make([]byte, len(key))
+        copy(k, key)
+        blx.list.Put(k, v, i)
         blx.count++
-        return true
+        return nil
+    }
+    return ErrFull
+}
+
+/* Start a new generation of records after they have been pushed down. The
+   old list is left to readers who may still hold it. */
+func (blx *Blocks) Reset() {
+    blx.count = 0
+    blx.list = NewSkipList(blx.list.cmp)
+}
+
+func (blx *Blocks) writeRecord(i uint64, key, value []byte) error {
+    err := writeRecord(blx.fd, i, key, value)
+    if err == nil && blx.sync {
+        err = Fsync(blx.fd)
     }
-    return false
+    if err != nil {
+        return pathError("write", blx.path, err)
+    }
+    return nil
 }
 
-func NewBlocks(path string) (*Blocks, bool) {
+func NewBlocks(path string, cmp Comparator) (*Blocks, error) {
     var err error
     var blx = new(Blocks)
     var mode int = O_WRONLY | O_CREAT | O_TRUNC
     blx.fd, err = Open(path, mode, S_IRALL | S_IWALL)
     if err != nil {
-        return nil, false
+        return nil, pathError("open", path, err)
     }
     blx.path = path
-    blx.records = make([]Record, MAX_RECORDS)
-    blx.dict = make(map[string]uint64, MAX_RECORDS)
-    return blx, true
+    blx.list = NewSkipList(cmp)
+    return blx, nil
 }
 
-func OpenBlocks(path string) (*Blocks, int64) {
+/* The second result is the length of the valid records, which may be followed
+   by a record torn by a crash. */
+func OpenBlocks(path string, cmp Comparator) (*Blocks, int64, error) {
     var err error
     var blx = new(Blocks)
     var mode int = O_RDWR | O_APPEND
     blx.fd, err = Open(path, mode, S_IRALL | S_IWALL)
     if err != nil {
-        return blx, -1
+        return blx, -1, pathError("open", path, err)
     }
 
     blx.path = path
-    blx.records = make([]Record, MAX_RECORDS)
-    blx.dict = make(map[string]uint64, MAX_RECORDS)
+    blx.list = NewSkipList(cmp)
+    /* Slots are replayed as they were written, and then the latest record of
+       each key goes to the list. */
+    var records = make(RecordSlice, MAX_RECORDS)
+    var dict = make(map[string]uint64, MAX_RECORDS)
+    defer func() {
+        for i := uint64(0); i < blx.count; i++ {
+            if j, ok := dict[string(records[i].key)]; ok && i == j {
+                blx.list.Put(records[i].key, records[i].value, i)
+            }
+        }
+    }()
     var trunc int64 = 0
     var buffer = make([]byte, 8)
     /* Record format:
@@ -141,89 +182,89 @@ func OpenBlocks(path string) (*Blocks, int64) {
             break
         }
         if err != nil || n != 8 {
-            return blx, trunc
+            return blx, trunc, nil
         }
         i, klen, vlen := decodeBlxHead(buffer)
         /* Read key */
-        blx.records[i].key = make([]byte, klen)
-        n, err = Read(blx.fd, blx.records[i].key)
+        records[i].key = make([]byte, klen)
+        n, err = Read(blx.fd, records[i].key)
         if err != nil || n != int(klen) {
-            return blx, trunc
+            return blx, trunc, nil
         }
         /* Read value */
-        blx.records[i].value = make([]byte, vlen)
-        n, err = Read(blx.fd, blx.records[i].value)
+        records[i].value = make([]byte, vlen)
+        n, err = Read(blx.fd, records[i].value)
         if err != nil || n != int(vlen) {
-            return blx, trunc
+            return blx, trunc, nil
         }
         /* Check whether there are more than one records of the key */
-        _, ok := blx.dict[string(blx.records[i].key)]
+        _, ok := dict[string(records[i].key)]
         if ok {
             blx.compact = true
         }
 
-        blx.dict[string(blx.records[i].key)] = i
+        dict[string(records[i].key)] = i
         if i + 1 > blx.count {
             blx.count = i + 1
         }
         trunc += 8 + int64(klen + vlen)
     }
-    return blx, trunc
+    return blx, trunc, nil
 }
 
-func WriteBlocks(blx *Blocks) bool {
+func WriteBlocks(blx *Blocks) error {
     var mode int = O_WRONLY | O_CREAT | O_TRUNC
     fd, err := Open(blx.path + ".1", mode, S_IRALL | S_IWALL)
     if err != nil {
-        return false
+        return pathError("open", blx.path + ".1", err)
     }
-    for i := uint64(0); i < blx.count; i++ {
-        ok := writeRecord(fd, i, blx.records[i].key, blx.records[i].value)
-        if !ok {
-            return false
+    for node := blx.list.First(); node != nil; node = node.Next() {
+        err = writeRecord(fd, node.index, node.Key(), node.Value())
+        if err != nil {
+            Close(fd)
+            return pathError("write", blx.path + ".1", err)
         }
     }
     Close(fd)
     err = Rename(blx.path + ".1", blx.path)
-    return err == nil
+    if err != nil {
+        return pathError("rename", blx.path, err)
+    }
+    return nil
 }
 
-func LoadBlocks(path string) (*Blocks, bool) {
-    blx, trunc := OpenBlocks(path)
-    if trunc == -1 {
-        return blx, false
+func LoadBlocks(path string, cmp Comparator) (*Blocks, error) {
+    blx, trunc, err := OpenBlocks(path, cmp)
+    if err != nil {
+        return nil, err
     } else if blx.compact {
         Close(blx.fd)
-        ok := WriteBlocks(blx)
-        if !ok {
-            return blx, false
+        err = WriteBlocks(blx)
+        if err != nil {
+            return nil, err
         }
-        blx, trunc = OpenBlocks(path)
-        if trunc == -1 {
-            return blx, false
+        blx, trunc, err = OpenBlocks(path, cmp)
+        if err != nil {
+            return nil, err
         }
     }
     Ftruncate(blx.fd, trunc)
-    return blx, true
+    return blx, nil
 }
 
-func writeRecord(fd int, i uint64, key []byte, value []byte) bool {
+func writeRecord(fd int, i uint64, key []byte, value []byte) error {
     klen := uint64(len(key))
     vlen := uint64(len(value))
     head := encodeBlxHead(i, klen, vlen)
-    n, err := Write(fd, head)
-    if err != nil || n != 8 {
-        return false
-    }
-    n, err = Write(fd, key)
-    if err != nil || n != int(klen) {
-        return false
+    err := writeAll(fd, head)
+    if err != nil {
+        return err
     }
-    n, err = Write(fd, value)
-    if err != nil || n != int(vlen) {
-        return false
+    err = writeAll(fd, key)
+    if err != nil {
+        return err
     }
-    return true
+    return writeAll(fd, value)
 }
 
 func decodeBlxHead(buffer []byte) (uint64, uint64, uint64) {
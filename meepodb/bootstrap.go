@@ -0,0 +1,385 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+    . "syscall"
+)
+
+/* Files pinned for servers copying them, one directory per server */
+const SNAPSHOTS_DIR string = ".snapshots"
+
+/* Files copied from another server, until their records are taken in */
+const BOOTSTRAP_DIR string = ".bootstrap"
+
+/* Bytes of a file sent by one FILE reply */
+const BOOT_CHUNK int = 1 << 20
+
+/* Time before an interrupted copy is tried again */
+const BOOT_RETRY time.Duration = 10 * time.Second
+
+/*
+ *  A server that starts empty, being new or replaced, copies the tables of a
+ *  peer instead of waiting for anti-entropy to bring them record by record.
+ *  The peer pins the files of every table in a directory of its own with SNAP:
+ *  runs are linked, since a push-down replaces a run by renaming another file
+ *  over it, and the meta and blx files are copied under the read lock, so the
+ *  copy is one consistent state of each table. The new server fetches those
+ *  files with FILE in chunks and appends them to its own copies, which tell
+ *  where to go on after a failure or a restart. The peer keeps the pinned
+ *  files until UNPN, so a copy resumes against the same state.
+ *
+ *  Once all files are copied, the records this server owns are written to its
+ *  tables by version, which leaves alone any newer write replicated to it
+ *  meanwhile, and the tables are synchronized with the peer to bring in the
+ *  writes made during the copy. Until then the local copies are not read.
+ */
+
+/* Pin the files making the current state of a table in dir. */
+func (cola *COLA) pin(dir string) error {
+    cola.lock.RLock()
+    defer cola.lock.RUnlock()
+    if cola.closed {
+        return ErrClosed
+    }
+    err := os.MkdirAll(dir, 0755)
+    if err != nil {
+        return err
+    }
+    err = os.Link(cola.Path + "/conf", dir + "/conf")
+    if err != nil {
+        return err
+    }
+    err = os.WriteFile(dir + "/meta", cola.Levels[:], 0644)
+    if err != nil {
+        return err
+    }
+    /* Blocks are appended under the write lock, so the file is complete */
+    blx, err := os.ReadFile(cola.Path + "/blx")
+    if err != nil {
+        return err
+    }
+    err = os.WriteFile(dir + "/blx", blx, 0644)
+    if err != nil {
+        return err
+    }
+    for level := range cola.extents {
+        for j := range cola.extents[level] {
+            var path = cola.runPath(level, j)
+            err = os.Link(path, dir + "/" + filepath.Base(path))
+            if err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+/* Names of snapshots are addresses of servers; names of files are table and
+   file name, as listed by SNAP. */
+func snapshotPath(strg *Storage, name string, file string) (string, error) {
+    if len(name) == 0 || name[0] == '.' || strings.Contains(name, "/") {
+        return "", ErrInvalid
+    }
+    var path = strg.Dir() + "/" + SNAPSHOTS_DIR + "/" + name
+    if file == "" {
+        return path, nil
+    }
+    var parts = strings.Split(file, "/")
+    if len(parts) != 2 || !validTableName(parts[0]) || len(parts[1]) == 0 ||
+       parts[1][0] == '.' {
+        return "", ErrInvalid
+    }
+    return path + "/" + file, nil
+}
+
+/* Pin every table for server name, unless done already, and list the files
+   as lines of "table/file size". */
+func (srv *Server) pinTables(name string) ([]byte, error) {
+    dir, err := snapshotPath(srv.strg, name, "")
+    if err != nil {
+        return nil, err
+    }
+    if _, err = os.Stat(dir); os.IsNotExist(err) {
+        err = os.RemoveAll(dir + ".1")
+        if err != nil {
+            return nil, err
+        }
+        tables, err := srv.strg.Tables()
+        if err != nil {
+            return nil, err
+        }
+        for _, table := range tables {
+            /* Raft groups send snapshots of their own */
+            if RAFT_TABLES[table] {
+                continue
+            }
+            cola, err := srv.strg.ExistentCOLA([]byte(table))
+            if err == nil {
+                err = cola.pin(dir + ".1/" + table)
+            }
+            if err != nil {
+                return nil, err
+            }
+        }
+        err = os.MkdirAll(dir + ".1", 0755)
+        if err == nil {
+            err = os.Rename(dir + ".1", dir)
+        }
+        if err != nil {
+            return nil, err
+        }
+        println("pinned tables for", name)
+    }
+    var manifest []byte
+    tables, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    for _, table := range tables {
+        files, err := os.ReadDir(dir + "/" + table.Name())
+        if err != nil {
+            return nil, err
+        }
+        for _, file := range files {
+            info, err := file.Info()
+            if err != nil {
+                return nil, err
+            }
+            manifest = fmt.Appendf(manifest, "%s/%s %d\n", table.Name(), file.Name(),
+                                   info.Size())
+        }
+    }
+    return manifest, nil
+}
+
+/* Up to BOOT_CHUNK bytes of a pinned file from offset on. */
+func (srv *Server) readPinned(name, file string, offset uint64) ([]byte, error) {
+    path, err := snapshotPath(srv.strg, name, file)
+    if err != nil {
+        return nil, err
+    }
+    fd, err := Open(path, O_RDONLY, 0)
+    if err != nil {
+        return nil, pathError("open", path, err)
+    }
+    defer Close(fd)
+    var buffer = make([]byte, BOOT_CHUNK)
+    n, err := Pread(fd, buffer, int64(offset))
+    if err != nil {
+        return nil, pathError("read", path, err)
+    }
+    return buffer[:n], nil
+}
+
+func (srv *Server) unpinTables(name string) error {
+    dir, err := snapshotPath(srv.strg, name, "")
+    if err != nil {
+        return err
+    }
+    return os.RemoveAll(dir)
+}
+
+/* Whether a copy from another server was left unfinished, and from which. */
+func pendingBootstrap(dir string) string {
+    source, err := os.ReadFile(dir + "/" + BOOTSTRAP_DIR + "/source")
+    if err != nil {
+        return ""
+    }
+    return string(source)
+}
+
+/* Copy the tables of source, trying again until it is done. */
+func (srv *Server) bootstrap(source string) {
+    var pool = NewPool()
+    defer pool.Close()
+    for {
+        err := srv.copyTables(pool, source)
+        if err == nil {
+            break
+        }
+        println("cannot bootstrap from", source, "\b:", err.Error())
+        time.Sleep(BOOT_RETRY)
+    }
+}
+
+func (srv *Server) copyTables(pool *Pool, source string) error {
+    var dir = srv.strg.Dir() + "/" + BOOTSTRAP_DIR
+    err := os.MkdirAll(dir, 0755)
+    if err != nil {
+        return err
+    }
+    err = replaceFile(dir + "/source", []byte(source))
+    if err != nil {
+        return err
+    }
+    manifest, err := pool.Call(source, EncodeRequest(SNAP_CODE, nil, []byte(srv.Addr), nil))
+    if err != nil {
+        return err
+    }
+    /* Files of another state of the peer cannot be gone on with */
+    old, err := os.ReadFile(dir + "/manifest")
+    if err == nil && !bytes.Equal(old, manifest) {
+        entries, _ := os.ReadDir(dir)
+        for _, entry := range entries {
+            if entry.IsDir() {
+                os.RemoveAll(dir + "/" + entry.Name())
+            }
+        }
+    }
+    err = replaceFile(dir + "/manifest", manifest)
+    if err != nil {
+        return err
+    }
+    var tables []string
+    var total, copied uint64
+    for _, line := range strings.Split(strings.TrimSpace(string(manifest)), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) == 0 {
+            continue
+        }
+        if len(fields) != 2 || strings.Count(fields[0], "/") != 1 {
+            return &RemoteError{ Addr: source, Msg: "bad file list" }
+        }
+        size, err := strconv.ParseUint(fields[1], 10, 64)
+        if err != nil {
+            return &RemoteError{ Addr: source, Msg: "bad file list" }
+        }
+        table, _, _ := strings.Cut(fields[0], "/")
+        if !contains(tables, table) {
+            tables = append(tables, table)
+        }
+        n, err := srv.copyFile(pool, source, fields[0], dir + "/" + fields[0], size)
+        if err != nil {
+            return err
+        }
+        total += size
+        copied += n
+    }
+    println("copied", copied, "of", total, "bytes from", source)
+    var records int
+    for _, table := range tables {
+        n, err := srv.takeRecords(table, dir + "/" + table)
+        if err != nil {
+            return err
+        }
+        records += n
+    }
+    _, err = pool.Call(source, EncodeRequest(UNPN_CODE, nil, []byte(srv.Addr), nil))
+    if err != nil {
+        println("cannot release files on", source, "\b:", err.Error())
+    }
+    err = os.RemoveAll(dir)
+    if err != nil {
+        return err
+    }
+    println("bootstrapped from", source, "\b:", records, "records")
+    /* Writes made during the copy */
+    for _, table := range tables {
+        err := srv.syncTable(pool, []byte(table), source)
+        if err != nil {
+            println("cannot sync", table, "with", source, "\b:", err.Error())
+        }
+    }
+    /* Reads are served once those writes are in too. A table that failed to
+       sync is left to anti-entropy. */
+    srv.booting.Store(false)
+    return nil
+}
+
+/* Fetch the rest of a file, as much as path does not have yet. */
+func (srv *Server) copyFile(pool *Pool, source, file, path string, size uint64) (uint64, error) {
+    err := os.MkdirAll(filepath.Dir(path), 0755)
+    if err != nil {
+        return 0, err
+    }
+    var mode int = O_WRONLY | O_CREAT
+    fd, err := Open(path, mode, S_IRALL | S_IWALL)
+    if err != nil {
+        return 0, pathError("open", path, err)
+    }
+    defer Close(fd)
+    var stat Stat_t
+    err = Fstat(fd, &stat)
+    if err != nil {
+        return 0, pathError("stat", path, err)
+    }
+    var offset = uint64(stat.Size)
+    if offset > size {
+        offset = 0
+        Ftruncate(fd, 0)
+    }
+    var start = offset
+    for offset < size {
+        var request = EncodeRequest(FILE_CODE, []byte(srv.Addr), []byte(file),
+                                    Uint64ToBytes(offset))
+        chunk, err := pool.Call(source, request)
+        if err != nil {
+            return offset - start, err
+        }
+        if len(chunk) == 0 {
+            return offset - start, &RemoteError{ Addr: source, Msg: file + " is short" }
+        }
+        _, err = Pwrite(fd, chunk, int64(offset))
+        if err != nil {
+            return offset - start, pathError("write", path, err)
+        }
+        offset += uint64(len(chunk))
+    }
+    err = Fsync(fd)
+    if err != nil {
+        return offset - start, pathError("fsync", path, err)
+    }
+    return offset - start, nil
+}
+
+/* Write the records of a copied table that this server owns to its own. */
+func (srv *Server) takeRecords(table, path string) (int, error) {
+    copied, err := OpenCOLA(path, srv.strg.opts)
+    if err != nil {
+        return 0, err
+    }
+    defer copied.Close()
+    var count int
+    var failed error
+    err = copied.ScanRecords(nil, nil, func(k, v []byte, version uint64) bool {
+        if !contains(Owners([]byte(table), k), srv.Addr) {
+            return true
+        }
+        _, failed = srv.strg.Put([]byte(table), k, v, version)
+        count++
+        return failed == nil
+    })
+    if err == nil {
+        err = failed
+    }
+    return count, err
+}
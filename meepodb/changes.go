@@ -0,0 +1,256 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strconv"
+    "sync"
+    . "syscall"
+    "time"
+)
+
+/* Directory of the change log, hidden from Tables as its name starts with
+   '.' */
+const CHANGES_DIR string = ".changes"
+
+/* Bytes of a segment of the change log before the next one is started */
+const CHANGES_SEGMENT uint64 = 64 << 20
+
+/* Bytes of changes in a TAIL reply, unless a single change is longer */
+const TAIL_CHUNK uint64 = 1 << 20
+
+/*
+ *  The change log has every write to the tables of a server in the order it
+ *  was made, for followers and subscriptions to tail, see Following and
+ *  Subscription. A change is framed as a request: SET with the stamped
+ *  record, or DROP of a table with a deleted record of the time it was.
+ *  Records moved away by a reallocation are not changes, as they live on
+ *  elsewhere.
+ *
+ *  Positions are byte offsets into the whole log, which is split into
+ *  segments named after the position they start at. A segment is removed
+ *  when a new one is started and its last change is RETAIN_CHANGES seconds
+ *  old, so a position before the oldest one kept is gone.
+ */
+type ChangeLog struct {
+    lock     sync.Mutex
+    dir      string
+    segments []uint64   /* Start of each segment, oldest first */
+    fd       int        /* Last segment, appended to           */
+    head     uint64     /* Position after the last change      */
+}
+
+func OpenChangeLog(dir string) (*ChangeLog, error) {
+    err := os.MkdirAll(dir, os.FileMode(S_IRWXA))
+    if err != nil {
+        return nil, err
+    }
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    var log = &ChangeLog{ dir: dir, fd: -1 }
+    for _, entry := range entries {
+        start, err := strconv.ParseUint(entry.Name(), 10, 64)
+        if err == nil {
+            log.segments = append(log.segments, start)
+        }
+    }
+    sort.Slice(log.segments, func(a, b int) bool {
+        return log.segments[a] < log.segments[b]
+    })
+    if len(log.segments) == 0 {
+        log.segments = []uint64{ 0 }
+    }
+    var last = log.segments[len(log.segments) - 1]
+    log.fd, err = Open(log.segmentPath(last), O_RDWR | O_CREAT | O_APPEND, S_IRALL | S_IWALL)
+    if err != nil {
+        return nil, pathError("open", log.segmentPath(last), err)
+    }
+    /* A change cut off by a crash is dropped */
+    size, err := log.validSize(log.fd)
+    if err == nil {
+        err = Ftruncate(log.fd, int64(size))
+    }
+    if err != nil {
+        Close(log.fd)
+        return nil, pathError("truncate", log.segmentPath(last), err)
+    }
+    log.head = last + size
+    log.prune()
+    return log, nil
+}
+
+func (log *ChangeLog) segmentPath(start uint64) string {
+    return fmt.Sprintf("%s/%020d", log.dir, start)
+}
+
+/* Bytes of whole changes at the beginning of a segment. */
+func (log *ChangeLog) validSize(fd int) (uint64, error) {
+    var stat Stat_t
+    err := Fstat(fd, &stat)
+    if err != nil {
+        return 0, err
+    }
+    var offset uint64
+    var head = make([]byte, 8)
+    for offset + 8 <= uint64(stat.Size) {
+        n, err := Pread(fd, head, int64(offset))
+        if err != nil {
+            return 0, err
+        }
+        if n != 8 {
+            break
+        }
+        _, tlen, klen, vlen := DecodeHead(head)
+        if offset + 8 + tlen + klen + vlen > uint64(stat.Size) {
+            break
+        }
+        offset += 8 + tlen + klen + vlen
+    }
+    return offset, nil
+}
+
+/* Add a change, starting a new segment if the last one is full. */
+func (log *ChangeLog) Append(code byte, table, key, record []byte) error {
+    var change = EncodeRequest(code, table, key, record)
+    log.lock.Lock()
+    defer log.lock.Unlock()
+    var last = log.segments[len(log.segments) - 1]
+    if log.head - last >= CHANGES_SEGMENT {
+        fd, err := Open(log.segmentPath(log.head), O_RDWR | O_CREAT | O_APPEND,
+                        S_IRALL | S_IWALL)
+        if err != nil {
+            return pathError("open", log.segmentPath(log.head), err)
+        }
+        Close(log.fd)
+        log.fd = fd
+        log.segments = append(log.segments, log.head)
+        log.prune()
+    }
+    err := writeAll(log.fd, change)
+    if err != nil {
+        /* Whatever got written would be taken as a change cut off */
+        Ftruncate(log.fd, int64(log.head - log.segments[len(log.segments) - 1]))
+        return pathError("write", log.segmentPath(log.segments[len(log.segments) - 1]), err)
+    }
+    log.head += uint64(len(change))
+    return nil
+}
+
+/* Remove the segments past retention, oldest first, never the last one. A
+   segment was last written when its last change was made. */
+func (log *ChangeLog) prune() {
+    var horizon = time.Now().Add(-time.Duration(RETAIN_CHANGES) * time.Second)
+    for len(log.segments) > 1 {
+        info, err := os.Stat(log.segmentPath(log.segments[0]))
+        if err == nil && info.ModTime().After(horizon) {
+            break
+        }
+        os.Remove(log.segmentPath(log.segments[0]))
+        log.segments = log.segments[1:]
+    }
+}
+
+/* Oldest position kept and the position after the last change. */
+func (log *ChangeLog) Bounds() (uint64, uint64) {
+    log.lock.Lock()
+    defer log.lock.Unlock()
+    return log.segments[0], log.head
+}
+
+/* Changes from position on, about TAIL_CHUNK bytes of them, and the position
+   after them. ErrNotFound is returned if position is gone or beyond the
+   head. */
+func (log *ChangeLog) Read(position uint64) ([]byte, uint64, error) {
+    log.lock.Lock()
+    var i = sort.Search(len(log.segments), func(i int) bool {
+        return log.segments[i] > position
+    }) - 1
+    var head = log.head
+    if i < 0 || position > head {
+        log.lock.Unlock()
+        return nil, position, ErrNotFound
+    }
+    var start = log.segments[i]
+    var end = head
+    if i + 1 < len(log.segments) {
+        end = log.segments[i + 1]
+    }
+    /* Opened under the lock, so that the segment is not removed first */
+    var path = log.segmentPath(start)
+    fd, err := Open(path, O_RDONLY, 0)
+    log.lock.Unlock()
+    if err != nil {
+        return nil, position, pathError("open", path, err)
+    }
+    defer Close(fd)
+    var result []byte
+    var head8 = make([]byte, 8)
+    for position < end && uint64(len(result)) < TAIL_CHUNK {
+        _, err = Pread(fd, head8, int64(position - start))
+        if err != nil {
+            return nil, position, pathError("read", path, err)
+        }
+        _, tlen, klen, vlen := DecodeHead(head8)
+        var change = make([]byte, 8 + tlen + klen + vlen)
+        n, err := Pread(fd, change, int64(position - start))
+        if err == nil && n != len(change) {
+            err = io.ErrUnexpectedEOF
+        }
+        if err != nil {
+            return nil, position, pathError("read", path, err)
+        }
+        result = append(result, change...)
+        position += uint64(len(change))
+    }
+    return result, position, nil
+}
+
+/* The changes of one table among changes read. */
+func tableChanges(changes, table []byte) []byte {
+    var result []byte
+    for len(changes) >= 8 {
+        _, tlen, klen, vlen := DecodeHead(changes[:8])
+        var size = 8 + tlen + klen + vlen
+        if uint64(len(changes)) < size {
+            break
+        }
+        if string(changes[8 : 8 + tlen]) == string(table) {
+            result = append(result, changes[:size]...)
+        }
+        changes = changes[size:]
+    }
+    return result
+}
+
+func (log *ChangeLog) Close() error {
+    log.lock.Lock()
+    defer log.lock.Unlock()
+    return Close(log.fd)
+}
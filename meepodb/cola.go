@@ -23,249 +23,716 @@
 package meepodb
 
 import (
+    "bytes"
+    "compress/flate"
+    "fmt"
+    "io"
     "os"
     "strconv"
+    "sync"
     . "syscall"
 )
 
+/*
+ *  COLA is safe for concurrent use. Readers share the lock and a writer takes
+ *  it alone, including the merges of PushDown, since merged runs are unmapped.
+ */
 type COLA struct {
+    lock      sync.RWMutex
+    closed    bool
     MetaFd    int
-    Bitmap    uint64
+    Levels    [MAX_LEVELS]uint8     /* Number of runs in each level */
+    Policy    Policy
     blocks    *Blocks
-    extents   [64]*Extent
+    extents   [MAX_LEVELS][]*Extent /* Runs of a level, oldest first */
     Path      string
+    bufsize   uint64                /* Records in blocks before a push-down */
+    compress  byte
+    cmp       Comparator
 }
 
-func (cola *COLA) Close() {
-    cola.blocks.Close()
-    for i := int(MAX_RECORDS); i > 0; i <<= 1 {
-        if uint64(i) & cola.Bitmap > 0 {
-            cola.extents[log(i)].Free()
+func (cola *COLA) Close() error {
+    cola.lock.Lock()
+    defer cola.lock.Unlock()
+    if cola.closed {
+        return nil
+    }
+    cola.closed = true
+    var result error = cola.blocks.Close()
+    for level := range cola.extents {
+        for _, ext := range cola.extents[level] {
+            err := ext.Free()
+            if result == nil {
+                result = err
+            }
         }
     }
     Close(cola.MetaFd)
+    return result
 }
 
-func (cola *COLA) Keys() []string {
-    var exist = make(map[string]bool, MAX_RECORDS)
-    var delt = make(map[string]bool, MAX_RECORDS)
-    /* Traverse blocks */
-    for i := uint64(0); i < cola.blocks.count; i++ {
-        if len(cola.blocks.records[i].value) == 0 {
-            delt[string(cola.blocks.records[i].key)] = true
-        } else {
-            exist[string(cola.blocks.records[i].key)] = true
-        }
+/* Sources from the newest to the oldest. Callers hold the lock. */
+func (cola *COLA) iterator(start []byte) *mergeIterator {
+    var iter = &mergeIterator{ cmp: cola.cmp }
+    var list = cola.blocks.List()
+    if start == nil {
+        iter.sources = append(iter.sources, &listSource{ list.First() })
+    } else {
+        iter.sources = append(iter.sources, &listSource{ list.Seek(start) })
     }
-    /* Traverse extents */
-    for i := int(MAX_RECORDS); i > 0; i <<= 1 {
-        if uint64(i) & cola.Bitmap > 0 {
-            var j int = log(i)
-            var total = cola.extents[j].Count()
-            for t := uint64(0); t < total; t++ {
-                k, v := cola.extents[j].Record(t)
-                s := string(k)
-                if _, ok := exist[s]; ok {
-                    continue
-                }
-                if _, ok := delt[s]; ok {
-                    continue
-                }
-                if len(v) == 0 {
-                    delt[s] = true
-                } else {
-                    exist[s] = true
-                }
+    for level := range cola.extents {
+        for j := len(cola.extents[level]) - 1; j >= 0; j-- {
+            var ext = cola.extents[level][j]
+            var i uint64 = 0
+            if start != nil {
+                i = ext.Seek(start, cola.cmp)
             }
+            iter.sources = append(iter.sources, &extentSource{ ext, i })
         }
     }
-    /* Return existent keys */
-    var keys = make([]string, len(exist))
-    var i int = 0
-    for k, _ := range exist {
-        keys[i] = k
-        i++
+    return iter
+}
+
+/*
+ *  Call fn on the existent records in [start, end) in key order until fn
+ *  returns false. A nil start or end leaves the range open on that side. The
+ *  table is read-locked meanwhile, so fn must not write to it.
+ */
+func (cola *COLA) Scan(start, end []byte, fn func(key, value []byte) bool) error {
+    return cola.ScanVersions(start, end, func(key, value []byte, version uint64) bool {
+        return fn(key, value)
+    })
+}
+
+/* Scan with the version of each record. */
+func (cola *COLA) ScanVersions(start, end []byte,
+                               fn func(key, value []byte, version uint64) bool) error {
+    return cola.scan(start, end, false, fn)
+}
+
+/* Scan deleted records as well, which come with empty values. */
+func (cola *COLA) ScanRecords(start, end []byte,
+                              fn func(key, value []byte, version uint64) bool) error {
+    return cola.scan(start, end, true, fn)
+}
+
+func (cola *COLA) scan(start, end []byte, deletions bool,
+                       fn func(key, value []byte, version uint64) bool) error {
+    cola.lock.RLock()
+    defer cola.lock.RUnlock()
+    if cola.closed {
+        return ErrClosed
+    }
+    var iter = cola.iterator(start)
+    for {
+        k, record, ok := iter.Next()
+        if !ok || (end != nil && cola.cmp.Compare(k, end) >= 0) {
+            return nil
+        }
+        if deleted(record) && !deletions {
+            continue
+        }
+        version, v := Unstamp(record)
+        v, err := cola.decode(v)
+        if err != nil {
+            return err
+        }
+        if !fn(k, v, version) {
+            return nil
+        }
     }
-    return keys[:]
+}
+
+/* Existent keys in key order. */
+func (cola *COLA) Keys() []string {
+    var keys = make([]string, 0, MAX_RECORDS)
+    cola.Scan(nil, nil, func(key, value []byte) bool {
+        keys = append(keys, string(key))
+        return true
+    })
+    return keys
 }
 
 func (cola *COLA) Size() uint64 {
     return uint64(len(cola.Keys()))
 }
 
-func (cola *COLA) Get(key []byte) []byte {
-    var value []byte
+func (cola *COLA) Get(key []byte) ([]byte, error) {
+    value, _, err := cola.GetVersion(key)
+    return value, err
+}
+
+/* ErrNotFound is returned if the key does not exist, along with the version
+   it was deleted at if it was. */
+func (cola *COLA) GetVersion(key []byte) ([]byte, uint64, error) {
+    cola.lock.RLock()
+    defer cola.lock.RUnlock()
+    if cola.closed {
+        return nil, 0, ErrClosed
+    }
+    record, ok := cola.find(key)
+    if !ok {
+        return nil, 0, ErrNotFound
+    }
+    version, value := Unstamp(record)
+    if len(value) == 0 {
+        return nil, version, ErrNotFound
+    }
+    value, err := cola.decode(value)
+    return value, version, err
+}
+
+/* The latest record of key. */
+func (cola *COLA) find(key []byte) ([]byte, bool) {
     /* Try to get from blocks */
-    value = cola.blocks.Get(key)
-    if value != nil {
-        return value
-    }
-    /* Get from extents */
-    for i := int(MAX_RECORDS); i > 0; i <<= 1 {
-        if uint64(i) & cola.Bitmap > 0 {
-            j := cola.extents[log(i)].Find(key)
-            if j >= 0 {
-                _, value = cola.extents[log(i)].Record(uint64(j))
-                return value
+    if record := cola.blocks.Get(key); record != nil {
+        return record, true
+    }
+    /* Get from extents, the newest run first */
+    for level := range cola.extents {
+        for j := len(cola.extents[level]) - 1; j >= 0; j-- {
+            var ext = cola.extents[level][j]
+            i := ext.Find(key, cola.cmp)
+            if i >= 0 {
+                _, record := ext.Record(uint64(i))
+                return record, true
             }
         }
     }
-    return nil
+    return nil, false
 }
 
-func (cola *COLA) Set(key, value []byte) bool {
-    var ok bool = cola.blocks.Set(key, value)
-    if !ok {
-        return false
+/* Write a new version of key. An empty value deletes the key. */
+func (cola *COLA) Set(key, value []byte) error {
+    _, err := cola.Put(key, value, CLOCK.Now())
+    return err
+}
+
+/* Write key at version unless the table has a newer version of it already.
+   The result tells whether it was written. */
+func (cola *COLA) Put(key, value []byte, version uint64) (bool, error) {
+    return cola.PutThen(key, value, version, nil)
+}
+
+/* Put, calling written if the record was written, before any other write to
+   the table, so that writes are seen in the order they were made. */
+func (cola *COLA) PutThen(key, value []byte, version uint64, written func()) (bool, error) {
+    if uint64(len(key)) > MAX_KEY_LEN || uint64(len(value)) > MAX_VALUE_LEN {
+        return false, ErrInvalid
+    }
+    CLOCK.Update(version)
+    value, err := cola.encode(value)
+    if err != nil {
+        return false, err
     }
-    if cola.blocks.count == MAX_RECORDS {
-        return cola.PushDown()
+    var record = Stamp(version, value)
+    cola.lock.Lock()
+    defer cola.lock.Unlock()
+    if cola.closed {
+        return false, ErrClosed
     }
-    return true
+    if old, ok := cola.find(key); ok && recordVersion(old) > version {
+        return false, nil
+    }
+    err = cola.blocks.Set(key, record)
+    if err != nil {
+        return false, err
+    }
+    if written != nil {
+        written()
+    }
+    if cola.blocks.count >= cola.bufsize {
+        return true, cola.pushDown()
+    }
+    return true, nil
+}
+
+func (cola *COLA) encode(value []byte) ([]byte, error) {
+    if cola.compress == NO_COMPRESSION || len(value) == 0 {
+        return value, nil
+    }
+    var buffer bytes.Buffer
+    writer, err := flate.NewWriter(&buffer, flate.BestSpeed)
+    if err != nil {
+        return nil, err
+    }
+    writer.Write(value)
+    writer.Close()
+    return buffer.Bytes(), nil
+}
+
+func (cola *COLA) decode(value []byte) ([]byte, error) {
+    if cola.compress == NO_COMPRESSION || len(value) == 0 {
+        return value, nil
+    }
+    var reader = flate.NewReader(bytes.NewReader(value))
+    defer reader.Close()
+    result, err := io.ReadAll(reader)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s: %v", ErrCorrupt, cola.Path, err)
+    }
+    return result, nil
+}
+
+func (cola *COLA) PushDown() error {
+    cola.lock.Lock()
+    defer cola.lock.Unlock()
+    if cola.closed {
+        return ErrClosed
+    }
+    return cola.pushDown()
 }
 
-func (cola *COLA) PushDown() bool {
-    var ext *Extent = BlocksToMemExtent(cola.blocks.records)
-    var i int
-    for i = int(MAX_RECORDS); i > 0; i <<= 1 {
-        /* If current extent does not exist... */
-        if uint64(i) & cola.Bitmap == 0 {
-            if uint64(i) > cola.Bitmap {
-                CompactMemExtent(ext)
+func (cola *COLA) pushDown() error {
+    var ext *Extent = BlocksToMemExtent(cola.blocks.Records())
+    var level int
+    for level = 0; level < MAX_LEVELS; level++ {
+        var runs = len(cola.extents[level])
+        /* If current level has room for one more run... */
+        if runs < cola.Policy.Runs() {
+            /* Deleted records can be dropped only by the oldest run */
+            if runs == 0 && cola.bottom(level) {
+                CompactMemExtent(ext, tombstoneHorizon())
             }
-            cola.Bitmap |= uint64(i)
             break
         }
-        /* Merge current extent and pushed-down extent */
-        ext = MergeMemExtents(cola.extents[log(i)], ext)
-        cola.extents[log(i)].Free()
+        /* Merge all the runs of current level and pushed-down extent */
+        for j := runs - 1; j >= 0; j-- {
+            ext = MergeMemExtents(cola.extents[level][j], ext, cola.cmp)
+            cola.extents[level][j].Free()
+        }
+        cola.extents[level] = nil
+        cola.Levels[level] = 0
         /* If reach the bottom... */
-        if cola.Bitmap & ^uint64(i) < uint64(i) {
-            CompactMemExtent(ext)
+        if cola.bottom(level) {
+            CompactMemExtent(ext, tombstoneHorizon())
         }
-        /* If merged size can fit current extent... */
-        if ext.total <= uint64(i) {
+        /* If merged size can fit current level... */
+        if cola.Policy.Merge == MERGE_LEVELED &&
+           ext.total <= cola.Policy.Capacity(level) {
             break
         }
-        cola.Bitmap &= ^uint64(i)
-    }
-    /* Write the new extent to disk */
-    var path string = cola.Path + "/ext_" + strconv.Itoa(i)
-    var mode int = O_WRONLY | O_CREAT | O_TRUNC
-    fd, err := Open(path + ".1", mode, S_IRALL | S_IWALL)
-    if err != nil {
-        return false
     }
-    n, err := Write(fd, ext.raw)
-    if err != nil || n != int(ext.size) {
-        return false
+    if level == MAX_LEVELS {
+        return fmt.Errorf("%w: %s has no level left", ErrFull, cola.Path)
     }
-    Close(fd)
-    err = Rename(path + ".1", path)
+    /* Write the new extent to disk */
+    var path string = cola.runPath(level, len(cola.extents[level]))
+    err := writeExtent(path, ext)
     if err != nil {
-        return false
+        return err
     }
     /* Load the new extent to memory */
-    var ok bool
-    cola.extents[log(i)], ok = OpenExtent(path)
-    if !ok {
-        return false
+    run, err := OpenExtent(path)
+    if err != nil {
+        return err
     }
-    /* Update the bitmap on disk */
-    n, err = Write(cola.MetaFd, Uint64ToBytes(cola.Bitmap))
-    if err != nil || n != 8 {
-        return false
+    cola.extents[level] = append(cola.extents[level], run)
+    cola.Levels[level]++
+    /* Update the levels on disk */
+    err = cola.writeLevels()
+    if err != nil {
+        return err
     }
     /* Flush blocks in memory or blx file on disk when it gets large */
     offset, err := Seek(cola.blocks.fd, 0, os.SEEK_CUR)
     if err != nil {
-        return false
+        return pathError("seek", cola.blocks.path, err)
     }
     if offset < BLX_BUF_SIZE {
-        cola.blocks.count = 0
-        cola.blocks.dict = make(map[string]uint64, MAX_RECORDS)
-        return true
+        cola.blocks.Reset()
+        return nil
     }
+    var sync = cola.blocks.sync
     cola.blocks.Close()
-    cola.blocks, ok = NewBlocks(cola.Path + "/blx")
-    return ok
+    cola.blocks, err = NewBlocks(cola.Path + "/blx", cola.cmp)
+    if err != nil {
+        return err
+    }
+    cola.blocks.sync = sync
+    return nil
+}
+
+/* Merge every run into one at the deepest level, dropping deleted records and
+   the older copies of records. The result tells how many runs there were and
+   how many records went. */
+func (cola *COLA) Compact() (int, uint64, error) {
+    cola.lock.Lock()
+    defer cola.lock.Unlock()
+    if cola.closed {
+        return 0, 0, ErrClosed
+    }
+    var before = cola.blocks.List().Len()
+    var pushed = before > 0
+    for level := range cola.extents {
+        for _, run := range cola.extents[level] {
+            before += run.total
+        }
+    }
+    if pushed {
+        err := cola.pushDown()
+        if err != nil {
+            return 0, 0, err
+        }
+    }
+    /* Runs from the oldest to the newest */
+    var runs []*Extent
+    var deepest int
+    var after uint64
+    for level := MAX_LEVELS - 1; level >= 0; level-- {
+        if len(runs) == 0 && len(cola.extents[level]) > 0 {
+            deepest = level
+        }
+        for _, run := range cola.extents[level] {
+            runs = append(runs, run)
+            after += run.total
+        }
+    }
+    if len(runs) == 0 {
+        return 0, before - after, nil
+    }
+    var ext = runs[0]
+    if len(runs) == 1 {
+        /* A lone run may still keep deletions whose grace has run out;
+           compacting replaces the records, which of a run are mapped */
+        ext = OpenMemExtent(clone(ext.raw))
+    }
+    for _, run := range runs[1:] {
+        ext = MergeMemExtents(ext, run, cola.cmp)
+    }
+    CompactMemExtent(ext, tombstoneHorizon())
+    if len(runs) == 1 && ext.total == runs[0].total {
+        return 1, before - after, nil
+    }
+    var path = cola.runPath(deepest, 0)
+    err := writeExtent(path, ext)
+    if err != nil {
+        return 0, 0, err
+    }
+    run, err := OpenExtent(path)
+    if err != nil {
+        return 0, 0, err
+    }
+    for level := range cola.extents {
+        for _, old := range cola.extents[level] {
+            old.Free()
+        }
+        cola.extents[level] = nil
+        cola.Levels[level] = 0
+    }
+    cola.extents[deepest] = []*Extent{ run }
+    cola.Levels[deepest] = 1
+    err = cola.writeLevels()
+    if err != nil {
+        return 0, 0, err
+    }
+    return len(runs), before - run.total, nil
+}
+
+func writeExtent(path string, ext *Extent) error {
+    var mode int = O_WRONLY | O_CREAT | O_TRUNC
+    fd, err := Open(path + ".1", mode, S_IRALL | S_IWALL)
+    if err != nil {
+        return pathError("open", path + ".1", err)
+    }
+    err = writeAll(fd, ext.raw)
+    Close(fd)
+    if err != nil {
+        return pathError("write", path + ".1", err)
+    }
+    err = Rename(path + ".1", path)
+    if err != nil {
+        return pathError("rename", path, err)
+    }
+    return nil
+}
+
+/* Check whether no deeper level holds any run. */
+func (cola *COLA) bottom(level int) bool {
+    for i := level + 1; i < MAX_LEVELS; i++ {
+        if cola.Levels[i] > 0 {
+            return false
+        }
+    }
+    return true
+}
+
+/* The first run of a level is named after its capacity as the doubling COLA
+   always did, e.g. ext_8192, and the others get a suffix, e.g. ext_8192_1. */
+func (cola *COLA) runPath(level, run int) string {
+    var capacity = cola.Policy.Capacity(level)
+    var path = cola.Path + "/ext_" + strconv.FormatUint(capacity, 10)
+    if run > 0 {
+        path += "_" + strconv.Itoa(run)
+    }
+    return path
 }
 
-func NewCOLA(path string) (*COLA, bool) {
-    err := Mkdir(path, S_IRALL | S_IWALL | S_IXALL)
+/* Meta is a log of level snapshots, one byte for each level. */
+func (cola *COLA) writeLevels() error {
+    err := writeAll(cola.MetaFd, cola.Levels[:])
     if err != nil {
-        return nil, false
+        return pathError("write", cola.Path + "/meta", err)
+    }
+    return nil
+}
+
+/* Policy, compression and comparator are taken from opts and kept by the
+   table for good, while the others apply to this process only. */
+func NewCOLA(path string, opts *Options) (*COLA, error) {
+    opts, err := opts.complete()
+    if err != nil {
+        return nil, err
+    }
+    err = Mkdir(path, S_IRALL | S_IWALL | S_IXALL)
+    if err != nil {
+        return nil, pathError("mkdir", path, err)
     }
     var cola = new(COLA)
+    cola.Path = path
+    cola.Policy = opts.Policy
+    cola.compress = opts.Compression
+    cola.cmp = opts.Comparator
+    cola.bufsize = opts.WriteBufferSize
+    /* conf */
+    var conf = tableConf{ opts.Policy, opts.Compression, opts.Comparator.Name(),
+                          VERSIONED_RECORDS }
+    err = writeConf(path + "/conf", conf)
+    if err != nil {
+        return nil, err
+    }
     /* meta */
     var mode int = O_WRONLY | O_CREAT
     cola.MetaFd, err = Open(path + "/meta", mode, S_IRALL | S_IWALL)
     if err != nil {
-        return nil, false
+        return nil, pathError("open", path + "/meta", err)
     }
-    n, err := Write(cola.MetaFd, Uint64ToBytes(cola.Bitmap))
-    if err != nil || n != 8 {
-        return nil, false
+    err = cola.writeLevels()
+    if err != nil {
+        return nil, err
     }
     /* blx */
-    var ok bool
-    cola.blocks, ok = NewBlocks(path + "/blx")
-    if !ok {
-        return nil, false
+    cola.blocks, err = NewBlocks(path + "/blx", cola.cmp)
+    if err != nil {
+        return nil, err
     }
-    cola.Path = path
-    return cola, true
+    cola.blocks.sync = opts.Sync
+    return cola, nil
 }
 
-func OpenCOLA(path string) (*COLA, bool) {
-    var err error
+func OpenCOLA(path string, opts *Options) (*COLA, error) {
+    opts, err := opts.complete()
+    if err != nil {
+        return nil, err
+    }
     var cola = new(COLA)
+    cola.Path = path
+    /* Tables without conf were created by the doubling COLA */
+    var conf tableConf
+    _, err = os.Stat(path + "/conf")
+    if os.IsNotExist(err) {
+        conf = tableConf{ DEFAULT_POLICY, NO_COMPRESSION, BytewiseComparator.Name(),
+                          RAW_RECORDS }
+        err = upgradeMeta(path, conf)
+    } else {
+        conf, err = readConf(path + "/conf")
+        if err == nil {
+            err = finishMeta(path)
+        }
+    }
+    if err != nil {
+        return nil, err
+    }
     cola.MetaFd, err = Open(path + "/meta", O_RDWR, S_IRALL | S_IWALL)
     if err != nil {
-        return nil, false
+        return nil, pathError("open", path + "/meta", err)
     }
-    /* Read last bitmap */
-    Seek(cola.MetaFd, -8, os.SEEK_END)
-    var buffer = make([]byte, 8)
-    n, err := Read(cola.MetaFd, buffer)
-    if err != nil || n != 8 {
-        return nil, false
+    if conf.comparator != opts.Comparator.Name() {
+        Close(cola.MetaFd)
+        return nil, fmt.Errorf("%w: %s is ordered by %s, not %s", ErrInvalid,
+                               path, conf.comparator, opts.Comparator.Name())
     }
-    cola.Bitmap = BytesToUint64(buffer)
-    /* Delete all the old bitmaps */
+    cola.Policy = conf.policy
+    cola.compress = conf.compression
+    cola.cmp = opts.Comparator
+    cola.bufsize = opts.WriteBufferSize
+    /* Read last levels */
+    Seek(cola.MetaFd, int64(-MAX_LEVELS), os.SEEK_END)
+    n, err := Read(cola.MetaFd, cola.Levels[:])
+    if err != nil || n != MAX_LEVELS {
+        Close(cola.MetaFd)
+        return nil, pathError("read", path + "/meta", ErrCorrupt)
+    }
+    /* Delete all the old levels */
     Seek(cola.MetaFd, 0, os.SEEK_SET)
-    n, err = Write(cola.MetaFd, buffer)
-    if err != nil || n != 8 {
-        return nil, false
+    err = cola.writeLevels()
+    if err != nil {
+        Close(cola.MetaFd)
+        return nil, err
+    }
+    Ftruncate(cola.MetaFd, int64(MAX_LEVELS))
+    switch conf.format {
+        case RAW_RECORDS:
+            err = cola.upgradeRecords(conf)
+        case UPGRADING_RECORDS:
+            err = cola.finishUpgrade(conf)
+    }
+    if err != nil {
+        Close(cola.MetaFd)
+        return nil, err
     }
-    Ftruncate(cola.MetaFd, 8)
     /* blx */
-    var ok bool
-    cola.blocks, ok = LoadBlocks(path + "/blx")
-    if !ok {
-        return nil, false
+    cola.blocks, err = LoadBlocks(path + "/blx", cola.cmp)
+    if err != nil {
+        Close(cola.MetaFd)
+        return nil, err
     }
+    cola.blocks.sync = opts.Sync
     /* Extents */
-    for i := int(MAX_RECORDS); i > 0; i <<= 1 {
-        if uint64(i) & cola.Bitmap > 0 {
-            extpath := path + "/ext_" + strconv.Itoa(i)
-            cola.extents[log(i)], ok = OpenExtent(extpath)
-            if !ok {
-                return nil, false
+    for level := range cola.Levels {
+        for j := 0; j < int(cola.Levels[level]); j++ {
+            run, err := OpenExtent(cola.runPath(level, j))
+            if err != nil {
+                cola.Close()
+                return nil, err
             }
+            cola.extents[level] = append(cola.extents[level], run)
         }
     }
-    cola.Path = path
-    if cola.blocks.count == MAX_RECORDS {
-        ok = cola.PushDown()
+    if cola.blocks.count >= cola.bufsize {
+        err = cola.pushDown()
+        if err != nil {
+            cola.Close()
+            return nil, err
+        }
     }
-    return cola, ok
+    return cola, nil
 }
 
-func log(i int) int {
-    var result int = 0
-    for i /= int(MAX_RECORDS) * 2; i > 0; i >>= 1 {
-        result++
+/* Suffix of the versioned copies of the files of a table being upgraded */
+const UPGRADE_SUFFIX string = ".v"
+
+/* Convert the last bitmap of a doubling COLA to level snapshot and write the
+   conf down, so that it can be opened as any other table. The snapshot is
+   written to meta.1 and put over meta only after the conf, so that an upgrade
+   cut off before the conf starts again from the bitmap, and one cut off after
+   it is finished by finishMeta. */
+func upgradeMeta(path string, conf tableConf) error {
+    meta, err := os.ReadFile(path + "/meta")
+    if err != nil {
+        return err
     }
-    return result
+    if len(meta) < 8 {
+        return pathError("read", path + "/meta", ErrCorrupt)
+    }
+    var bitmap uint64 = BytesToUint64(meta[len(meta) - 8:])
+    var levels [MAX_LEVELS]uint8
+    for level := 0; level < MAX_LEVELS; level++ {
+        var i uint64 = DEFAULT_POLICY.Capacity(level)
+        if i == 0 {
+            break
+        }
+        if bitmap & i > 0 {
+            levels[level] = 1
+        }
+    }
+    var mode int = O_WRONLY | O_CREAT | O_TRUNC
+    fd, err := Open(path + "/meta.1", mode, S_IRALL | S_IWALL)
+    if err != nil {
+        return pathError("open", path + "/meta.1", err)
+    }
+    err = writeAll(fd, levels[:])
+    if err == nil {
+        err = Fsync(fd)
+    }
+    Close(fd)
+    if err != nil {
+        return pathError("write", path + "/meta.1", err)
+    }
+    err = writeConf(path + "/conf", conf)
+    if err != nil {
+        return err
+    }
+    return finishMeta(path)
+}
+
+/* Put the level snapshot of an upgraded doubling COLA over its bitmap, if
+   upgradeMeta did not get to it. */
+func finishMeta(path string) error {
+    err := Rename(path + "/meta.1", path + "/meta")
+    if err != nil && err != ENOENT {
+        return pathError("rename", path + "/meta", err)
+    }
+    return nil
+}
+
+/* Files of a table holding records, blx first. */
+func (cola *COLA) recordFiles() []string {
+    var paths = []string{ cola.Path + "/blx" }
+    for level := range cola.Levels {
+        for j := 0; j < int(cola.Levels[level]); j++ {
+            paths = append(paths, cola.runPath(level, j))
+        }
+    }
+    return paths
+}
+
+/* Give every record of a table of raw records version 0, so that any write
+   made from now on wins over them. The versioned copies are written beside
+   the files, with UPGRADE_SUFFIX, and the conf says UPGRADING_RECORDS once
+   all of them are; a crash before that starts the upgrade over from the raw
+   files, and one after it only finishes putting the copies in place, so no
+   record is stamped twice. */
+func (cola *COLA) upgradeRecords(conf tableConf) error {
+    println("upgrading records of", cola.Path)
+    blx, _, err := OpenBlocks(cola.Path + "/blx", cola.cmp)
+    if err != nil {
+        return err
+    }
+    Close(blx.fd)
+    var list = NewSkipList(cola.cmp)
+    for node := blx.list.First(); node != nil; node = node.Next() {
+        list.Put(node.Key(), Stamp(0, node.Value()), node.index)
+    }
+    blx.list = list
+    blx.path += UPGRADE_SUFFIX
+    err = WriteBlocks(blx)
+    if err != nil {
+        return err
+    }
+    for _, path := range cola.recordFiles()[1:] {
+        run, err := OpenExtent(path)
+        if err != nil {
+            return err
+        }
+        var records = make(RecordSlice, run.Count())
+        for i := range records {
+            k, v := run.Record(uint64(i))
+            records[i] = Record{ k, Stamp(0, v) }
+        }
+        err = writeExtent(path + UPGRADE_SUFFIX, BlocksToMemExtent(records))
+        run.Free()
+        if err != nil {
+            return err
+        }
+    }
+    conf.format = UPGRADING_RECORDS
+    err = writeConf(cola.Path + "/conf", conf)
+    if err != nil {
+        return err
+    }
+    return cola.finishUpgrade(conf)
+}
+
+/* Put the versioned copies of an upgrade in place of the raw files. A file
+   without a copy has been replaced already. */
+func (cola *COLA) finishUpgrade(conf tableConf) error {
+    for _, path := range cola.recordFiles() {
+        err := Rename(path + UPGRADE_SUFFIX, path)
+        if err != nil && err != ENOENT {
+            return pathError("rename", path, err)
+        }
+    }
+    conf.format = VERSIONED_RECORDS
+    return writeConf(cola.Path + "/conf", conf)
 }
@@ -0,0 +1,220 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "fmt"
+    "os"
+    . "syscall"
+    "testing"
+    "time"
+)
+
+/* Turn the files of a closed table back into raw records, as tables made
+   before versions were. */
+func unversion(t *testing.T, cola *COLA) {
+    blx, _, err := OpenBlocks(cola.Path + "/blx", cola.cmp)
+    if err != nil {
+        t.Fatal(err)
+    }
+    Close(blx.fd)
+    var list = NewSkipList(cola.cmp)
+    for node := blx.list.First(); node != nil; node = node.Next() {
+        _, value := Unstamp(node.Value())
+        list.Put(node.Key(), value, node.index)
+    }
+    blx.list = list
+    if err = WriteBlocks(blx); err != nil {
+        t.Fatal(err)
+    }
+    for _, path := range cola.recordFiles()[1:] {
+        run, err := OpenExtent(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var records = make(RecordSlice, run.Count())
+        for i := range records {
+            k, v := run.Record(uint64(i))
+            _, value := Unstamp(v)
+            records[i] = Record{ k, value }
+        }
+        err = writeExtent(path, BlocksToMemExtent(records))
+        run.Free()
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    setFormat(t, cola.Path, RAW_RECORDS)
+}
+
+func setFormat(t *testing.T, path string, format byte) {
+    conf, err := readConf(path + "/conf")
+    if err != nil {
+        t.Fatal(err)
+    }
+    conf.format = format
+    if err = writeConf(path + "/conf", conf); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func checkValues(t *testing.T, path string, n int) {
+    cola, err := OpenCOLA(path, hammerOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cola.Close()
+    for i := 0; i < n; i++ {
+        value, version, err := cola.GetVersion([]byte(fmt.Sprint("k", i)))
+        if err != nil || string(value) != fmt.Sprint("v", i) || version != 0 {
+            t.Fatalf("k%d: read %q at %d, %v", i, value, version, err)
+        }
+    }
+}
+
+/* An upgrade cut off at any point is finished by the next open, without
+   stamping any record twice. */
+func TestUpgradeRecordsResumes(t *testing.T) {
+    var path = t.TempDir() + "/t"
+    cola, err := NewCOLA(path, hammerOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    const N = 300
+    for i := 0; i < N; i++ {
+        if err = cola.Set([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint("v", i))); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if len(cola.recordFiles()) < 2 {
+        t.Fatal("no runs to upgrade")
+    }
+    cola.Close()
+    unversion(t, cola)
+
+    /* Cut off before the copies were all written: they are made again */
+    for _, file := range cola.recordFiles() {
+        os.WriteFile(file + UPGRADE_SUFFIX, []byte("torn"), 0644)
+    }
+    checkValues(t, path, N)
+
+    /* Cut off after every copy was put in place, before the conf was done */
+    setFormat(t, path, UPGRADING_RECORDS)
+    checkValues(t, path, N)
+}
+
+/* A table of n raw records as the doubling COLA left them, with the bitmap of
+   its levels at the end of meta and no conf, and the levels it has. */
+func doublingTable(t *testing.T, n int) (string, [MAX_LEVELS]uint8) {
+    var path = t.TempDir() + "/t"
+    cola, err := NewCOLA(path, &Options{ WriteBufferSize: 64 })
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < n; i++ {
+        if err = cola.Set([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint("v", i))); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if len(cola.recordFiles()) < 2 {
+        t.Fatal("no runs to upgrade")
+    }
+    cola.Close()
+    unversion(t, cola)
+    var bitmap uint64
+    for level, runs := range cola.Levels {
+        if runs > 1 {
+            t.Fatalf("%d runs on level %d", runs, level)
+        }
+        if runs == 1 {
+            bitmap |= DEFAULT_POLICY.Capacity(level)
+        }
+    }
+    /* An older bitmap before the last */
+    var meta = append(Uint64ToBytes(0), Uint64ToBytes(bitmap)...)
+    if err = os.WriteFile(path + "/meta", meta, 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err = os.Remove(path + "/conf"); err != nil {
+        t.Fatal(err)
+    }
+    return path, cola.Levels
+}
+
+/* An upgrade of the meta of a doubling COLA cut off on either side of the
+   conf is finished by the next open. */
+func TestUpgradeMetaResumes(t *testing.T) {
+    const N = 300
+    /* Cut off while the snapshot was written: it is made again */
+    path, _ := doublingTable(t, N)
+    os.WriteFile(path + "/meta.1", []byte("torn"), 0644)
+    checkValues(t, path, N)
+
+    /* Cut off after the conf, before the snapshot was put over the bitmap */
+    path, levels := doublingTable(t, N)
+    if err := os.WriteFile(path + "/meta.1", levels[:], 0644); err != nil {
+        t.Fatal(err)
+    }
+    var conf = tableConf{ DEFAULT_POLICY, NO_COMPRESSION, BytewiseComparator.Name(),
+                          RAW_RECORDS }
+    if err := writeConf(path + "/conf", conf); err != nil {
+        t.Fatal(err)
+    }
+    checkValues(t, path, N)
+    if _, err := os.Stat(path + "/meta.1"); !os.IsNotExist(err) {
+        t.Fatalf("meta.1 left behind: %v", err)
+    }
+}
+
+/* Compactions keep a deletion until TOMBSTONE_GRACE is over, so that a
+   replica asked for the key still answers with the deletion's version. */
+func TestCompactKeepsRecentDeletions(t *testing.T) {
+    cola, err := NewCOLA(t.TempDir() + "/t", hammerOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cola.Close()
+    for i := 0; i < 100; i++ {
+        cola.Set([]byte(fmt.Sprint("k", i)), []byte("v"))
+    }
+    cola.Set([]byte("k7"), nil)
+    if _, _, err = cola.Compact(); err != nil {
+        t.Fatal(err)
+    }
+    _, version, err := cola.GetVersion([]byte("k7"))
+    if version == 0 {
+        t.Fatalf("k7: deletion dropped within the grace, %v", err)
+    }
+    var grace = TOMBSTONE_GRACE
+    TOMBSTONE_GRACE = 0
+    defer func() { TOMBSTONE_GRACE = grace }()
+    time.Sleep(time.Millisecond)
+    _, dropped, err := cola.Compact()
+    if err != nil || dropped != 1 {
+        t.Fatalf("%d records dropped after the grace, %v", dropped, err)
+    }
+    if _, version, _ = cola.GetVersion([]byte("k7")); version != 0 {
+        t.Fatalf("k7: deletion kept after the grace at %d", version)
+    }
+}
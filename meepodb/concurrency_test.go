@@ -0,0 +1,226 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+    "testing"
+)
+
+/*
+ *  These tests hammer one COLA or Storage from many goroutines and are meant
+ *  to be run with the race detector, e.g. `go test -race ./meepodb`.
+ */
+
+const (
+    HAMMER_WORKERS int = 8
+    HAMMER_ROUNDS  int = 2000
+)
+
+/* A small write buffer, so that writes push down and merge all the time */
+var hammerOptions = &Options{ WriteBufferSize: 64,
+                              Policy: Policy{ Growth: 2, Merge: MERGE_TIERED } }
+
+/* Each worker writes and deletes keys of its own, which it can check, and
+   reads the keys of the others, while one more compacts the table. */
+func TestCOLAConcurrent(t *testing.T) {
+    cola, err := NewCOLA(t.TempDir() + "/t", hammerOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cola.Close()
+    var workers sync.WaitGroup
+    var done = make(chan struct{})
+    var compactions = make(chan error, 1)
+    go func() {
+        for {
+            select {
+                case <-done:
+                    compactions <- nil
+                    return
+                default:
+            }
+            if _, _, err := cola.Compact(); err != nil {
+                compactions <- err
+                return
+            }
+        }
+    }()
+    for w := 0; w < HAMMER_WORKERS; w++ {
+        workers.Add(1)
+        go func(w int) {
+            defer workers.Done()
+            for i := 0; i < HAMMER_ROUNDS; i++ {
+                var key = []byte(fmt.Sprintf("w%d-k%d", w, i % 100))
+                var err error
+                if i % 3 == 2 {
+                    err = cola.Set(key, nil)
+                } else {
+                    err = cola.Set(key, []byte(fmt.Sprint(i)))
+                }
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+                _, err = cola.Get([]byte(fmt.Sprintf("w%d-k%d", (w + 1) % HAMMER_WORKERS, i % 100)))
+                if err != nil && !errors.Is(err, ErrNotFound) {
+                    t.Error(err)
+                    return
+                }
+                if i % 500 == 0 {
+                    cola.Size()
+                    cola.Scan(nil, nil, func(key, value []byte) bool { return true })
+                }
+            }
+        }(w)
+    }
+    workers.Wait()
+    close(done)
+    if err := <-compactions; err != nil {
+        t.Fatal(err)
+    }
+    /* The last round of key k was HAMMER_ROUNDS - 100 + k */
+    for w := 0; w < HAMMER_WORKERS; w++ {
+        for k := 0; k < 100; k++ {
+            var i = HAMMER_ROUNDS - 100 + k
+            value, err := cola.Get([]byte(fmt.Sprintf("w%d-k%d", w, k)))
+            switch {
+                case i % 3 == 2 && !errors.Is(err, ErrNotFound):
+                    t.Fatalf("w%d-k%d: deleted key read as %q, %v", w, k, value, err)
+                case i % 3 != 2 && (err != nil || string(value) != fmt.Sprint(i)):
+                    t.Fatalf("w%d-k%d: read %q, %v instead of %d", w, k, value, err, i)
+            }
+        }
+    }
+}
+
+/* Workers put, get and delete in a few tables while others drop them; a table
+   dropped under a write may fail it with ErrClosed, nothing else may fail. */
+func TestStorageConcurrent(t *testing.T) {
+    strg, err := NewStorage(t.TempDir(), hammerOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer strg.Close()
+    var tables = [][]byte{ []byte("a"), []byte("b"), []byte("c") }
+    var workers sync.WaitGroup
+    for w := 0; w < HAMMER_WORKERS; w++ {
+        workers.Add(1)
+        go func(w int) {
+            defer workers.Done()
+            for i := 0; i < HAMMER_ROUNDS; i++ {
+                var table = tables[(w + i) % len(tables)]
+                var key = []byte(fmt.Sprintf("k%d", i % 50))
+                var err error
+                switch {
+                    case w < 2 && i % 400 == 399:
+                        err = strg.Drop(table)
+                    case i % 4 == 3:
+                        _, err = strg.Put(table, key, nil, CLOCK.Now())
+                    case i % 2 == 1:
+                        _, err = strg.Get(table, key)
+                        if errors.Is(err, ErrNotFound) {
+                            err = nil
+                        }
+                    default:
+                        _, err = strg.Put(table, key, []byte(fmt.Sprint(w)), CLOCK.Now())
+                }
+                if i % 250 == 0 {
+                    strg.Size(table)
+                    strg.Keys(table)
+                }
+                if err != nil && !errors.Is(err, ErrClosed) {
+                    t.Error(err)
+                    return
+                }
+            }
+        }(w)
+    }
+    workers.Wait()
+    for _, table := range tables {
+        if _, err := strg.Put(table, []byte("last"), []byte("x"), CLOCK.Now()); err != nil {
+            t.Fatal(err)
+        }
+        if value, err := strg.Get(table, []byte("last")); err != nil || string(value) != "x" {
+            t.Fatalf("%s: read %q, %v after the hammering", table, value, err)
+        }
+    }
+}
+
+/* Writes racing on a key reach the change log in the order they were made,
+   so the last change logged of every key is what the table has. */
+func TestChangeLogOrder(t *testing.T) {
+    var dir = t.TempDir()
+    strg, err := NewStorage(dir, hammerOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer strg.Close()
+    log, err := OpenChangeLog(dir + "/" + CHANGES_DIR)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer log.Close()
+    strg.LogChanges(log)
+    var workers sync.WaitGroup
+    for w := 0; w < HAMMER_WORKERS; w++ {
+        workers.Add(1)
+        go func(w int) {
+            defer workers.Done()
+            for i := 0; i < HAMMER_ROUNDS; i++ {
+                var key = []byte(fmt.Sprint("k", i % 2))
+                /* Versions of the workers interleave, so some writes lose */
+                var version = uint64(i) << 16 | uint64(w)
+                if _, err := strg.Put([]byte("t"), key, []byte(fmt.Sprint(w)), version); err != nil {
+                    t.Error(err)
+                    return
+                }
+            }
+        }(w)
+    }
+    workers.Wait()
+    var last = make(map[string][]byte)
+    for position := uint64(0); ; {
+        changes, next, err := log.Read(position)
+        if err != nil || next == position {
+            break
+        }
+        for len(changes) > 0 {
+            _, tlen, klen, vlen := DecodeHead(changes[:8])
+            var key = string(changes[8 + tlen : 8 + tlen + klen])
+            last[key] = changes[8 + tlen + klen : 8 + tlen + klen + vlen]
+            changes = changes[8 + tlen + klen + vlen:]
+        }
+        position = next
+    }
+    for k := 0; k < 2; k++ {
+        var key = fmt.Sprint("k", k)
+        value, version, err := strg.GetVersion([]byte("t"), []byte(key))
+        if err != nil || string(Stamp(version, value)) != string(last[key]) {
+            t.Fatalf("%s: table has %q at %d, the log ends with %q", key, value, version, last[key])
+        }
+    }
+}
@@ -23,20 +23,101 @@
 package meepodb
 
 import (
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "maps"
+    "os"
+    "runtime"
+    "strings"
     . "syscall"
 )
 
 /* ========================================================================= *
- *                             USER SETTINGS                                 */
+ *  DEFAULT SETTINGS, overridden by the config file and then by the flags.   */
 
-var SERVERS = [...]string {
+var SERVERS = []string {
     "192.168.3.139:6631",
 }
 
-const DB_DIR string = "/home/wiza/mpdb"
+var DB_DIR string = "/home/wiza/mpdb"
+
+/* Port of meepodb-server if none is given on the command line */
+var PORT int = 6631
 
 var REPLICA bool = false
 
+var REPLICA_FACTOR int = 3
+
+/* Copies of the tables listed here, e.g. "users": 5, instead of
+   REPLICA_FACTOR. They are kept even without REPLICA. */
+var REPLICAS = map[string]int {
+}
+
+/* Zone or rack of each server, e.g. "192.168.3.139:6631": "rack1". Copies of
+   a record go to distinct zones where there are enough of them, and servers
+   without a zone count as zones of their own. */
+var ZONES = map[string]string {
+}
+
+/* Tables kept by Raft groups of REPLICA_FACTOR servers, or as many as
+   REPLICAS gives, for linearizable reads and writes */
+var RAFT_TABLES = map[string]bool {
+}
+
+/* Tables partitioned into key ranges instead of hashed onto the ring */
+var RANGE_TABLES = map[string]bool {
+}
+
+/* Records a range grows to before it is split */
+var RANGE_SPLIT int = 1 << 20
+
+/* Consistency of requests that do not specify one */
+var READ_LEVEL Consistency = ONE
+var WRITE_LEVEL Consistency = QUORUM
+
+/* Seconds between anti-entropy rounds with the other replicas, 0 for none */
+var ANTI_ENTROPY int = 600
+
+/* Seconds a deletion is kept by compactions, so that every replica has it
+   from hints, read repairs or anti-entropy before it is dropped; a replica
+   without it would take an older value for the newest */
+var TOMBSTONE_GRACE int = 864000
+
+/* Server to copy the tables from on start, for a new or replaced server */
+var BOOTSTRAP string = ""
+
+/* Servers whose tables this one keeps read-only copies of, tailing their
+   changes, instead of being one of SERVERS itself; see Following */
+var FOLLOW []string
+
+/* Seconds the change log keeps changes for, for followers and subscribers to
+   resume from; a segment is removed once its last change is older */
+var RETAIN_CHANGES int = 86400
+
+var MAX_CONNS int = 10000
+
+/* Bytes of requests a server may be part way through reading at once, over
+   all connections; a request that would go over it is refused */
+var MAX_READING int = 2 << 30
+
+/* Fsync blx after every write */
+var SYNC bool = false
+
+/* Number of event loops and table workers of a server */
+var LOOPS int = runtime.NumCPU()
+
+/* Merge policies of tables created from now on, e.g.
+       "log": Policy{ Growth: 4, Merge: MERGE_TIERED },
+   Tables not listed here use DEFAULT_POLICY. */
+var POLICIES = map[string]Policy {
+}
+
+/* Read when -config is not given; it is fine if it does not exist. */
+const CONFIG_FILE string = "meepodb.json"
+
 /* ========================================================================= */
 
 /*
@@ -51,7 +132,398 @@ const (
     MAX_RECORDS uint64 = 1 << 12
     BLX_BUF_SIZE int64 = int64(1) << 20 * 16
 
-    MAX_CONNS      int = 10000
-    MAX_TABLES     int = 10000
-    REPLICA_FACTOR int = 3
+    MAX_TABLES int = 10000
 )
+
+/*
+ *  The config file is a JSON object, every field of which is optional:
+ *
+ *      {
+ *          "servers": ["192.168.3.139:6631", "192.168.3.140:6631"],
+ *          "dir": "/home/wiza/mpdb",
+ *          "port": 6631,
+ *          "replica": true,
+ *          "replica_factor": 3,
+ *          "replicas": { "users": 5 },
+ *          "zones": { "192.168.3.139:6631": "rack1", "192.168.3.140:6631": "rack2" },
+ *          "raft": ["meta"],
+ *          "ranges": ["events"],
+ *          "range_split": 1048576,
+ *          "read_consistency": "one",
+ *          "write_consistency": "quorum",
+ *          "anti_entropy": 600,
+ *          "tombstone_grace": 864000,
+ *          "follow": ["192.168.3.139:6631"],
+ *          "retain_changes": 86400,
+ *          "max_conns": 10000,
+ *          "max_reading": 2147483648,
+ *          "sync": false,
+ *          "loops": 4,
+ *          "policies": { "log": { "growth": 4, "merge": "tiered" } }
+ *      }
+ */
+type fileConfig struct {
+    Servers        []string                `json:"servers"`
+    Dir            *string                 `json:"dir"`
+    Port           *int                    `json:"port"`
+    Replica        *bool                   `json:"replica"`
+    ReplicaFactor  *int                    `json:"replica_factor"`
+    Replicas       map[string]int          `json:"replicas"`
+    Zones          map[string]string       `json:"zones"`
+    Raft           []string                `json:"raft"`
+    Ranges         []string                `json:"ranges"`
+    RangeSplit     *int                    `json:"range_split"`
+    ReadLevel      *string                 `json:"read_consistency"`
+    WriteLevel     *string                 `json:"write_consistency"`
+    AntiEntropy    *int                    `json:"anti_entropy"`
+    TombstoneGrace *int                    `json:"tombstone_grace"`
+    Follow         []string                `json:"follow"`
+    RetainChanges  *int                    `json:"retain_changes"`
+    MaxConns       *int                    `json:"max_conns"`
+    MaxReading     *int                    `json:"max_reading"`
+    Sync           *bool                   `json:"sync"`
+    Loops          *int                    `json:"loops"`
+    Policies       map[string]filePolicy   `json:"policies"`
+}
+
+type filePolicy struct {
+    Growth  uint64  `json:"growth"`
+    Merge   string  `json:"merge"`
+}
+
+/* Apply the settings in a config file. */
+func LoadConfig(path string) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    var conf fileConfig
+    decoder := json.NewDecoder(file)
+    decoder.DisallowUnknownFields()
+    /* An empty file is an empty object */
+    if err = decoder.Decode(&conf); err != nil && err != io.EOF {
+        return fmt.Errorf("%s: %w", path, err)
+    }
+    if conf.Servers != nil {
+        SERVERS = conf.Servers
+    }
+    if conf.Dir != nil {
+        DB_DIR = *conf.Dir
+    }
+    if conf.Port != nil {
+        PORT = *conf.Port
+    }
+    if conf.Replica != nil {
+        REPLICA = *conf.Replica
+    }
+    if conf.ReplicaFactor != nil {
+        REPLICA_FACTOR = *conf.ReplicaFactor
+    }
+    /* Maps are copied on write, see ReloadConfig */
+    var replicas = maps.Clone(REPLICAS)
+    for name, n := range conf.Replicas {
+        replicas[name] = n
+    }
+    REPLICAS = replicas
+    var zones = maps.Clone(ZONES)
+    for server, zone := range conf.Zones {
+        zones[server] = zone
+    }
+    ZONES = zones
+    var raft = maps.Clone(RAFT_TABLES)
+    for _, name := range conf.Raft {
+        raft[name] = true
+    }
+    RAFT_TABLES = raft
+    var ranges = maps.Clone(RANGE_TABLES)
+    for _, name := range conf.Ranges {
+        ranges[name] = true
+    }
+    RANGE_TABLES = ranges
+    if conf.RangeSplit != nil {
+        RANGE_SPLIT = *conf.RangeSplit
+    }
+    if conf.ReadLevel != nil {
+        READ_LEVEL, err = ParseConsistency(*conf.ReadLevel)
+        if err != nil {
+            return fmt.Errorf("%s: %w", path, err)
+        }
+    }
+    if conf.WriteLevel != nil {
+        WRITE_LEVEL, err = ParseConsistency(*conf.WriteLevel)
+        if err != nil {
+            return fmt.Errorf("%s: %w", path, err)
+        }
+    }
+    if conf.AntiEntropy != nil {
+        ANTI_ENTROPY = *conf.AntiEntropy
+    }
+    if conf.TombstoneGrace != nil {
+        TOMBSTONE_GRACE = *conf.TombstoneGrace
+    }
+    if conf.Follow != nil {
+        FOLLOW = conf.Follow
+    }
+    if conf.RetainChanges != nil {
+        RETAIN_CHANGES = *conf.RetainChanges
+    }
+    if conf.MaxConns != nil {
+        MAX_CONNS = *conf.MaxConns
+    }
+    if conf.MaxReading != nil {
+        MAX_READING = *conf.MaxReading
+    }
+    if conf.Sync != nil {
+        SYNC = *conf.Sync
+    }
+    if conf.Loops != nil {
+        LOOPS = *conf.Loops
+    }
+    var policies = maps.Clone(POLICIES)
+    for name, p := range conf.Policies {
+        var policy = Policy{ Growth: p.Growth, Merge: MERGE_LEVELED }
+        switch p.Merge {
+            case "", "leveled":
+            case "tiered":
+                policy.Merge = MERGE_TIERED
+            default:
+                return fmt.Errorf("%s: unknown merge policy %q of %s", path, p.Merge, name)
+        }
+        policies[name] = policy
+    }
+    POLICIES = policies
+    return CheckConfig()
+}
+
+/* Register the common flags, parse the command line and apply the config file
+   and then the flags that are set. Binaries may register their own flags
+   before calling it. */
+func ParseConfig() error {
+    var path     = flag.String("config", CONFIG_FILE, "config file")
+    var servers  = flag.String("servers", "", "comma-separated addresses of all servers")
+    var dir      = flag.String("dir", DB_DIR, "database directory")
+    var port     = flag.Int("port", PORT, "port of this server")
+    var replica  = flag.Bool("replica", REPLICA, "keep replicas of every record")
+    var factor   = flag.Int("replica-factor", REPLICA_FACTOR, "number of replicas")
+    var zones    = flag.String("zones", "", "comma-separated server=zone pairs")
+    var raft     = flag.String("raft", "", "comma-separated tables kept by Raft")
+    var ranges   = flag.String("ranges", "", "comma-separated tables partitioned by key range")
+    var split    = flag.Int("range-split", RANGE_SPLIT, "records of a range before it is split")
+    var read     = flag.String("read-consistency", READ_LEVEL.String(), "ONE, QUORUM or ALL")
+    var write    = flag.String("write-consistency", WRITE_LEVEL.String(), "ONE, QUORUM or ALL")
+    var entropy  = flag.Int("anti-entropy", ANTI_ENTROPY, "seconds between anti-entropy rounds, 0 for none")
+    var grace    = flag.Int("tombstone-grace", TOMBSTONE_GRACE, "seconds deletions are kept by compactions")
+    var boot     = flag.String("bootstrap", "", "server to copy the tables from on start")
+    var follow   = flag.String("follow", "", "comma-separated servers to follow read-only")
+    var retain   = flag.Int("retain-changes", RETAIN_CHANGES, "seconds the change log keeps changes for")
+    var maxConns = flag.Int("max-conns", MAX_CONNS, "maximum connections per event loop")
+    var reading  = flag.Int("max-reading", MAX_READING, "bytes of requests read at once over all connections")
+    var sync     = flag.Bool("sync", SYNC, "fsync after every write")
+    var loops    = flag.Int("loops", LOOPS, "number of event loops")
+    flag.Parse()
+
+    var explicit bool
+    flag.Visit(func(f *flag.Flag) {
+        if f.Name == "config" {
+            explicit = true
+        }
+    })
+    var err error
+    var overrides = map[string]func() {
+        "servers"           : func() { SERVERS = strings.Split(*servers, ",") },
+        "dir"               : func() { DB_DIR = *dir },
+        "port"              : func() { PORT = *port },
+        "replica"           : func() { REPLICA = *replica },
+        "replica-factor"    : func() { REPLICA_FACTOR = *factor },
+        "zones"             : func() {
+            var result = maps.Clone(ZONES)
+            for _, pair := range strings.Split(*zones, ",") {
+                server, zone, ok := strings.Cut(pair, "=")
+                if !ok {
+                    err = fmt.Errorf("invalid zone %q, not server=zone", pair)
+                    return
+                }
+                result[server] = zone
+            }
+            ZONES = result
+        },
+        "raft"              : func() {
+            var result = maps.Clone(RAFT_TABLES)
+            for _, name := range strings.Split(*raft, ",") {
+                result[name] = true
+            }
+            RAFT_TABLES = result
+        },
+        "ranges"            : func() {
+            var result = maps.Clone(RANGE_TABLES)
+            for _, name := range strings.Split(*ranges, ",") {
+                result[name] = true
+            }
+            RANGE_TABLES = result
+        },
+        "range-split"       : func() { RANGE_SPLIT = *split },
+        "read-consistency"  : func() { READ_LEVEL, err = ParseConsistency(*read) },
+        "write-consistency" : func() { WRITE_LEVEL, err = ParseConsistency(*write) },
+        "anti-entropy"      : func() { ANTI_ENTROPY = *entropy },
+        "tombstone-grace"   : func() { TOMBSTONE_GRACE = *grace },
+        "bootstrap"         : func() { BOOTSTRAP = *boot },
+        "follow"            : func() { FOLLOW = strings.Split(*follow, ",") },
+        "retain-changes"    : func() { RETAIN_CHANGES = *retain },
+        "max-conns"         : func() { MAX_CONNS = *maxConns },
+        "max-reading"       : func() { MAX_READING = *reading },
+        "sync"              : func() { SYNC = *sync },
+        "loops"             : func() { LOOPS = *loops },
+    }
+    reload = func() error {
+        err = LoadConfig(*path)
+        if err != nil && (explicit || !errors.Is(err, os.ErrNotExist)) {
+            return err
+        }
+        err = nil
+        flag.Visit(func(f *flag.Flag) {
+            if apply, ok := overrides[f.Name]; ok && err == nil {
+                apply()
+            }
+        })
+        if err != nil {
+            return err
+        }
+        return CheckConfig()
+    }
+    return reload()
+}
+
+var reload func() error
+
+/* Read the config file again, as ParseConfig did, with the flags still
+   winning. Tables no longer listed in it lose their own replicas, Raft
+   and policies, and servers their zones.
+
+   The maps of settings are never written once set: a reload fills new ones
+   and replaces the old, so a reader that got a map before keeps a whole one.
+   Callers still hold a lock of their own over the reload against every read
+   of the settings, as meepodb-proxy does, since the variables change. If
+   the config does not load or check, every setting is put back as it was. */
+func ReloadConfig() error {
+    if reload == nil {
+        return errors.New("config was not parsed")
+    }
+    var restore = saveSettings()
+    REPLICAS = map[string]int{}
+    ZONES = map[string]string{}
+    RAFT_TABLES = map[string]bool{}
+    RANGE_TABLES = map[string]bool{}
+    POLICIES = map[string]Policy{}
+    err := reload()
+    if err != nil {
+        restore()
+        return err
+    }
+    /* Placement may have changed with the zones */
+    resetRings()
+    return nil
+}
+
+/* The settings as they are now, put back by the function returned. */
+func saveSettings() func() {
+    var servers, dir, port = SERVERS, DB_DIR, PORT
+    var replica, factor, replicas, zones = REPLICA, REPLICA_FACTOR, REPLICAS, ZONES
+    var raft, ranges, split = RAFT_TABLES, RANGE_TABLES, RANGE_SPLIT
+    var read, write, entropy, grace = READ_LEVEL, WRITE_LEVEL, ANTI_ENTROPY, TOMBSTONE_GRACE
+    var boot, follow, retain = BOOTSTRAP, FOLLOW, RETAIN_CHANGES
+    var maxConns, reading, sync, loops, policies = MAX_CONNS, MAX_READING, SYNC, LOOPS, POLICIES
+    return func() {
+        SERVERS, DB_DIR, PORT = servers, dir, port
+        REPLICA, REPLICA_FACTOR, REPLICAS, ZONES = replica, factor, replicas, zones
+        RAFT_TABLES, RANGE_TABLES, RANGE_SPLIT = raft, ranges, split
+        READ_LEVEL, WRITE_LEVEL, ANTI_ENTROPY, TOMBSTONE_GRACE = read, write, entropy, grace
+        BOOTSTRAP, FOLLOW, RETAIN_CHANGES = boot, follow, retain
+        MAX_CONNS, MAX_READING, SYNC, LOOPS, POLICIES = maxConns, reading, sync, loops, policies
+    }
+}
+
+func CheckConfig() error {
+    if len(SERVERS) == 0 {
+        return errors.New("no servers configured")
+    }
+    for _, s := range SERVERS {
+        if len(s) == 0 {
+            return errors.New("empty server address")
+        }
+    }
+    if len(DB_DIR) == 0 {
+        return errors.New("no database directory configured")
+    }
+    if PORT <= 0 || PORT > 65535 {
+        return fmt.Errorf("invalid port %d", PORT)
+    }
+    if REPLICA_FACTOR < 1 {
+        return fmt.Errorf("invalid replica factor %d", REPLICA_FACTOR)
+    }
+    for name, n := range REPLICAS {
+        if n < 1 {
+            return fmt.Errorf("invalid number of replicas %d of %s", n, name)
+        }
+    }
+    for name := range RAFT_TABLES {
+        if !validTableName(name) {
+            return fmt.Errorf("invalid Raft table %q", name)
+        }
+        if RANGE_TABLES[name] {
+            return fmt.Errorf("%s cannot be both a Raft and a range table", name)
+        }
+    }
+    for name := range RANGE_TABLES {
+        if !validTableName(name) {
+            return fmt.Errorf("invalid range table %q", name)
+        }
+    }
+    for server, zone := range ZONES {
+        if !contains(SERVERS, server) || zone == "" {
+            return fmt.Errorf("invalid zone %q of %s", zone, server)
+        }
+    }
+    if RANGE_SPLIT < 2 {
+        return fmt.Errorf("invalid range split %d", RANGE_SPLIT)
+    }
+    if READ_LEVEL == DEFAULT_LEVEL || WRITE_LEVEL == DEFAULT_LEVEL {
+        return errors.New("default consistency must be ONE, QUORUM or ALL")
+    }
+    if ANTI_ENTROPY < 0 {
+        return fmt.Errorf("invalid anti-entropy interval %d", ANTI_ENTROPY)
+    }
+    if TOMBSTONE_GRACE < ANTI_ENTROPY {
+        return fmt.Errorf("tombstone grace %d is shorter than the anti-entropy interval %d",
+                          TOMBSTONE_GRACE, ANTI_ENTROPY)
+    }
+    if BOOTSTRAP != "" && !contains(SERVERS, BOOTSTRAP) {
+        return fmt.Errorf("bootstrap server %s is not one of the servers", BOOTSTRAP)
+    }
+    for _, s := range FOLLOW {
+        if !contains(SERVERS, s) {
+            return fmt.Errorf("followed server %s is not one of the servers", s)
+        }
+    }
+    if len(FOLLOW) > 0 && BOOTSTRAP != "" {
+        return errors.New("a follower cannot bootstrap")
+    }
+    if RETAIN_CHANGES < 0 {
+        return fmt.Errorf("invalid change retention %d", RETAIN_CHANGES)
+    }
+    if MAX_CONNS < 1 {
+        return fmt.Errorf("invalid max conns %d", MAX_CONNS)
+    }
+    if MAX_READING < 1 << 20 {
+        return fmt.Errorf("invalid max reading %d", MAX_READING)
+    }
+    if LOOPS < 1 {
+        return fmt.Errorf("invalid number of loops %d", LOOPS)
+    }
+    for name, policy := range POLICIES {
+        if !policy.Valid() {
+            return fmt.Errorf("invalid policy %s of %s", policy.String(), name)
+        }
+    }
+    return nil
+}
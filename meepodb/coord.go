@@ -0,0 +1,322 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+package meepodb
+
+import (
+    "errors"
+    "fmt"
+)
+
+/*
+ *  Any server accepts requests for any key. A write is forwarded with FWRD to
+ *  the first owner of the key that answers, normally its primary, owners taken
+ *  as down by gossip being tried last. The owner writes its own copy, sends
+ *  the other owners REPL and acknowledges once as many copies as the
+ *  consistency level requires are persisted. Copies written before a write
+ *  fails are not rolled back, and the copies of owners that are down or
+ *  cannot be reached are kept as hints, see Hints.
+ *
+ *  A read is served by the server receiving it, from its own copy if it is an
+ *  owner and from the copies of the other owners fetched with LGET, until as
+ *  many have answered as the consistency level requires. The copy of the
+ *  highest version wins, and the owners that answered with an older copy are
+ *  sent the winning one in the background, see repair.
+ *
+ *  Versions are given by the coordinator of a write and travel with the
+ *  records in REPL, LGET and DSTR, see Stamp. FWRD replies with the version,
+ *  which a client may keep as a session token, see Session.
+ */
+
+func readLevel(opts RequestOptions) Consistency {
+    if opts.Consistency == DEFAULT_LEVEL {
+        return READ_LEVEL
+    }
+    return opts.Consistency
+}
+
+func writeLevel(opts RequestOptions) Consistency {
+    if opts.Consistency == DEFAULT_LEVEL {
+        return WRITE_LEVEL
+    }
+    return opts.Consistency
+}
+
+/* The result is the version written, 0 for Raft tables, which need no
+   session tokens. */
+func (srv *Server) set(pool *Pool, opts RequestOptions, table, key, value []byte) (uint64, error) {
+    /* The level is fixed here, in case the coordinator defaults to another */
+    if RaftTable(table) {
+        _, err := srv.raftCall(pool, SET_CODE, table, key, value)
+        return 0, err
+    }
+    opts.Consistency = writeLevel(opts)
+    var request = WithOptions(EncodeRequest(FWRD_CODE, table, key, value), opts)
+    for _, owner := range srv.members.Prefer(Owners(table, key)) {
+        if owner == srv.Addr {
+            return srv.coordinate(pool, opts, table, key, value)
+        }
+        v, err := pool.Call(owner, request)
+        if err == nil {
+            var version uint64
+            if len(v) == 8 {
+                version = BytesToUint64(v)
+            }
+            return version, nil
+        }
+        /* The coordinator answered, so another one would fail as well */
+        var remote *RemoteError
+        if errors.As(err, &remote) {
+            return 0, err
+        }
+        println("cannot forward to", owner, "\b:", err.Error())
+    }
+    return 0, fmt.Errorf("%w: no owner of the key answers", ErrUnavailable)
+}
+
+func (srv *Server) coordinate(pool *Pool, opts RequestOptions, table, key, value []byte) (uint64, error) {
+    var level = writeLevel(opts)
+    var owners = Owners(table, key)
+    var version = CLOCK.Now()
+    var record = Stamp(version, value)
+    var acks int
+    for _, owner := range owners {
+        var err error
+        if owner == srv.Addr {
+            _, err = srv.strg.Put(table, key, value, version)
+        } else if !srv.members.Alive(owner) {
+            /* Not worth waiting for it to time out */
+            srv.hint(owner, table, key, record)
+            continue
+        } else {
+            _, err = pool.Call(owner, EncodeRequest(REPL_CODE, table, key, record))
+        }
+        if err != nil {
+            /* Value is always long, so do not print it */
+            println("cannot SET", string(table), string(key), "on", owner,
+                    "\b:", err.Error())
+            var remote *RemoteError
+            if owner != srv.Addr && !errors.As(err, &remote) {
+                srv.hint(owner, table, key, record)
+            }
+            continue
+        }
+        acks++
+    }
+    if need := level.Required(len(owners)); acks < need {
+        return 0, fmt.Errorf("%w: write at %s needs %d of %d copies, %d written",
+                             ErrUnavailable, level, need, len(owners), acks)
+    }
+    return version, nil
+}
+
+func (srv *Server) hint(owner string, table, key, record []byte) {
+    if srv.hints == nil {
+        return
+    }
+    err := srv.hints.Add(owner, table, key, record)
+    if err != nil {
+        println("cannot keep hint for", owner, "\b:", err.Error())
+    }
+}
+
+/* The record of the highest version among the owners. A key never written
+   is an empty record. A read with a session token fails with ErrBehind if no
+   copy is as new as the token yet, for the client to retry rather than the
+   worker to wait, see Session. */
+func (srv *Server) get(pool *Pool, opts RequestOptions, table, key []byte,
+                       token uint64) ([]byte, error) {
+    if RaftTable(table) {
+        return srv.raftCall(pool, GET_CODE, table, key, nil)
+    }
+    record, err := srv.read(pool, opts, table, key, token)
+    if err == nil && recordVersion(record) < token {
+        return nil, fmt.Errorf("%w: no copy of %s/%s has caught up yet", ErrBehind, table, key)
+    }
+    return record, err
+}
+
+/* Read from as many owners as the level requires, and from more of them
+   while none has a copy as new as the token. */
+func (srv *Server) read(pool *Pool, opts RequestOptions, table, key []byte,
+                        token uint64) ([]byte, error) {
+    var level = readLevel(opts)
+    var owners = Owners(table, key)
+    var need = level.Required(len(owners))
+    /* Servers being drained, and those a range moved away from lately, may
+       hold records their new owners do not have yet, so they are asked as
+       well */
+    var draining = union(srv.drainingOwners(table, key), srv.previousOwners(table, key))
+    var records = make([][]byte, 0, len(owners) + len(draining))
+    var sources = make([]string, 0, len(owners) + len(draining))
+    var newest uint64
+    /* The local copy costs nothing, so it is read first */
+    if contains(owners, srv.Addr) {
+        record, err := srv.localRecord(table, key)
+        if err == nil {
+            records = append(records, record)
+            sources = append(sources, srv.Addr)
+            newest = recordVersion(record)
+        } else {
+            println("cannot GET", string(table), string(key), "\b:", err.Error())
+        }
+    }
+    for _, owner := range srv.members.Prefer(owners) {
+        if len(records) >= need && newest >= token {
+            break
+        }
+        if owner == srv.Addr {
+            continue
+        }
+        record, err := pool.Call(owner, EncodeRequest(LGET_CODE, table, key, nil))
+        if err != nil {
+            println("cannot GET from", owner, "\b:", err.Error())
+            continue
+        }
+        records = append(records, record)
+        sources = append(sources, owner)
+        newest = max(newest, recordVersion(record))
+    }
+    if len(records) < need {
+        return nil, fmt.Errorf("%w: read at %s needs %d of %d copies, %d answered",
+                               ErrUnavailable, level, need, len(owners), len(records))
+    }
+    for _, server := range draining {
+        var record []byte
+        var err error
+        if server == srv.Addr {
+            record, err = srv.localRecord(table, key)
+        } else if srv.members.Alive(server) {
+            record, err = pool.Call(server, EncodeRequest(LGET_CODE, table, key, nil))
+        } else {
+            continue
+        }
+        if err == nil {
+            records = append(records, record)
+            sources = append(sources, server)
+        }
+    }
+    var best = latest(records)
+    for i, record := range records {
+        if recordVersion(record) < recordVersion(best) && contains(owners, sources[i]) {
+            srv.repair(sources[i], table, key, best)
+        }
+    }
+    return best, nil
+}
+
+/* A stale copy found by a read, to be overwritten with the newest record. */
+type repair struct {
+    owner   string
+    table   []byte
+    key     []byte
+    record  []byte
+}
+
+/* Repairs waiting for the repairer; more are dropped and left to
+   anti-entropy. */
+const REPAIR_QUEUE int = 1024
+
+/* Overwrite a stale copy with record. The local one is repaired at once, the
+   others by the repairer so that the read is not delayed. */
+func (srv *Server) repair(owner string, table, key, record []byte) {
+    if owner == srv.Addr {
+        version, value := Unstamp(record)
+        _, err := srv.strg.Put(table, key, value, version)
+        if err != nil {
+            println("cannot repair", string(table), string(key), "\b:", err.Error())
+        }
+        return
+    }
+    select {
+        case srv.repairs <- &repair{ owner, table, key, record }:
+        default:
+    }
+}
+
+func (srv *Server) repairer() {
+    var pool = NewPool()
+    for r := range srv.repairs {
+        _, err := pool.Call(r.owner, EncodeRequest(REPL_CODE, r.table, r.key, r.record))
+        if err != nil {
+            println("cannot repair", string(r.table), string(r.key), "on", r.owner,
+                    "\b:", err.Error())
+        }
+    }
+}
+
+/* The local record of a key, deleted or not, or an empty one. */
+func (srv *Server) localRecord(table, key []byte) ([]byte, error) {
+    if srv.booting.Load() {
+        return nil, fmt.Errorf("%w: %s is copying its tables", ErrUnavailable, srv.Addr)
+    }
+    value, version, err := srv.strg.GetVersion(table, key)
+    if errors.Is(err, ErrNotFound) {
+        if version == 0 {
+            return nil, nil
+        }
+        return Stamp(version, nil), nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return Stamp(version, value), nil
+}
+
+/* The record of the highest version, the first one on a tie. */
+func latest(records [][]byte) []byte {
+    var best []byte = Stamp(0, nil)
+    for _, record := range records {
+        if recordVersion(record) > recordVersion(best) {
+            best = record
+        }
+    }
+    return best
+}
+
+/* Drop the table on every server. */
+func (srv *Server) drop(pool *Pool, table []byte) error {
+    if RaftTable(table) {
+        _, err := srv.raftCall(pool, DROP_CODE, table, nil, nil)
+        return err
+    }
+    var dropped int
+    for _, server := range SERVERS {
+        var err error
+        if server == srv.Addr {
+            err = srv.strg.Drop(table)
+        } else {
+            _, err = pool.Call(server, EncodeRequest(LDRP_CODE, table, nil, nil))
+        }
+        if err != nil {
+            println("cannot DROP", string(table), "on", server, "\b:", err.Error())
+            continue
+        }
+        dropped++
+    }
+    if dropped < len(SERVERS) {
+        return fmt.Errorf("%w: dropped on %d of %d servers", ErrUnavailable,
+                          dropped, len(SERVERS))
+    }
+    println("DROP", string(table))
+    return nil
+}
@@ -0,0 +1,111 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+package meepodb
+
+import (
+    "fmt"
+    . "syscall"
+)
+
+/*
+ *  DB is MeepoDB embedded in process: a directory of tables with no server
+ *  around it. It is safe for concurrent use.
+ *
+ *      db, err := meepodb.OpenDB("/var/lib/app", nil)
+ *      users, err := db.Table("users")
+ *      err = users.Set([]byte("wiza"), []byte("..."))
+ */
+type DB struct {
+    strg  *Storage
+}
+
+type Table struct {
+    name  string
+    cola  *COLA
+}
+
+/* Open the database in dir, which is created if it does not exist. A nil
+   opts means DefaultOptions. It is not named Open since the package imports
+   syscall into its file blocks. */
+func OpenDB(dir string, opts *Options) (*DB, error) {
+    err := Mkdir(dir, S_IRWXA)
+    if err != nil && err != EEXIST {
+        return nil, pathError("mkdir", dir, err)
+    }
+    strg, err := NewStorage(dir, opts)
+    if err != nil {
+        return nil, err
+    }
+    return &DB{ strg }, nil
+}
+
+/* Open a table, or create it if it does not exist. */
+func (db *DB) Table(name string) (*Table, error) {
+    cola, err := db.strg.COLA([]byte(name))
+    if err != nil {
+        return nil, fmt.Errorf("meepodb: table %s: %w", name, err)
+    }
+    return &Table{ name, cola }, nil
+}
+
+/* Remove a table and all its data. Tables obtained before return ErrClosed
+   from then on. */
+func (db *DB) Drop(name string) error {
+    return db.strg.Drop([]byte(name))
+}
+
+func (db *DB) Close() error {
+    return db.strg.Close()
+}
+
+func (table *Table) Name() string {
+    return table.name
+}
+
+/* ErrNotFound is returned if the key does not exist. */
+func (table *Table) Get(key []byte) ([]byte, error) {
+    return table.cola.Get(key)
+}
+
+/* The version is that of the record found, or of the deletion of the key
+   along with ErrNotFound. Versions are given by CLOCK. */
+func (table *Table) GetVersion(key []byte) ([]byte, uint64, error) {
+    return table.cola.GetVersion(key)
+}
+
+func (table *Table) Set(key, value []byte) error {
+    if len(value) == 0 {
+        return fmt.Errorf("%w: empty value, use Delete", ErrInvalid)
+    }
+    return table.cola.Set(key, value)
+}
+
+func (table *Table) Delete(key []byte) error {
+    return table.cola.Set(key, nil)
+}
+
+/* Call fn on the records in [start, end) in key order until fn returns
+   false. A nil start or end leaves the range open on that side. fn must not
+   write to the table. */
+func (table *Table) Scan(start, end []byte, fn func(key, value []byte) bool) error {
+    return table.cola.Scan(start, end, fn)
+}
@@ -0,0 +1,295 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+)
+
+/* Time between passes of a drain that has records or hints left */
+const DRAIN_RETRY time.Duration = 5 * time.Second
+
+/*
+ *  A server is removed from the cluster by draining it. DRAN marks it
+ *  leaving, which the other servers learn by gossip, and from then on its
+ *  records belong to the servers that would own them without it. The server
+ *  hands every record it holds over to their owners, deleting each one once
+ *  the owners have acknowledged it, gives the ranges it keeps to other
+ *  servers, and hands its hints over. It goes over its tables again until a
+ *  pass finds nothing left, which makes sure nothing written to it meanwhile
+ *  is lost, and only then marks itself left. Until then, reads and scans ask
+ *  it as well, since the new owners may not have every record yet.
+ *
+ *  A server left holds nothing and can be stopped and taken out of SERVERS.
+ *  Servers of a Raft group cannot be drained, as the group is fixed.
+ */
+type drainProgress struct {
+    lock     sync.Mutex
+    started  bool
+    pass     int
+    table    string
+    tables   int
+    done     int
+    left     int       /* Records left at the start of the pass */
+    hints    int
+    err      error
+}
+
+/* Drain addr, or tell how draining it goes. */
+func (srv *Server) drainServer(pool *Pool, addr string) ([]byte, error) {
+    if !contains(SERVERS, addr) {
+        return nil, fmt.Errorf("%w: %s is not a server", ErrInvalid, addr)
+    }
+    if addr != srv.Addr {
+        return pool.Call(addr, EncodeRequest(DRAN_CODE, nil, []byte(addr), nil))
+    }
+    if srv.members.State(addr) == MEMBER_ACTIVE {
+        for table := range RAFT_TABLES {
+            if contains(FullRing().Owners([]byte(table), nil), addr) {
+                return nil, fmt.Errorf("%w: %s is in the Raft group of %s", ErrInvalid,
+                                       addr, table)
+            }
+        }
+        if len(CurrentRing().Servers()) < 2 {
+            return nil, fmt.Errorf("%w: no server would be left", ErrInvalid)
+        }
+        srv.members.SetState(addr, MEMBER_LEAVING)
+    }
+    srv.startDrain()
+    return srv.drainReport(), nil
+}
+
+/* Drain this server if it is leaving, once. */
+func (srv *Server) startDrain() {
+    if srv.members.State(srv.Addr) != MEMBER_LEAVING {
+        return
+    }
+    var progress = &srv.drain
+    progress.lock.Lock()
+    defer progress.lock.Unlock()
+    if progress.started {
+        return
+    }
+    progress.started = true
+    println("draining", srv.Addr)
+    go srv.drainLoop()
+}
+
+func (srv *Server) drainLoop() {
+    var pool = NewPool()
+    defer pool.Close()
+    /* Let the others learn that this server is leaving, so that writes stop
+       coming to it before the first pass */
+    time.Sleep(3 * GOSSIP_INTERVAL)
+    for {
+        done, err := srv.drainPass(pool)
+        srv.drain.lock.Lock()
+        srv.drain.err = err
+        srv.drain.lock.Unlock()
+        if err != nil {
+            println("cannot drain", srv.Addr, "\b:", err.Error())
+        }
+        if done {
+            break
+        }
+        time.Sleep(DRAIN_RETRY)
+    }
+    srv.members.SetState(srv.Addr, MEMBER_LEFT)
+    println("drained", srv.Addr, "\b, it can be stopped and taken out of the servers")
+}
+
+/* One pass over every table. It is done when nothing was left to hand over
+   at its start. */
+func (srv *Server) drainPass(pool *Pool) (bool, error) {
+    tables, err := srv.strg.Tables()
+    if err != nil {
+        return false, err
+    }
+    var left int
+    for _, table := range tables {
+        cola, err := srv.strg.ExistentCOLA([]byte(table))
+        if err != nil {
+            return false, err
+        }
+        cola.ScanVersions(nil, nil, func(k, v []byte, version uint64) bool {
+            left++
+            return true
+        })
+    }
+    var hints int
+    for _, n := range srv.hints.Pending() {
+        hints += n
+    }
+    var progress = &srv.drain
+    progress.lock.Lock()
+    progress.pass++
+    progress.tables, progress.done = len(tables), 0
+    progress.left, progress.hints = left, hints
+    progress.lock.Unlock()
+    if left == 0 && hints == 0 {
+        return true, nil
+    }
+    for table := range RANGE_TABLES {
+        err = srv.moveOwnRanges(pool, []byte(table))
+        if err != nil {
+            return false, err
+        }
+    }
+    for _, table := range tables {
+        progress.lock.Lock()
+        progress.table = table
+        progress.lock.Unlock()
+        err = srv.handOver(table)
+        if err != nil {
+            return false, err
+        }
+        progress.lock.Lock()
+        progress.done++
+        progress.lock.Unlock()
+    }
+    for target := range srv.hints.Pending() {
+        var gone = srv.members.State(target) == MEMBER_LEFT
+        if !gone && !srv.members.Alive(target) {
+            continue
+        }
+        _, err = srv.hints.Replay(pool, target, gone)
+        if err != nil {
+            return false, err
+        }
+    }
+    return false, nil
+}
+
+/* Send every record of a table to its owners and delete it. Records of
+   hashed tables this server owned are sent only to the owners that replace
+   it, and the others to all their owners. */
+func (srv *Server) handOver(table string) error {
+    reallocLock.Lock()
+    defer reallocLock.Unlock()
+    var self = srv.Addr
+    var previous = func(t, key []byte) []string {
+        if RangeTable(t) {
+            return nil
+        }
+        if owners := FullRing().Owners(t, key); contains(owners, self) {
+            return owners
+        }
+        return nil
+    }
+    return reallocateTable(srv.strg, self, table, nil, previous, false)
+}
+
+/* Give the ranges this server keeps to the next server on the ring that
+   does not keep them yet, preferring one in another zone. */
+func (srv *Server) moveOwnRanges(pool *Pool, table []byte) error {
+    for _, kr := range RANGES.Table(table) {
+        if !contains(kr.Owners, srv.Addr) {
+            continue
+        }
+        var ring = CurrentRing()
+        var owners []string
+        for _, owner := range kr.Owners {
+            if owner != srv.Addr {
+                owners = append(owners, owner)
+            }
+        }
+        /* A zone the others are not in, if there is one */
+        var zones []string
+        for _, owner := range owners {
+            zones = append(zones, ZoneOf(owner))
+        }
+        var hash = HashTableKey(table, kr.Start)
+        var next string
+        for _, s := range ring.Successors(hash, len(ring.Servers())) {
+            if contains(owners, s) {
+                continue
+            }
+            if next == "" || !contains(zones, ZoneOf(s)) && contains(zones, ZoneOf(next)) {
+                next = s
+            }
+        }
+        if next != "" {
+            owners = append(owners, next)
+        }
+        err := srv.publishRange(pool, table, kr.Start, owners)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/* Servers being drained that owned key before. */
+func (srv *Server) drainingOwners(table, key []byte) []string {
+    var leaving = srv.members.InState(MEMBER_LEAVING)
+    if len(leaving) == 0 {
+        return nil
+    }
+    /* Ranges name their owners, the old ones being forgotten */
+    if RangeTable(table) {
+        return leaving
+    }
+    var result []string
+    for _, owner := range FullRing().Owners(table, key) {
+        if contains(leaving, owner) {
+            result = append(result, owner)
+        }
+    }
+    return result
+}
+
+/* Readable state of the drain of this server. */
+func (srv *Server) drainReport() []byte {
+    var progress = &srv.drain
+    progress.lock.Lock()
+    defer progress.lock.Unlock()
+    var report strings.Builder
+    switch srv.members.State(srv.Addr) {
+        case MEMBER_ACTIVE:
+            fmt.Fprintf(&report, "%s active\n", srv.Addr)
+            return []byte(report.String())
+        case MEMBER_LEFT:
+            fmt.Fprintf(&report, "%s left, it can be stopped and taken out of the servers\n",
+                        srv.Addr)
+            return []byte(report.String())
+    }
+    if progress.pass == 0 {
+        fmt.Fprintf(&report, "%s leaving, about to hand its records over", srv.Addr)
+    } else {
+        fmt.Fprintf(&report, "%s leaving: pass %d, %d records and %d hints left, table %d of %d",
+                    srv.Addr, progress.pass, progress.left, progress.hints, progress.done,
+                    progress.tables)
+        if progress.done < progress.tables {
+            fmt.Fprintf(&report, " (%s)", progress.table)
+        }
+    }
+    if progress.err != nil {
+        fmt.Fprintf(&report, ", last error: %s", progress.err.Error())
+    }
+    report.WriteString("\n")
+    return []byte(report.String())
+}
@@ -58,6 +58,8 @@ func GpollDel(state *GpollState, ev *EpollEvent) bool {
 
 func GpollWait(state *GpollState) int {
     n, err := EpollWait(state.Epfd, state.Events, -1)
+    /* The runtime preempts goroutines with signals */
+    if err == EINTR { return 0 }
     if err != nil || n < 0 { return -1 }
     return n
 }
@@ -0,0 +1,64 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+package meepodb
+
+import (
+    "errors"
+    "io"
+    "os"
+    . "syscall"
+)
+
+var (
+    ErrNotFound    = errors.New("meepodb: not found")
+    ErrCorrupt     = errors.New("meepodb: corrupt data")
+    ErrClosed      = errors.New("meepodb: closed")
+    ErrInvalid     = errors.New("meepodb: invalid argument")
+    ErrFull        = errors.New("meepodb: blocks are full")
+    ErrUnavailable = errors.New("meepodb: not enough servers available")
+    ErrNotLeader   = errors.New("meepodb: not the leader")
+    ErrReadOnly    = errors.New("meepodb: read-only")
+    ErrBehind      = errors.New("meepodb: copies behind the session")
+)
+
+/* Errors of system calls are wrapped with the operation and the path, so that
+   errors.Is still works on both ErrCorrupt and the Errno underneath. */
+func pathError(op, path string, err error) error {
+    return &os.PathError{ Op: op, Path: path, Err: err }
+}
+
+func writeAll(fd int, data []byte) error {
+    for len(data) > 0 {
+        n, err := Write(fd, data)
+        if err == EINTR {
+            continue
+        }
+        if err != nil {
+            return err
+        }
+        if n == 0 {
+            return io.ErrShortWrite
+        }
+        data = data[n:]
+    }
+    return nil
+}
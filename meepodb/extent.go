@@ -85,13 +85,13 @@ func (extent *Extent) Record(i uint64) ([]byte, []byte) {
 }
 
 /* Binary search */
-func (extent *Extent) Find(key []byte) int64 {
+func (extent *Extent) Find(key []byte, cmp Comparator) int64 {
     var result int64 = -1
     var left, right uint64 = 0, extent.total
     for left < right {
         var middle uint64 = (left + right) / 2
         var midkey []byte = extent.Key(middle)
-        var flag int = bytes.Compare(midkey, key)
+        var flag int = cmp.Compare(midkey, key)
         if flag == 0 {
             result = int64(middle)
             break
@@ -104,11 +104,29 @@ func (extent *Extent) Find(key []byte) int64 {
     return result
 }
 
-func (extent *Extent) Free() bool {
-    return Munmap(extent.raw) == nil
+/* Index of the first record whose key is not less than key. */
+func (extent *Extent) Seek(key []byte, cmp Comparator) uint64 {
+    var left, right uint64 = 0, extent.total
+    for left < right {
+        var middle uint64 = (left + right) / 2
+        if cmp.Compare(extent.Key(middle), key) < 0 {
+            left = middle + 1
+        } else {
+            right = middle
+        }
+    }
+    return left
 }
 
-func OpenExtent(path string) (*Extent, bool) {
+func (extent *Extent) Free() error {
+    err := Munmap(extent.raw)
+    if err != nil {
+        return pathError("munmap", extent.path, err)
+    }
+    return nil
+}
+
+func OpenExtent(path string) (*Extent, error) {
     /* Extent format:
        |  size   |  total  |  index   | records |
        |---------|---------|----------|---------|
@@ -117,21 +135,32 @@ func OpenExtent(path string) (*Extent, bool) {
     extent := new(Extent)
     fd, err := Open(path, O_RDONLY, S_IREAD)
     if err != nil {
-        return extent, false
+        return nil, pathError("open", path, err)
     }
+    defer Close(fd)
     /* Decode extent head */
     buffer := make([]byte, 16)
     n, err := Read(fd, buffer)
-    if err != nil || n != 16 {
-        return extent, false
+    if err != nil {
+        return nil, pathError("read", path, err)
+    }
+    if n != 16 {
+        return nil, pathError("read", path, ErrCorrupt)
     }
     var size  uint64 = BytesToUint64(buffer[0 : 8])
     var total uint64 = BytesToUint64(buffer[8 : 16])
+    var stat Stat_t
+    err = Fstat(fd, &stat)
+    if err != nil {
+        return nil, pathError("stat", path, err)
+    }
+    if size != uint64(stat.Size) || total > (size - 16) / 8 {
+        return nil, pathError("open", path, ErrCorrupt)
+    }
     /* Extent struct */
     raw, err := Mmap(fd, 0, int(size), PROT_READ, MAP_PRIVATE)
-    Close(fd)
     if err != nil {
-        return extent, false
+        return nil, pathError("mmap", path, err)
     }
     var index []byte = raw[16 : 16 + 8 * total]
     *extent = Extent {
@@ -141,7 +170,7 @@ func OpenExtent(path string) (*Extent, bool) {
         index   : index,
         path    : path,
     }
-    return extent, true
+    return extent, nil
 }
 
 func OpenMemExtent(buffer []byte) *Extent {
@@ -155,9 +184,9 @@ func OpenMemExtent(buffer []byte) *Extent {
     }
 }
 
+/* Records come from the skiplist of Blocks, so they are sorted already. */
 func BlocksToMemExtent(records RecordSlice) *Extent {
-    sort.Sort(records)
-    var total uint64 = MAX_RECORDS
+    var total uint64 = uint64(len(records))
     var size uint64 = 16 + 8 * total
     var offsets = make([]uint64, total)
     for i := uint64(0); i < total; i++ {
@@ -180,7 +209,9 @@ func BlocksToMemExtent(records RecordSlice) *Extent {
     return OpenMemExtent(wbuf.ReadAll())
 }
 
-func MergeMemExtents(ext0, ext1 *Extent) *Extent {
+/* Of two records with the same key the one of the higher version wins, and
+   that of ext1 on a tie. */
+func MergeMemExtents(ext0, ext1 *Extent, cmp Comparator) *Extent {
     /* Get total and entries */
     ext := [2]*Extent{ ext0, ext1 }
     var total  uint64
@@ -192,9 +223,15 @@ func MergeMemExtents(ext0, ext1 *Extent) *Extent {
     flags   := make([]int, limit)
     len_    := [2]uint64{ ext[0].total, ext[1].total }
     for iter[0] < len_[0] && iter[1] < len_[1] {
-        flag := bytes.Compare(ext[0].Key(iter[0]), ext[1].Key(iter[1]))
+        flag := cmp.Compare(ext[0].Key(iter[0]), ext[1].Key(iter[1]))
         if flag == 0 {
+            k0, v0 := ext[0].Record(iter[0])
             k, v = ext[1].Record(iter[1])
+            /* Flag 2 takes the record of ext0 and skips both */
+            if recordVersion(v0) > recordVersion(v) {
+                k, v = k0, v0
+                flag = 2
+            }
             iter[0], iter[1] = iter[0] + 1, iter[1] + 1
         } else if flag < 0 {
             k, v = ext[0].Record(iter[0])
@@ -234,7 +271,10 @@ func MergeMemExtents(ext0, ext1 *Extent) *Extent {
         if flags[i] == 0 {
             k, v = ext[1].Record(iter[1])
             iter[0], iter[1] = iter[0] + 1, iter[1] + 1
-        }  else if flags[i] < 0 {
+        } else if flags[i] == 2 {
+            k, v = ext[0].Record(iter[0])
+            iter[0], iter[1] = iter[0] + 1, iter[1] + 1
+        } else if flags[i] < 0 {
             k, v = ext[0].Record(iter[0])
             iter[0]++
         } else {
@@ -247,13 +287,17 @@ func MergeMemExtents(ext0, ext1 *Extent) *Extent {
     return OpenMemExtent(wbuf.ReadAll())
 }
 
-func CompactMemExtent(ext *Extent) {
+/* Drop the deleted records of versions below horizon from ext. */
+func CompactMemExtent(ext *Extent, horizon uint64) {
     var size uint64 = 16
     var total uint64
     var entries = make([]uint64, ext.total)
+    var expired = func(v []byte) bool {
+        return deleted(v) && recordVersion(v) < horizon
+    }
     for i := uint64(0); i < ext.total; i++ {
         k, v := ext.Record(i)
-        if len(v) > 0 {
+        if !expired(v) {
             entries[total] = size << KEY_BITS + uint64(len(k))
             size += uint64(len(k) + len(v))
             total++
@@ -273,7 +317,7 @@ func CompactMemExtent(ext *Extent) {
     }
     for i := uint64(0); i < ext.total; i++ {
         k, v := ext.Record(i)
-        if len(v) > 0 {
+        if !expired(v) {
             wbuf.Write(k)
             wbuf.Write(v)
         }
@@ -425,8 +469,8 @@ func MergeExtents2(path string, ext0, ext1 *Extent) bool {
 }
 
 func CompactExtent2(path string) bool {
-    ext, ok := OpenExtent(path)
-    if !ok {
+    ext, err := OpenExtent(path)
+    if err != nil {
         return false
     }
     var size uint64 = 16
@@ -0,0 +1,349 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+/* Position in the change log of each server followed, "server position" per
+   line */
+const FOLLOW_FILE string = ".follow"
+
+/* Time between polls of a server with no more changes */
+const FOLLOW_INTERVAL time.Duration = 200 * time.Millisecond
+
+/* Time before a server that failed is polled again */
+const FOLLOW_RETRY time.Duration = 5 * time.Second
+
+/*
+ *  A follower is a server outside SERVERS keeping copies of the tables of the
+ *  servers in FOLLOW, which it tails with TAIL, see ChangeLog. It copies
+ *  their tables first with LSCN, from the position their logs were at, and
+ *  again whenever the position it reached is gone from a log. Records are
+ *  written by their versions, so copies of a record from several servers,
+ *  or written twice, come out as the newest one.
+ *
+ *  GET, SCAN, KEYS and SIZE are served from the copies, which are as stale
+ *  as the lag LAG reports, and writes are rejected with ErrReadOnly. A GET
+ *  with a session token newer than the copy fails, for the client to read
+ *  from the servers instead.
+ */
+type Following struct {
+    lock      sync.Mutex
+    path      string
+    followers []*follower
+}
+
+/* Tailing of one server */
+type follower struct {
+    primary  string
+    position uint64
+    synced   bool       /* Position holds since the tables were copied */
+    head     uint64     /* Of the log of the primary, last seen        */
+    caught   time.Time  /* When the primary had no more changes        */
+    copies   int        /* Times the tables were copied                */
+    err      error
+}
+
+/* Positions saved, a server without one having its tables copied first. */
+func OpenFollowing(dir string, primaries []string) (*Following, error) {
+    var following = &Following{ path: dir + "/" + FOLLOW_FILE }
+    var positions = make(map[string]uint64)
+    data, err := os.ReadFile(following.path)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    for _, line := range strings.Split(string(data), "\n") {
+        primary, position, ok := strings.Cut(line, " ")
+        if !ok {
+            continue
+        }
+        positions[primary], err = strconv.ParseUint(position, 10, 64)
+        if err != nil {
+            return nil, fmt.Errorf("%w: %s: %q", ErrCorrupt, following.path, line)
+        }
+    }
+    for _, primary := range primaries {
+        position, ok := positions[primary]
+        following.followers = append(following.followers, &follower{
+            primary  : primary,
+            position : position,
+            synced   : ok,
+        })
+    }
+    return following, nil
+}
+
+/* Callers hold the lock. */
+func (following *Following) save() error {
+    var data []byte
+    for _, f := range following.followers {
+        if f.synced {
+            data = fmt.Appendf(data, "%s %d\n", f.primary, f.position)
+        }
+    }
+    return replaceFile(following.path, data)
+}
+
+/* Lines of how far behind each server followed the copies are. */
+func (following *Following) Report() []byte {
+    following.lock.Lock()
+    defer following.lock.Unlock()
+    var now = time.Now()
+    var result []byte
+    for _, f := range following.followers {
+        var lag = "never caught up"
+        if !f.caught.IsZero() {
+            lag = "lag " + now.Sub(f.caught).Round(time.Millisecond).String()
+        }
+        result = fmt.Appendf(result, "%s at %d of %d, %d bytes behind, %s",
+                             f.primary, f.position, f.head,
+                             max(f.head, f.position) - f.position, lag)
+        if !f.synced {
+            result = append(result, ", copying tables"...)
+        } else if f.copies > 1 {
+            /* The follower fell behind the changes the server keeps */
+            result = fmt.Appendf(result, ", tables copied %d times", f.copies)
+        }
+        if f.err != nil {
+            result = fmt.Appendf(result, ", last error: %s", f.err.Error())
+        }
+        result = append(result, '\n')
+    }
+    return result
+}
+
+/* Serve copies of the tables of the servers in FOLLOW, read-only. */
+func (srv *Server) Follow() bool {
+    var err error
+    srv.started = time.Now()
+    srv.follows, err = OpenFollowing(srv.strg.Dir(), FOLLOW)
+    if err != nil {
+        println("cannot open", FOLLOW_FILE, "\b:", err.Error())
+        return false
+    }
+    loops, ok := srv.listen()
+    if !ok {
+        return false
+    }
+    for _, f := range srv.follows.followers {
+        go srv.follow(f)
+    }
+    return srv.run(loops)
+}
+
+/* Tail the change log of a server for good. */
+func (srv *Server) follow(f *follower) {
+    var following = srv.follows
+    var pool = NewPool()
+    for {
+        following.lock.Lock()
+        var position, synced = f.position, f.synced
+        following.lock.Unlock()
+        v, err := pool.Call(f.primary, EncodeRequest(TAIL_CODE, nil, nil, Uint64ToBytes(position)))
+        if err == nil && len(v) < 16 {
+            err = fmt.Errorf("%w: TAIL reply of %d bytes", ErrCorrupt, len(v))
+        }
+        var oldest, head uint64
+        var copied bool
+        if err == nil {
+            oldest, head = BytesToUint64(v[0:8]), BytesToUint64(v[8:16])
+            if !synced || position < oldest || position > head {
+                println("copying the tables of", f.primary, "\b, from position", head)
+                err = srv.copyPrimary(pool, f.primary)
+                position, copied = head, true
+            } else {
+                err = srv.applyChanges(v[16:])
+                position += uint64(len(v) - 16)
+            }
+        }
+        following.lock.Lock()
+        f.err = err
+        if err == nil {
+            if copied {
+                f.copies++
+            }
+            f.position, f.synced = position, true
+            f.head = max(f.head, head)
+            if position >= head {
+                f.caught = time.Now()
+            }
+            err = following.save()
+        }
+        following.lock.Unlock()
+        switch {
+            case err != nil:
+                println("cannot follow", f.primary, "\b:", err.Error())
+                time.Sleep(FOLLOW_RETRY)
+            case position >= head:
+                time.Sleep(FOLLOW_INTERVAL)
+        }
+    }
+}
+
+/* Copy every table of a server by its local records, deletions included. */
+func (srv *Server) copyPrimary(pool *Pool, primary string) error {
+    list, err := pool.Call(primary, EncodeSym(TABS_CODE))
+    if err != nil {
+        return err
+    }
+    for _, line := range strings.Split(strings.TrimSpace(string(list)), "\n") {
+        table, _, _ := strings.Cut(line, " ")
+        if table == "" {
+            continue
+        }
+        var start = []byte{}
+        for start != nil {
+            v, err := pool.Call(primary, EncodeScan(LSCN_CODE, []byte(table), start, nil, 0))
+            if err != nil {
+                return err
+            }
+            page, err := DecodeScanPage(v)
+            if err != nil {
+                return err
+            }
+            for i, key := range page.Keys {
+                _, err = srv.strg.Put([]byte(table), key, page.Values[i], page.Versions[i])
+                if err != nil {
+                    return err
+                }
+            }
+            start = page.Next
+        }
+    }
+    return nil
+}
+
+/* Apply changes as framed by ChangeLog. */
+func (srv *Server) applyChanges(changes []byte) error {
+    for len(changes) > 0 {
+        if len(changes) < 8 {
+            return fmt.Errorf("%w: change cut off", ErrCorrupt)
+        }
+        code, tlen, klen, vlen := DecodeHead(changes[:8])
+        if uint64(len(changes)) < 8 + tlen + klen + vlen {
+            return fmt.Errorf("%w: change cut off", ErrCorrupt)
+        }
+        var table = changes[8 : 8 + tlen]
+        var key = changes[8 + tlen : 8 + tlen + klen]
+        var record = changes[8 + tlen + klen : 8 + tlen + klen + vlen]
+        changes = changes[8 + tlen + klen + vlen:]
+        var err error
+        switch code {
+            case SET_CODE:
+                version, value := Unstamp(record)
+                _, err = srv.strg.Put(table, key, value, version)
+            case DROP_CODE:
+                err = srv.dropBefore(table, recordVersion(record))
+            default:
+                err = fmt.Errorf("%w: change of code %#x", ErrCorrupt, code)
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/* Delete the records of table older than a drop by one of the servers
+   followed. The table is not dropped, as records copied from the others may
+   live on there; those they wrote later win over the deletions. */
+func (srv *Server) dropBefore(table []byte, version uint64) error {
+    cola, err := srv.strg.ExistentCOLA(table)
+    if errors.Is(err, ErrNotFound) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    var keys [][]byte
+    err = cola.ScanVersions(nil, nil, func(key, value []byte, v uint64) bool {
+        if v < version {
+            keys = append(keys, clone(key))
+        }
+        return true
+    })
+    for _, key := range keys {
+        if err != nil {
+            break
+        }
+        _, err = srv.strg.Put(table, key, nil, version)
+    }
+    return err
+}
+
+/* Requests to a follower, which has no say in the cluster. */
+func (srv *Server) handleFollower(req *request) {
+    var sockfd = req.sockfd
+    switch req.code {
+        case GET_CODE:
+            record, err := srv.localRecord(req.table, req.key)
+            if err == nil && len(req.value) == 8 &&
+               recordVersion(record) < BytesToUint64(req.value) {
+                err = fmt.Errorf("%w: the copy of %s has not caught up yet", ErrBehind,
+                                 srv.Addr)
+            }
+            if err == nil && !req.opts.Version {
+                _, record = Unstamp(record)
+            } else if err == nil && record == nil {
+                record = Stamp(0, nil)
+            }
+            replyResult(sockfd, record, err)
+        case SCAN_CODE, KEYS_CODE:
+            var value []byte
+            limit, end := decodeScan(req.value)
+            var fetch = func(server string, start []byte) (*ScanPage, error) {
+                return srv.localScan(req.table, start, end, limit)
+            }
+            page, err := scanServers([]string{ srv.Addr }, req.table, req.key, end, limit, fetch)
+            if err == nil {
+                if req.code == KEYS_CODE {
+                    clear(page.Values)
+                }
+                value = page.Encode()
+            }
+            replyResult(sockfd, value, err)
+        case SIZE_CODE:
+            reply(sockfd, OK_CODE, Uint64ToBytes(srv.strg.Size(req.table)))
+        case STAT_CODE:
+            report, err := srv.status()
+            replyResult(sockfd, report, err)
+        case TABS_CODE:
+            list, err := srv.tableList()
+            replyResult(sockfd, list, err)
+        case LAG_CODE:
+            reply(sockfd, OK_CODE, srv.follows.Report())
+        case SET_CODE, DROP_CODE, FWRD_CODE, REPL_CODE, DSTR_CODE, LDRP_CODE:
+            replyResult(sockfd, nil, fmt.Errorf("%w: %s is a follower", ErrReadOnly, srv.Addr))
+        default:
+            replyResult(sockfd, nil, errors.New("not served by a follower"))
+    }
+}
@@ -0,0 +1,367 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "fmt"
+    "math"
+    "math/rand"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    GOSSIP_INTERVAL time.Duration = time.Second
+    /* Servers gossiped with each round */
+    GOSSIP_FANOUT   int           = 2
+    /* Heartbeat intervals a server remembers of each other one */
+    PHI_WINDOW      int           = 100
+    /* Suspicion above which a server is taken as down, 8 meaning a 1e-8
+       chance of the heartbeat being merely late */
+    PHI_THRESHOLD   float64       = 8
+)
+
+/* States of a server in the membership, which only go forward */
+const (
+    MEMBER_ACTIVE  byte = iota
+    MEMBER_LEAVING        /* Handing its records over, owns none */
+    MEMBER_LEFT           /* Holds no records any more           */
+)
+
+/* States of servers other than active, kept across restarts */
+const MEMBERS_FILE string = ".members"
+
+/*
+ *  Every GOSSIP_INTERVAL a server bumps its own heartbeat and sends the
+ *  heartbeats it knows of to GOSSIP_FANOUT random servers with GOSP, which
+ *  answer with theirs. A heartbeat is the start time of its server and a
+ *  counter, so that one restarted is not taken for one stalled.
+ *
+ *  Liveness is judged by phi accrual: each server records how long the
+ *  heartbeats of the others take to go up, and a server whose heartbeat has
+ *  not gone up for long compared to that is down. Each server judges by
+ *  itself from the heartbeats it has seen, so views may differ for a few
+ *  rounds.
+ *
+ *  A server being drained is marked leaving, and the mark goes around with
+ *  the heartbeats. No record is placed on a server that is not active.
+ */
+type Members struct {
+    self     string
+    lock     sync.Mutex
+    members  map[string]*member
+    path     string               /* MEMBERS_FILE, none on clients */
+}
+
+type member struct {
+    start      uint64
+    beat       uint64
+    state      byte
+    last       time.Time
+    intervals  []float64
+}
+
+func NewMembers(self string, servers []string) *Members {
+    var m = &Members{ self: self, members: make(map[string]*member) }
+    var now = time.Now()
+    for _, s := range append([]string{ self }, servers...) {
+        m.members[s] = &member{ last: now }
+    }
+    m.members[self].start = uint64(now.UnixNano())
+    return m
+}
+
+/* Suspicion that a server is down, assuming heartbeat intervals are
+   exponentially distributed around their mean. */
+func (mb *member) phi(now time.Time) float64 {
+    var mean = GOSSIP_INTERVAL.Seconds()
+    if len(mb.intervals) > 0 {
+        var sum float64
+        for _, x := range mb.intervals {
+            sum += x
+        }
+        mean = math.Max(sum / float64(len(mb.intervals)), mean / 2)
+    }
+    return now.Sub(mb.last).Seconds() / mean * math.Log10E
+}
+
+func (mb *member) observe(start, beat uint64, now time.Time) {
+    if start < mb.start || (start == mb.start && beat <= mb.beat) {
+        return
+    }
+    /* The first heartbeat of a run tells nothing about its intervals */
+    if start == mb.start {
+        mb.intervals = append(mb.intervals, now.Sub(mb.last).Seconds())
+        if len(mb.intervals) > PHI_WINDOW {
+            mb.intervals = mb.intervals[1:]
+        }
+    }
+    mb.start, mb.beat, mb.last = start, beat, now
+}
+
+/* Whether a server is taken as up. Servers not in the membership are. */
+func (m *Members) Alive(addr string) bool {
+    if addr == m.self {
+        return true
+    }
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    mb, ok := m.members[addr]
+    return !ok || mb.phi(time.Now()) < PHI_THRESHOLD
+}
+
+/* Servers taken as up first, keeping the order otherwise. */
+func (m *Members) Prefer(servers []string) []string {
+    var result = make([]string, 0, len(servers))
+    var down []string
+    for _, s := range servers {
+        if m.Alive(s) {
+            result = append(result, s)
+        } else {
+            down = append(down, s)
+        }
+    }
+    return append(result, down...)
+}
+
+/* | start 8 bytes | beat 8 bytes | state | alen 2 bytes | addr | of every
+   server heard of. */
+func (m *Members) encode() []byte {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    var result []byte
+    for addr, mb := range m.members {
+        if mb.start == 0 && mb.state == MEMBER_ACTIVE {
+            continue
+        }
+        result = append(result, Uint64ToBytes(mb.start)...)
+        result = append(result, Uint64ToBytes(mb.beat)...)
+        result = append(result, mb.state, byte(len(addr) >> 8), byte(len(addr)))
+        result = append(result, addr...)
+    }
+    return result
+}
+
+/* Take in heartbeats gossiped by another server. Servers not heard of before
+   join the membership. */
+func (m *Members) merge(data []byte) {
+    var now = time.Now()
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    var changed bool
+    for len(data) >= 19 {
+        var start, beat = BytesToUint64(data), BytesToUint64(data[8:])
+        var state = data[16]
+        var alen = int(data[17]) << 8 | int(data[18])
+        if len(data) < 19 + alen {
+            break
+        }
+        var addr = string(data[19 : 19 + alen])
+        data = data[19 + alen:]
+        mb, ok := m.members[addr]
+        if !ok {
+            mb = &member{ last: now }
+            m.members[addr] = mb
+        }
+        if state > mb.state {
+            mb.state = state
+            changed = true
+        }
+        if addr != m.self {
+            mb.observe(start, beat, now)
+        }
+    }
+    if changed {
+        m.stateChanged()
+    }
+}
+
+/* Mark a server as leaving or left. The result tells whether it was not
+   already. */
+func (m *Members) SetState(addr string, state byte) bool {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    mb, ok := m.members[addr]
+    if !ok {
+        mb = &member{ last: time.Now() }
+        m.members[addr] = mb
+    }
+    if state <= mb.state {
+        return false
+    }
+    mb.state = state
+    m.stateChanged()
+    return true
+}
+
+func (m *Members) State(addr string) byte {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    if mb, ok := m.members[addr]; ok {
+        return mb.state
+    }
+    return MEMBER_ACTIVE
+}
+
+/* Servers in the given state, sorted. */
+func (m *Members) InState(state byte) []string {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    var result []string
+    for addr, mb := range m.members {
+        if mb.state == state {
+            result = append(result, addr)
+        }
+    }
+    sort.Strings(result)
+    return result
+}
+
+/* Called with the lock held. Placement is told of the servers that are not
+   active, and they are saved. */
+func (m *Members) stateChanged() {
+    var inactive []string
+    var saved []byte
+    for addr, mb := range m.members {
+        if mb.state != MEMBER_ACTIVE {
+            inactive = append(inactive, addr)
+            saved = append(saved, addr + " " + strconv.Itoa(int(mb.state)) + "\n"...)
+        }
+    }
+    sort.Strings(inactive)
+    setInactive(inactive)
+    if m.path == "" {
+        return
+    }
+    err := replaceFile(m.path, saved)
+    if err != nil {
+        println("cannot save members:", err.Error())
+    }
+}
+
+/* Read back the states saved in path, and save them there from now on. */
+func (m *Members) Load(path string) error {
+    data, err := os.ReadFile(path)
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    m.path = path
+    for _, line := range strings.Split(string(data), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) != 2 {
+            continue
+        }
+        state, err := strconv.Atoi(fields[1])
+        if err != nil || state > int(MEMBER_LEFT) {
+            return fmt.Errorf("%w: bad line %q in %s", ErrCorrupt, line, path)
+        }
+        mb, ok := m.members[fields[0]]
+        if !ok {
+            mb = &member{ last: time.Now() }
+            m.members[fields[0]] = mb
+        }
+        mb.state = byte(state)
+    }
+    m.stateChanged()
+    return nil
+}
+
+/* Lines of "server up|down phi", sorted by server, with "leaving" or "left"
+   after servers that are so. */
+func (m *Members) Topology() []byte {
+    var now = time.Now()
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    var servers = make([]string, 0, len(m.members))
+    for addr := range m.members {
+        servers = append(servers, addr)
+    }
+    sort.Strings(servers)
+    var result []byte
+    for _, addr := range servers {
+        var phi float64
+        if addr != m.self {
+            phi = m.members[addr].phi(now)
+        }
+        var state = "up"
+        if phi >= PHI_THRESHOLD {
+            state = "down"
+        }
+        result = append(result, addr + " " + state + " " +
+                                strconv.FormatFloat(phi, 'f', 2, 64)...)
+        switch m.members[addr].state {
+            case MEMBER_LEAVING:
+                result = append(result, " leaving"...)
+            case MEMBER_LEFT:
+                result = append(result, " left"...)
+        }
+        result = append(result, '\n')
+    }
+    return result
+}
+
+func (m *Members) others() []string {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    var result = make([]string, 0, len(m.members))
+    for addr := range m.members {
+        if addr != m.self {
+            result = append(result, addr)
+        }
+    }
+    return result
+}
+
+func (m *Members) beat() {
+    m.lock.Lock()
+    m.members[m.self].beat++
+    m.lock.Unlock()
+}
+
+func (srv *Server) gossip() {
+    var pool = NewPool()
+    for {
+        time.Sleep(GOSSIP_INTERVAL)
+        srv.members.beat()
+        var others = srv.members.others()
+        rand.Shuffle(len(others), func(i, j int) {
+            others[i], others[j] = others[j], others[i]
+        })
+        for _, peer := range others[:min(len(others), GOSSIP_FANOUT)] {
+            var request = EncodeRequest(GOSP_CODE, nil, nil, srv.members.encode())
+            value, err := pool.Call(peer, request)
+            if err == nil {
+                srv.members.merge(value)
+            }
+        }
+        /* Another server may have marked this one leaving */
+        srv.startDrain()
+    }
+}
@@ -23,31 +23,62 @@
 package meepodb
 
 import (
+    "context"
     "net"
     . "syscall"
+    "time"
 )
 
+/* Not defined by package syscall. */
+const SO_REUSEPORT int = 0x0F
+
+/* Connections are armed with EPOLLONESHOT, so that a connection is not read
+   again until the request in flight has been answered and Rearm is called. */
+const CONN_EVENTS uint32 = EPOLLIN | EPOLLRDHUP | EPOLLONESHOT
+
+/* Time a read of the rest of a request may wait before the client is taken
+   as gone */
+const READ_TIMEOUT time.Duration = 10 * time.Second
+
 type GpollLoop struct {
     Lfd    int32
     State  *GpollState
     Ready  int
 }
 
-func GpollListen(addr string, maxConns int) (*GpollLoop, bool) {
-    raddr, err := net.ResolveTCPAddr("tcp", addr)
-    if err != nil {
-        return nil, false
+/* With reuse, several loops can listen on the same address and the kernel
+   spreads new connections over them. */
+func GpollListen(addr string, maxConns int, reuse bool) (*GpollLoop, bool) {
+    var config net.ListenConfig
+    if reuse {
+        config.Control = func(network, address string, c RawConn) error {
+            var serr error
+            err := c.Control(func(fd uintptr) {
+                serr = SetsockoptInt(int(fd), SOL_SOCKET, SO_REUSEPORT, 1)
+            })
+            if err != nil {
+                return err
+            }
+            return serr
+        }
     }
-    listen, err := net.ListenTCP("tcp", raddr)
+    listener, err := config.Listen(context.Background(), "tcp", addr)
     if err != nil {
         return nil, false
     }
+    listen := listener.(*net.TCPListener)
     file, err := listen.File()
     if err != nil {
         return nil, false
     }
-    fd := int32(file.Fd())
+    /* The descriptor of file is closed when file is collected */
+    dupfd, err := Dup(int(file.Fd()))
+    file.Close()
     listen.Close()
+    if err != nil {
+        return nil, false
+    }
+    fd := int32(dupfd)
 
     state, ok := GpollCreate(maxConns + 1024)
     if !ok {
@@ -67,16 +98,14 @@ func (loop *GpollLoop) Wait() {
 
 func (loop *GpollLoop) AddEvent() {
     fd, _, err := Accept(int(loop.Lfd))
-    if fd < 0 {
-        return
-    }
-    err = SetNonblock(fd, true)
-    if err != nil {
-        Close(fd)
+    if err != nil || fd < 0 {
         return
     }
+    SetNoDelay(fd)
+    var timeout = NsecToTimeval(READ_TIMEOUT.Nanoseconds())
+    SetsockoptTimeval(fd, SOL_SOCKET, SO_RCVTIMEO, &timeout)
     ev := EpollEvent {
-        Events: EPOLLIN|(EPOLLET & 0xFFFFFFFF),
+        Events: CONN_EVENTS,
         Fd: int32(fd),
     }
     if GpollAdd(loop.State, &ev) == false {
@@ -84,6 +113,15 @@ func (loop *GpollLoop) AddEvent() {
     }
 }
 
-func (loop *GpollLoop) DelEvent(ev *EpollEvent) bool {
-    return GpollDel(loop.State, ev)
+/* Wait for the next request on a connection. */
+func (loop *GpollLoop) Rearm(fd int) bool {
+    ev := EpollEvent {
+        Events: CONN_EVENTS,
+        Fd: int32(fd),
+    }
+    return GpollMod(loop.State, &ev)
+}
+
+func (loop *GpollLoop) DelEvent(fd int) bool {
+    return GpollDel(loop.State, &EpollEvent{ Fd: int32(fd) })
 }
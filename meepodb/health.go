@@ -0,0 +1,148 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "fmt"
+    "strings"
+)
+
+/*
+ *  A range is under-replicated when it has fewer copies than its table asks
+ *  for, when its copies share zones although there are enough zones to keep
+ *  them apart, or when some of its copies are on servers taken as down.
+ *  Ranges of hashed tables are the arcs between points of the ring, and those
+ *  of range tables are their ranges. HLTH lists the ones that are so.
+ */
+type rangeHealth struct {
+    ranges   int
+    short    int       /* Fewer copies than asked for   */
+    shared   int       /* Copies sharing a zone         */
+    down     int       /* Copies on servers taken down  */
+}
+
+/* Lines of the health of every table, or of one, with the range tables
+   listing their ranges that are under-replicated. */
+func (srv *Server) replicaHealth(table string) ([]byte, error) {
+    var tables []string
+    if table != "" {
+        tables = append(tables, table)
+    } else {
+        var err error
+        tables, err = srv.strg.Tables()
+        if err != nil {
+            return nil, err
+        }
+        for name := range RANGE_TABLES {
+            if !contains(tables, name) {
+                tables = append(tables, name)
+            }
+        }
+    }
+    var ring = CurrentRing()
+    var result []byte
+    for _, name := range tables {
+        var health rangeHealth
+        var details []byte
+        var n = TableReplicas(name)
+        var check = func(owners []string) bool {
+            var bad bool
+            health.ranges++
+            if len(owners) < n {
+                health.short++
+                bad = true
+            }
+            var zones []string
+            var down bool
+            for _, owner := range owners {
+                if !contains(zones, ZoneOf(owner)) {
+                    zones = append(zones, ZoneOf(owner))
+                }
+                down = down || !srv.members.Alive(owner)
+            }
+            if len(zones) < min(len(owners), ring.Zones()) {
+                health.shared++
+                bad = true
+            }
+            if down {
+                health.down++
+                bad = true
+            }
+            return bad
+        }
+        switch {
+            case RangeTable([]byte(name)):
+                for _, kr := range RANGES.Table([]byte(name)) {
+                    if check(kr.Owners) {
+                        var end = "-"
+                        if kr.End != nil {
+                            end = fmt.Sprintf("%q", kr.End)
+                        }
+                        details = fmt.Appendf(details, "  %q %s %s\n", kr.Start, end,
+                                              srv.ownersState(kr.Owners))
+                    }
+                }
+            case RaftTable([]byte(name)):
+                check(ring.Owners([]byte(name), nil))
+            default:
+                for _, point := range ring.points {
+                    check(ring.Successors(point, n))
+                }
+        }
+        result = fmt.Appendf(result, "%s: %d ranges of %d copies, %d short, %d sharing zones, %d down\n",
+                             name, health.ranges, n, health.short, health.shared, health.down)
+        result = append(result, details...)
+    }
+    return result, nil
+}
+
+/* Owners with their zones and whether they are down. */
+func (srv *Server) ownersState(owners []string) string {
+    var list = make([]string, len(owners))
+    for i, owner := range owners {
+        list[i] = owner
+        if zone, ok := ZONES[owner]; ok {
+            list[i] += "@" + zone
+        }
+        if !srv.members.Alive(owner) {
+            list[i] += "(down)"
+        }
+    }
+    return strings.Join(list, ",")
+}
+
+/* Warn of tables whose copies cannot all be in distinct zones. */
+func checkZones() {
+    if len(ZONES) == 0 {
+        return
+    }
+    var zones = CurrentRing().Zones()
+    var n = Replicas()
+    for _, replicas := range REPLICAS {
+        n = max(n, replicas)
+    }
+    if n > zones {
+        println("only", zones, "zones for", n, "copies, some copies share zones")
+    }
+}
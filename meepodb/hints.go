@@ -0,0 +1,241 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "bytes"
+    "errors"
+    "os"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+/* Table of hints, hidden from Tables as its name starts with '.' */
+const HINTS_FILE string = ".hints"
+
+/* Time between attempts to hand hints over to their servers */
+const HINT_INTERVAL time.Duration = 10 * time.Second
+
+/*
+ *  A copy that cannot be written because its server is unreachable is kept
+ *  by the coordinator as a hint, the record keyed by server, table and key.
+ *  Hints are handed over with REPL once the server answers again and deleted
+ *  after it acknowledges. A newer hint for the same key replaces the older
+ *  one, since only the newest record matters to the server.
+ *
+ *  A hint does not count as a copy for the consistency level.
+ */
+type Hints struct {
+    cola     *COLA
+    lock     sync.Mutex
+    pending  map[string]int
+}
+
+func OpenHints(strg *Storage) (*Hints, error) {
+    var path = strg.Dir() + "/" + HINTS_FILE
+    var hints = &Hints{ pending: make(map[string]int) }
+    var err error
+    _, err = os.Stat(path)
+    if err == nil {
+        hints.cola, err = OpenCOLA(path, strg.opts)
+    } else if os.IsNotExist(err) {
+        hints.cola, err = NewCOLA(path, strg.opts)
+    }
+    if err != nil {
+        return nil, err
+    }
+    err = hints.cola.ScanVersions(nil, nil, func(k, v []byte, version uint64) bool {
+        target, _, _ := decodeHintKey(k)
+        hints.pending[target]++
+        return true
+    })
+    if err != nil {
+        hints.cola.Close()
+        return nil, err
+    }
+    return hints, nil
+}
+
+/* | target | 0 | tlen 1 byte | table | key |, so that the hints of a
+   server are adjacent. */
+func hintKey(target string, table, key []byte) []byte {
+    var result = make([]byte, 0, len(target) + 2 + len(table) + len(key))
+    result = append(result, target...)
+    result = append(result, 0, byte(len(table)))
+    result = append(result, table...)
+    return append(result, key...)
+}
+
+func decodeHintKey(hkey []byte) (string, []byte, []byte) {
+    i := bytes.IndexByte(hkey, 0)
+    if i < 0 || i + 2 + int(hkey[i + 1]) > len(hkey) {
+        return "", nil, nil
+    }
+    var table = hkey[i + 2 : i + 2 + int(hkey[i + 1])]
+    return string(hkey[:i]), table, hkey[i + 2 + len(table):]
+}
+
+/* Keep record for target, unless a newer hint of the key is kept already. */
+func (hints *Hints) Add(target string, table, key, record []byte) error {
+    var hkey = hintKey(target, table, key)
+    hints.lock.Lock()
+    defer hints.lock.Unlock()
+    _, _, err := hints.cola.GetVersion(hkey)
+    var existent = err == nil
+    if err != nil && !errors.Is(err, ErrNotFound) {
+        return err
+    }
+    /* The record is stamped, so it is never empty like a deleted hint */
+    written, err := hints.cola.Put(hkey, record, recordVersion(record))
+    if err != nil {
+        return err
+    }
+    if written && !existent {
+        hints.pending[target]++
+    }
+    return nil
+}
+
+/* Number of hints kept for each server. */
+func (hints *Hints) Pending() map[string]int {
+    hints.lock.Lock()
+    defer hints.lock.Unlock()
+    var result = make(map[string]int, len(hints.pending))
+    for target, n := range hints.pending {
+        if n > 0 {
+            result[target] = n
+        }
+    }
+    return result
+}
+
+/* Hand the hints of target over to it, a batch at a time, or to the owners
+   of their records if target no longer holds any. */
+func (hints *Hints) Replay(pool *Pool, target string, gone bool) (int, error) {
+    var start = hintKey(target, nil, nil)[:len(target) + 1]
+    var end = []byte(target + "\x01")
+    var sent int
+    for {
+        var hkeys, records [][]byte
+        err := hints.cola.ScanVersions(start, end, func(k, v []byte, version uint64) bool {
+            hkeys = append(hkeys, clone(k))
+            records = append(records, clone(v))
+            return len(hkeys) < REALLOC_BATCH
+        })
+        if err != nil || len(hkeys) == 0 {
+            return sent, err
+        }
+        for i, hkey := range hkeys {
+            _, table, key := decodeHintKey(hkey)
+            var request = EncodeRequest(REPL_CODE, table, key, records[i])
+            if gone {
+                err = replicate(pool, Owners(table, key), request)
+            } else {
+                _, err = pool.Call(target, request)
+            }
+            var remote *RemoteError
+            if err != nil && !errors.As(err, &remote) {
+                return sent, err
+            }
+            if err != nil {
+                /* The server refuses it, so it would refuse it again */
+                println("cannot hand over", string(table), string(key), "to", target,
+                        "\b:", err.Error())
+            } else {
+                sent++
+            }
+            err = hints.remove(target, hkey, recordVersion(records[i]))
+            if err != nil {
+                return sent, err
+            }
+        }
+        start = append(hkeys[len(hkeys) - 1], 0)
+    }
+}
+
+/* Delete a hint handed over, unless a newer one has come meanwhile. */
+func (hints *Hints) remove(target string, hkey []byte, version uint64) error {
+    hints.lock.Lock()
+    defer hints.lock.Unlock()
+    if _, current, err := hints.cola.GetVersion(hkey); err != nil || current != version {
+        return nil
+    }
+    _, err := hints.cola.Put(hkey, nil, version)
+    if err == nil {
+        hints.pending[target]--
+    }
+    return err
+}
+
+func (hints *Hints) Close() error {
+    return hints.cola.Close()
+}
+
+/* Lines of "server count", sorted by server. */
+func (hints *Hints) Report() []byte {
+    var pending = hints.Pending()
+    var targets = make([]string, 0, len(pending))
+    for target := range pending {
+        targets = append(targets, target)
+    }
+    sort.Strings(targets)
+    var result []byte
+    for _, target := range targets {
+        result = append(result, target + " " + strconv.Itoa(pending[target]) + "\n"...)
+    }
+    return result
+}
+
+/* Send a request to every server given, failing if any fails. */
+func replicate(pool *Pool, servers []string, request []byte) error {
+    for _, server := range servers {
+        _, err := pool.Call(server, request)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (srv *Server) handoff() {
+    var pool = NewPool()
+    for {
+        time.Sleep(HINT_INTERVAL)
+        for target := range srv.hints.Pending() {
+            var gone = srv.members.State(target) == MEMBER_LEFT
+            if !gone && !srv.members.Alive(target) {
+                continue
+            }
+            n, err := srv.hints.Replay(pool, target, gone)
+            if n > 0 {
+                println("handed", n, "hints over to", target)
+            }
+            if err != nil {
+                println("cannot hand hints over to", target, "\b:", err.Error())
+            }
+        }
+    }
+}
@@ -0,0 +1,90 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+package meepodb
+
+/* A run of records in key order: the skiplist of blocks or an extent. */
+type source interface {
+    valid() bool
+    key() []byte
+    value() []byte
+    next()
+}
+
+type listSource struct {
+    node  *SkipNode
+}
+
+func (src *listSource) valid() bool   { return src.node != nil }
+func (src *listSource) key() []byte   { return src.node.Key() }
+func (src *listSource) value() []byte { return src.node.Value() }
+func (src *listSource) next()         { src.node = src.node.Next() }
+
+type extentSource struct {
+    ext   *Extent
+    i     uint64
+}
+
+func (src *extentSource) valid() bool { return src.i < src.ext.Count() }
+func (src *extentSource) key() []byte { return src.ext.Key(src.i) }
+func (src *extentSource) next()       { src.i++ }
+
+func (src *extentSource) value() []byte {
+    _, v := src.ext.Record(src.i)
+    return v
+}
+
+/*
+ *  Merge the sources in key order. Of the records with the same key the one
+ *  of the highest version wins, and on a tie that of the first source, as
+ *  sources are sorted from the newest to the oldest. Deleted records come
+ *  out as well.
+ */
+type mergeIterator struct {
+    cmp      Comparator
+    sources  []source
+}
+
+func (iter *mergeIterator) Next() ([]byte, []byte, bool) {
+    var winner source
+    for _, src := range iter.sources {
+        if !src.valid() {
+            continue
+        }
+        if winner == nil || iter.cmp.Compare(src.key(), winner.key()) < 0 {
+            winner = src
+        }
+    }
+    if winner == nil {
+        return nil, nil, false
+    }
+    var key, value = winner.key(), winner.value()
+    var version = recordVersion(value)
+    for _, src := range iter.sources {
+        if src.valid() && iter.cmp.Compare(src.key(), key) == 0 {
+            if v := src.value(); recordVersion(v) > version {
+                value, version = v, recordVersion(v)
+            }
+            src.next()
+        }
+    }
+    return key, value, true
+}
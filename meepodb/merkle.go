@@ -0,0 +1,267 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "errors"
+    "time"
+)
+
+/*
+ *  Anti-entropy catches up the copies that read repair never sees. Every
+ *  ANTI_ENTROPY seconds a server compares each of its tables with every other
+ *  server. Both sides hash the records they own in common into MERKLE_LEAVES
+ *  buckets, a bucket being a range of the ring, and build a Merkle tree over
+ *  the buckets. Only the buckets under differing nodes are exchanged with
+ *  SYNC, and each side keeps the newer copy of every record in them.
+ *
+ *  The leaves of a tree are few, so TREE answers with all of them and the
+ *  trees are compared on the side asking. A table dropped while a server was
+ *  down comes back from that server.
+ */
+
+const (
+    MERKLE_DEPTH  uint = 10
+    MERKLE_LEAVES int  = 1 << MERKLE_DEPTH
+
+    /* Buckets exchanged by one SYNC */
+    SYNC_BUCKETS  int  = 16
+)
+
+type MerkleTree struct {
+    /* nodes[1] is the root, nodes[i] has children 2i and 2i + 1 and the
+       leaves start at MERKLE_LEAVES */
+    nodes   []uint64
+}
+
+func NewMerkleTree(leaves []uint64) *MerkleTree {
+    var tree = &MerkleTree{ nodes: make([]uint64, 2 * MERKLE_LEAVES) }
+    copy(tree.nodes[MERKLE_LEAVES:], leaves)
+    for i := MERKLE_LEAVES - 1; i > 0; i-- {
+        tree.nodes[i] = mix64(tree.nodes[2 * i] ^ mix64(tree.nodes[2 * i + 1] + 1))
+    }
+    return tree
+}
+
+/* Buckets whose hashes differ in the two trees. */
+func (tree *MerkleTree) Diff(other *MerkleTree) []int {
+    var buckets []int
+    var walk func(i int)
+    walk = func(i int) {
+        if tree.nodes[i] == other.nodes[i] {
+            return
+        }
+        if i >= MERKLE_LEAVES {
+            buckets = append(buckets, i - MERKLE_LEAVES)
+            return
+        }
+        walk(2 * i)
+        walk(2 * i + 1)
+    }
+    walk(1)
+    return buckets
+}
+
+/* Bucket of a key, the range of the ring it falls in. */
+func bucketOf(table, key []byte) int {
+    return int(HashTableKey(table, key) >> (64 - MERKLE_DEPTH))
+}
+
+/* Records of the table owned by this server and peer, deleted ones included.
+   A table that does not exist has none. */
+func (srv *Server) sharedRecords(table []byte, peer string,
+                                 fn func(bucket int, key []byte, value []byte,
+                                         version uint64)) error {
+    cola, err := srv.strg.ExistentCOLA(table)
+    if errors.Is(err, ErrNotFound) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    return cola.ScanRecords(nil, nil, func(k, v []byte, version uint64) bool {
+        var owners = Owners(table, k)
+        if contains(owners, srv.Addr) && contains(owners, peer) {
+            fn(bucketOf(table, k), k, v, version)
+        }
+        return true
+    })
+}
+
+/* Hashes of the buckets of the records shared with peer. A bucket hashes
+   the keys and versions of its records, whatever their order. */
+func (srv *Server) merkleLeaves(table []byte, peer string) ([]uint64, error) {
+    var leaves = make([]uint64, MERKLE_LEAVES)
+    err := srv.sharedRecords(table, peer, func(b int, k, v []byte, version uint64) {
+        leaves[b] += mix64(fnv64(string(k)) ^ version)
+    })
+    return leaves, err
+}
+
+/* Records shared with peer in the buckets, each as
+   | klen 4 bytes | rlen 4 bytes | key | record |. */
+func (srv *Server) bucketRecords(table []byte, peer string, buckets []byte) ([]byte, error) {
+    var wanted = make(map[int]bool)
+    for i := 0; i + 1 < len(buckets); i += 2 {
+        wanted[int(buckets[i]) << 8 | int(buckets[i + 1])] = true
+    }
+    var result []byte
+    err := srv.sharedRecords(table, peer, func(b int, k, v []byte, version uint64) {
+        if !wanted[b] {
+            return
+        }
+        result = appendRecord(result, k, Stamp(version, v))
+    })
+    return result, err
+}
+
+func appendRecord(buffer, key, record []byte) []byte {
+    buffer = append(buffer, Uint64ToBytes(uint64(len(key)) << 32 | uint64(len(record)))...)
+    buffer = append(buffer, key...)
+    return append(buffer, record...)
+}
+
+/* Calls fn on each key and record of a list made by appendRecord, as SCAN
+   replies. */
+func DecodeRecords(data []byte, fn func(key, record []byte)) error {
+    for len(data) > 0 {
+        if len(data) < 8 {
+            return errors.New("truncated records")
+        }
+        var x = BytesToUint64(data)
+        var klen, rlen = x >> 32, x & 0xFFFFFFFF
+        if uint64(len(data)) < 8 + klen + rlen {
+            return errors.New("truncated records")
+        }
+        fn(data[8 : 8 + klen], data[8 + klen : 8 + klen + rlen])
+        data = data[8 + klen + rlen:]
+    }
+    return nil
+}
+
+func (srv *Server) antiEntropy() {
+    var pool = NewPool()
+    for {
+        time.Sleep(time.Duration(ANTI_ENTROPY) * time.Second)
+        tables, err := srv.strg.Tables()
+        if err != nil {
+            println("cannot list tables:", err.Error())
+            continue
+        }
+        for _, table := range tables {
+            /* Raft groups keep their copies the same by themselves */
+            if RAFT_TABLES[table] {
+                continue
+            }
+            for _, peer := range CurrentRing().Servers() {
+                if peer == srv.Addr || !srv.members.Alive(peer) {
+                    continue
+                }
+                err = srv.syncTable(pool, []byte(table), peer)
+                if err != nil {
+                    println("cannot sync", table, "with", peer, "\b:", err.Error())
+                }
+            }
+        }
+    }
+}
+
+/* Bring the records of a table shared with peer up to date on both sides. */
+func (srv *Server) syncTable(pool *Pool, table []byte, peer string) error {
+    var self = []byte(srv.Addr)
+    local, err := srv.merkleLeaves(table, peer)
+    if err != nil {
+        return err
+    }
+    value, err := pool.Call(peer, EncodeRequest(TREE_CODE, table, self, nil))
+    if err != nil {
+        return err
+    }
+    if len(value) != 8 * MERKLE_LEAVES {
+        return &RemoteError{ Addr: peer, Msg: "bad Merkle tree" }
+    }
+    var remote = make([]uint64, MERKLE_LEAVES)
+    for i := range remote {
+        remote[i] = BytesToUint64(value[8 * i:])
+    }
+    var diff = NewMerkleTree(local).Diff(NewMerkleTree(remote))
+    var pulled, pushed int
+    for len(diff) > 0 {
+        var n = min(len(diff), SYNC_BUCKETS)
+        var buckets = make([]byte, 0, 2 * n)
+        for _, b := range diff[:n] {
+            buckets = append(buckets, byte(b >> 8), byte(b))
+        }
+        diff = diff[n:]
+        value, err = pool.Call(peer, EncodeRequest(SYNC_CODE, table, self, buckets))
+        if err != nil {
+            return err
+        }
+        var theirs = make(map[string]uint64)
+        var mine = make(map[string]uint64)
+        mineRecords, err := srv.bucketRecords(table, peer, buckets)
+        if err != nil {
+            return err
+        }
+        DecodeRecords(mineRecords, func(k, record []byte) {
+            mine[string(k)] = recordVersion(record)
+        })
+        err = DecodeRecords(value, func(k, record []byte) {
+            theirs[string(k)] = recordVersion(record)
+            if version, ok := mine[string(k)]; ok && version >= recordVersion(record) {
+                return
+            }
+            version, v := Unstamp(record)
+            _, err := srv.strg.Put(table, k, v, version)
+            if err != nil {
+                println("cannot SET", string(table), string(k), "\b:", err.Error())
+                return
+            }
+            pulled++
+        })
+        if err != nil {
+            return err
+        }
+        err = DecodeRecords(mineRecords, func(k, record []byte) {
+            if version, ok := theirs[string(k)]; ok && version >= recordVersion(record) {
+                return
+            }
+            _, err := pool.Call(peer, EncodeRequest(REPL_CODE, table, k, record))
+            if err != nil {
+                println("cannot SET", string(table), string(k), "on", peer,
+                        "\b:", err.Error())
+                return
+            }
+            pushed++
+        })
+        if err != nil {
+            return err
+        }
+    }
+    if pulled > 0 || pushed > 0 {
+        println("synced", string(table), "with", peer, "\b:", pulled, "pulled,",
+                pushed, "pushed")
+    }
+    return nil
+}
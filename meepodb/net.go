@@ -23,11 +23,18 @@
 package meepodb
 
 import (
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "slices"
+    "strings"
+    "sync"
+    "sync/atomic"
     . "syscall"
+    "time"
 )
 
 var CLUSTER_TAG uint64
-var buffer = make([]byte, 8 + MAX_TABLE_NAME_LEN + MAX_KEY_LEN + MAX_VALUE_LEN)
 
 func SetKeepAlive(sockfd, v int) error {
     return SetsockoptInt(sockfd, SOL_SOCKET, SO_KEEPALIVE, v)
@@ -41,96 +48,627 @@ func SetLinger(sockfd int, sec int) error {
     return SetsockoptInt(sockfd, SOL_SOCKET, SO_LINGER, sec)
 }
 
-func StartServer(addr string) {
-    gpoll, ok := GpollListen(addr, MAX_CONNS)
+/* A request read by an event loop and handed over to a worker. */
+type request struct {
+    loop   *GpollLoop
+    sockfd int
+    code   byte
+    opts   RequestOptions
+    table  []byte
+    key    []byte
+    value  []byte
+}
+
+/*
+ *  Requests of a class wait only for requests of the classes below it on
+ *  other servers, so servers waiting for each other never wait in a cycle.
+ */
+const (
+    CLIENT_CLASS int = iota     /* From clients, may be coordinated elsewhere */
+    COORD_CLASS                 /* Writes to coordinate, or Raft proposals    */
+    LOCAL_CLASS                 /* Served from the local storage only         */
+    CLASSES
+)
+
+/*
+ *  The server runs LOOPS event loops, each of which listens on the same
+ *  address with SO_REUSEPORT and owns the connections it accepts. Requests are
+ *  executed by LOOPS workers per class sharded by table, so that a table is
+ *  always served by one goroutine of a class while independent tables
+ *  proceed in parallel.
+ */
+type Server struct {
+    Addr    string
+    strg    *Storage
+    shards  [CLASSES][]chan *request
+    repairs chan *repair
+    hints   *Hints
+    members *Members
+    groups  map[string]*RaftGroup
+    glock   sync.Mutex              /* Guards groups                   */
+    leaders sync.Map                /* Table to the leader last seen   */
+    booting atomic.Bool             /* Tables still being copied       */
+    started time.Time               /* Since when it serves            */
+    drain   drainProgress
+    changes *ChangeLog              /* Writes, for followers to tail   */
+    follows *Following              /* Servers tailed by a follower    */
+}
+
+func NewServer(addr string, strg *Storage) *Server {
+    var srv = new(Server)
+    srv.Addr = addr
+    srv.strg = strg
+    srv.repairs = make(chan *repair, REPAIR_QUEUE)
+    srv.members = NewMembers(addr, SERVERS)
+    srv.groups = make(map[string]*RaftGroup)
+    for class := range srv.shards {
+        srv.shards[class] = make([]chan *request, LOOPS)
+        for i := range srv.shards[class] {
+            srv.shards[class][i] = make(chan *request, MAX_CONNS)
+        }
+    }
+    return srv
+}
+
+func (srv *Server) Storage() *Storage {
+    return srv.strg
+}
+
+func (srv *Server) Serve() bool {
+    var err error
+    srv.started = time.Now()
+    srv.hints, err = OpenHints(srv.strg)
+    if err != nil {
+        println("cannot open hints:", err.Error())
+        return false
+    }
+    srv.changes, err = OpenChangeLog(srv.strg.Dir() + "/" + CHANGES_DIR)
+    if err != nil {
+        println("cannot open change log:", err.Error())
+        return false
+    }
+    srv.strg.LogChanges(srv.changes)
+    err = srv.members.Load(srv.strg.Dir() + "/" + MEMBERS_FILE)
+    if err != nil {
+        println("cannot load members:", err.Error())
+        return false
+    }
+    RANGES, err = OpenRanges(srv.strg)
+    if err != nil {
+        println("cannot open ranges:", err.Error())
+        return false
+    }
+    for table := range RAFT_TABLES {
+        if contains(Owners([]byte(table), nil), srv.Addr) {
+            _, err = srv.raftGroup([]byte(table))
+            if err != nil {
+                println("cannot open Raft group of", table, "\b:", err.Error())
+                return false
+            }
+        }
+    }
+    loops, ok := srv.listen()
     if !ok {
-        println("GpollListen on", addr, "failed.")
-        return
+        return false
+    }
+    go srv.repairer()
+    go srv.handoff()
+    go srv.gossip()
+    if ANTI_ENTROPY > 0 {
+        go srv.antiEntropy()
+    }
+    if len(RANGE_TABLES) > 0 {
+        go srv.rangeLoop()
+    }
+    checkZones()
+    var source = pendingBootstrap(srv.strg.Dir())
+    if source == "" {
+        source = BOOTSTRAP
+    }
+    if source != "" && source != srv.Addr {
+        srv.booting.Store(true)
+        go srv.bootstrap(source)
+    }
+    return srv.run(loops)
+}
+
+func (srv *Server) listen() ([]*GpollLoop, bool) {
+    var loops = make([]*GpollLoop, LOOPS)
+    for i := range loops {
+        var ok bool
+        loops[i], ok = GpollListen(srv.Addr, MAX_CONNS, LOOPS > 1)
+        if !ok {
+            println("GpollListen on", srv.Addr, "failed.")
+            return nil, false
+        }
+    }
+    return loops, true
+}
+
+/* Serve requests until a loop fails. */
+func (srv *Server) run(loops []*GpollLoop) bool {
+    for _, shards := range srv.shards {
+        for _, shard := range shards {
+            go srv.work(shard)
+        }
     }
-    var strg = NewStorage()
+    var done = make(chan bool)
+    for _, loop := range loops {
+        go func(loop *GpollLoop) {
+            srv.poll(loop)
+            done <- true
+        }(loop)
+    }
+    /* Any loop failing stops the server */
+    <-done
+    return false
+}
+
+func (srv *Server) poll(gpoll *GpollLoop) {
     for {
         gpoll.Wait()
         if gpoll.Ready == -1 {
             println("GpollWait failed.")
             return
         }
-        for i, ev := range gpoll.State.Events[:gpoll.Ready] {
+        for _, ev := range gpoll.State.Events[:gpoll.Ready] {
             if ev.Fd == gpoll.Lfd {
                 gpoll.AddEvent()
-            } else {
-                var sockfd = int(ev.Fd)
-                code, tab, k, v := readRequest(sockfd)
-                if code == ERR_CODE {
-                    println("unknown request")
-                    continue
-                }
-                switch code {
-                    case GET_CODE:
-                        v = strg.Get(tab, k)
-                        head := EncodeHead(OK_CODE, 0, 0, uint64(len(v)))
-                        n, err := Write(sockfd, head)
-                        if err != nil || n != 8 {
-                            println("cannot reply", sockfd)
-                            continue
-                        }
-                        if len(v) != 0 {
-                            n, err = Write(sockfd, v)
-                            if err != nil || n != len(v) {
-                                println("cannot reply", sockfd)
-                            }
-                        }
-                    case SET_CODE:
-                        var ok bool = strg.Set(tab, k, v)
-                        if !ok {
-                            /* Value is always long, so do not print it */
-                            println("cannot SET", string(tab), string(k))
-                        }
-                    case DROP_CODE:
-                        var ok bool = strg.Drop(tab)
-                        if ok {
-                            println("DROP", string(tab))
-                        } else {
-                            println("cannot DROP", string(tab))
-                        }
-                    case QUIT_CODE:
-                        gpoll.DelEvent(&gpoll.State.Events[i])
-                        Close(sockfd)
-                        println("client", sockfd, "QUIT")
-                }
+                continue
             }
+            /* The connection is not reported again until it is rearmed, so
+               a slow client holds up its own reader only */
+            go srv.receive(gpoll, int(ev.Fd))
         }
     }
 }
 
-func readRequest(sockfd int) (byte, []byte, []byte, []byte) {
-    n, err := Read(sockfd, buffer)
-    if err != nil || n < 8 {
-        return ERR_CODE, nil, nil, nil
+/* Read the request a connection has for us and hand it over to a worker. */
+func (srv *Server) receive(gpoll *GpollLoop, sockfd int) {
+    code, opts, tab, k, v := readRequest(sockfd)
+    switch code {
+        case ERR_CODE:
+            /* The rest of the stream cannot be framed any more */
+            println("unknown request")
+            gpoll.DelEvent(sockfd)
+            Close(sockfd)
+        case QUIT_CODE:
+            gpoll.DelEvent(sockfd)
+            Close(sockfd)
+            println("client", sockfd, "QUIT")
+        default:
+            var req = &request {
+                loop   : gpoll,
+                sockfd : sockfd,
+                code   : code,
+                opts   : opts,
+                table  : tab,
+                key    : k,
+                value  : v,
+            }
+            var shards = srv.shards[classOf(code)]
+            shards[shardOf(tab, len(shards))] <- req
     }
-    code, tlen, klen, vlen := DecodeHead(buffer[:8])
-    body := buffer[8 : n]
+}
+
+/* Each worker keeps its own connections to the other servers. */
+func (srv *Server) work(shard chan *request) {
+    var pool = NewPool()
+    for req := range shard {
+        srv.handle(req, pool)
+        req.loop.Rearm(req.sockfd)
+    }
+}
+
+func classOf(code byte) int {
     switch code {
+        case GET_CODE, SET_CODE, DROP_CODE, SCAN_CODE, KEYS_CODE, SIZE_CODE:
+            return CLIENT_CLASS
+        case FWRD_CODE, LEAD_CODE:
+            return COORD_CLASS
+    }
+    return LOCAL_CLASS
+}
+
+func (srv *Server) handle(req *request, pool *Pool) {
+    var strg = srv.strg
+    var sockfd = req.sockfd
+    if srv.follows != nil {
+        srv.handleFollower(req)
+        return
+    }
+    switch req.code {
         case GET_CODE:
-            if n != int(8 + tlen + klen) {
-                return ERR_CODE, nil, nil, nil
+            /* A session token may come as the value */
+            var token uint64
+            if len(req.value) == 8 {
+                token = BytesToUint64(req.value)
+            }
+            record, err := srv.get(pool, req.opts, req.table, req.key, token)
+            if err == nil && !req.opts.Version {
+                _, record = Unstamp(record)
             }
-            return GET_CODE, body[:tlen], body[tlen:], nil
+            replyResult(sockfd, record, err)
         case SET_CODE:
-            if n != int(8 + tlen + klen + vlen) {
-                return ERR_CODE, nil, nil, nil
+            var value []byte
+            version, err := srv.set(pool, req.opts, req.table, req.key, req.value)
+            if req.opts.Version {
+                value = Uint64ToBytes(version)
             }
-            return SET_CODE, body[:tlen], body[tlen : tlen + klen],
-                   body[tlen + klen :]
+            replyResult(sockfd, value, err)
+        case FWRD_CODE:
+            version, err := srv.coordinate(pool, req.opts, req.table, req.key, req.value)
+            replyResult(sockfd, Uint64ToBytes(version), err)
         case DROP_CODE:
-            if n != int(8 + tlen) {
-                return ERR_CODE, nil, nil, nil
+            err := srv.drop(pool, req.table)
+            replyResult(sockfd, nil, err)
+        case LGET_CODE:
+            record, err := srv.localRecord(req.table, req.key)
+            if err != nil {
+                println("cannot GET", string(req.table), string(req.key),
+                        "\b:", err.Error())
             }
-            return DROP_CODE, body, nil, nil
-        case QUIT_CODE:
-            if n != 8 {
-                return ERR_CODE, nil, nil, nil
+            replyResult(sockfd, record, err)
+        case REPL_CODE, DSTR_CODE:
+            /* Records come with versions, and the newest one is kept */
+            version, value := Unstamp(req.value)
+            _, err := strg.Put(req.table, req.key, value, version)
+            if err != nil {
+                /* Value is always long, so do not print it */
+                println("cannot SET", string(req.table), string(req.key),
+                        "\b:", err.Error())
+            }
+            replyResult(sockfd, nil, err)
+        case LDRP_CODE:
+            err := strg.Drop(req.table)
+            if err == nil {
+                println("DROP", string(req.table))
+            } else {
+                println("cannot DROP", string(req.table), "\b:", err.Error())
+            }
+            replyResult(sockfd, nil, err)
+        case TREE_CODE:
+            leaves, err := srv.merkleLeaves(req.table, string(req.key))
+            var value = make([]byte, 0, 8 * len(leaves))
+            for _, leaf := range leaves {
+                value = append(value, Uint64ToBytes(leaf)...)
+            }
+            replyResult(sockfd, value, err)
+        case SYNC_CODE:
+            records, err := srv.bucketRecords(req.table, string(req.key), req.value)
+            replyResult(sockfd, records, err)
+        case LEAD_CODE:
+            value, err := srv.lead(req.value[0], req.table, req.key, req.value[1:])
+            replyResult(sockfd, value, err)
+        case RAFT_CODE:
+            var value []byte
+            g, err := srv.raftGroup(req.table)
+            if err == nil {
+                value, err = g.Step(string(req.key), req.value)
+            }
+            replyResult(sockfd, value, err)
+        case SCAN_CODE, KEYS_CODE:
+            var value []byte
+            limit, end := decodeScan(req.value)
+            page, err := srv.scan(pool, req.table, req.key, end, limit)
+            if err == nil {
+                if req.code == KEYS_CODE {
+                    clear(page.Values)
+                }
+                value = page.Encode()
+            }
+            replyResult(sockfd, value, err)
+        case SIZE_CODE:
+            var value []byte
+            count, err := srv.size(pool, req.table)
+            if err == nil {
+                value = Uint64ToBytes(count)
+            }
+            replyResult(sockfd, value, err)
+        case LSCN_CODE:
+            var value []byte
+            limit, end := decodeScan(req.value)
+            page, err := srv.localScan(req.table, req.key, end, limit)
+            if err == nil {
+                value = page.Encode()
+            } else {
+                println("cannot SCAN", string(req.table), "\b:", err.Error())
             }
-            return QUIT_CODE, nil, nil, nil
+            replyResult(sockfd, value, err)
+        case SNAP_CODE:
+            manifest, err := srv.pinTables(string(req.key))
+            if err != nil {
+                println("cannot pin tables for", string(req.key), "\b:", err.Error())
+            }
+            replyResult(sockfd, manifest, err)
+        case FILE_CODE:
+            chunk, err := srv.readPinned(string(req.table), string(req.key),
+                                         BytesToUint64(req.value))
+            replyResult(sockfd, chunk, err)
+        case UNPN_CODE:
+            err := srv.unpinTables(string(req.key))
+            replyResult(sockfd, nil, err)
+        case HLTH_CODE:
+            report, err := srv.replicaHealth(string(req.table))
+            replyResult(sockfd, report, err)
+        case STAT_CODE:
+            report, err := srv.status()
+            replyResult(sockfd, report, err)
+        case LAG_CODE:
+            replyResult(sockfd, nil, fmt.Errorf("%w: %s is not a follower", ErrInvalid, srv.Addr))
+        case TAIL_CODE:
+            /* | oldest position 8 | head 8 | changes |, no changes if the
+               position is not in the log */
+            var position = BytesToUint64(req.value)
+            oldest, head := srv.changes.Bounds()
+            changes, _, err := srv.changes.Read(position)
+            if errors.Is(err, ErrNotFound) {
+                changes, err = nil, nil
+            }
+            var value = append(Uint64ToBytes(oldest), Uint64ToBytes(head)...)
+            replyResult(sockfd, append(value, changes...), err)
+        case SUBS_CODE:
+            /* | oldest position 8 | head 8 | next position 8 | changes of
+               the table |, the next position being the one asked for if it
+               is not in the log */
+            var position = BytesToUint64(req.value)
+            oldest, head := srv.changes.Bounds()
+            changes, next, err := srv.changes.Read(position)
+            if errors.Is(err, ErrNotFound) {
+                changes, next, err = nil, position, nil
+            }
+            var value = append(Uint64ToBytes(oldest), Uint64ToBytes(head)...)
+            value = append(value, Uint64ToBytes(next)...)
+            replyResult(sockfd, append(value, tableChanges(changes, req.table)...), err)
+        case TABS_CODE:
+            list, err := srv.tableList()
+            replyResult(sockfd, list, err)
+        case CMPT_CODE:
+            report, err := srv.compact(string(req.table))
+            if err != nil {
+                println("cannot compact:", err.Error())
+            }
+            replyResult(sockfd, report, err)
+        case RBAL_CODE:
+            err := srv.startRebalance()
+            replyResult(sockfd, nil, err)
+        case DRAN_CODE:
+            report, err := srv.drainServer(pool, string(req.key))
+            replyResult(sockfd, report, err)
+        case RGET_CODE:
+            /* Records for servers, a listing of one table for people */
+            if len(req.table) == 0 {
+                reply(sockfd, OK_CODE, RANGES.Records())
+            } else {
+                reply(sockfd, OK_CODE, RANGES.Report(req.table))
+            }
+        case RSET_CODE:
+            /* Servers publishing a range give its version, clients do not */
+            var err error
+            version, owners := Unstamp(req.value)
+            var servers = strings.Split(string(owners), ",")
+            if version == 0 {
+                err = srv.moveRange(req.table, req.key, servers)
+            } else {
+                _, err = RANGES.Put(string(req.table), req.key, servers, version)
+            }
+            replyResult(sockfd, nil, err)
+        case TOPO_CODE:
+            reply(sockfd, OK_CODE, srv.members.Topology())
+        case GOSP_CODE:
+            srv.members.merge(req.value)
+            reply(sockfd, OK_CODE, srv.members.encode())
+        case HINT_CODE:
+            reply(sockfd, OK_CODE, srv.hints.Report())
+        case RALC_CODE:
+            go func() {
+                err := Reallocate(strg, srv.Addr)
+                if err != nil {
+                    println("cannot reallocate:", err.Error())
+                }
+            }()
+            reply(sockfd, OK_CODE, nil)
+        case EXPL_CODE:
+            var table = string(req.table)
+            go func() {
+                err := Expel(strg, srv.Addr, table)
+                if err != nil {
+                    println("cannot expel", table, "\b:", err.Error())
+                }
+            }()
+            reply(sockfd, OK_CODE, nil)
+    }
+}
+
+/* OK with the value, or ERR with the message of err. */
+func replyResult(sockfd int, value []byte, err error) {
+    if err != nil {
+        reply(sockfd, ERR_CODE, []byte(err.Error()))
+        return
+    }
+    reply(sockfd, OK_CODE, value)
+}
+
+func reply(sockfd int, code byte, value []byte) {
+    var buffer = make([]byte, 8 + len(value))
+    copy(buffer, EncodeHead(code, 0, 0, uint64(len(value))))
+    copy(buffer[8:], value)
+    err := writeAll(sockfd, buffer)
+    if err != nil {
+        println("cannot reply", sockfd)
+    }
+}
+
+func StartServer(addr string) {
+    strg, err := NewStorage(DB_DIR, &Options{ Sync: SYNC })
+    if err != nil {
+        println("cannot open", DB_DIR, "\b:", err.Error())
+        return
+    }
+    NewServer(addr, strg).Serve()
+}
+
+func shardOf(table []byte, n int) int {
+    hash := fnv.New32a()
+    hash.Write(table)
+    return int(hash.Sum32() % uint32(n))
+}
+
+func clone(data []byte) []byte {
+    if data == nil {
+        return nil
+    }
+    var result = make([]byte, len(data))
+    copy(result, data)
+    return result
+}
+
+/* Connections stay blocking, with READ_TIMEOUT for the rest of a request once
+   epoll has reported its beginning. The body is read by the sizes in the
+   head, after they are checked. */
+func readRequest(sockfd int) (byte, RequestOptions, []byte, []byte, []byte) {
+    var buffer = make([]byte, 8)
+    var opts RequestOptions
+    n, err := readFull(sockfd, buffer[:8])
+    /* A closed connection is taken as QUIT */
+    if n == 0 {
+        return QUIT_CODE, opts, nil, nil, nil
+    }
+    if err != nil {
+        return ERR_CODE, opts, nil, nil, nil
+    }
+    code, tlen, klen, vlen := DecodeHead(buffer[:8])
+    if code & OPTS_FLAG != 0 {
+        code &^= OPTS_FLAG
+        _, err = readFull(sockfd, buffer[:8])
+        if err != nil {
+            return QUIT_CODE, opts, nil, nil, nil
+        }
+        opts = DecodeOptions(BytesToUint64(buffer[:8]))
+        if opts.Consistency > ALL {
+            return ERR_CODE, opts, nil, nil, nil
+        }
+    }
+    switch code {
+        case GET_CODE:
+            if vlen != 0 && vlen != 8 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case LGET_CODE:
+            if vlen != 0 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case SET_CODE, FWRD_CODE:
+        case TREE_CODE, SYNC_CODE:
+            if klen == 0 || vlen % 2 != 0 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case SCAN_CODE, KEYS_CODE, LSCN_CODE:
+            if vlen < 8 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case RSET_CODE:
+            if tlen == 0 || vlen <= uint64(VERSION_LEN) {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case DSTR_CODE, REPL_CODE:
+            if vlen < uint64(VERSION_LEN) {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case DROP_CODE, EXPL_CODE, LDRP_CODE, SIZE_CODE:
+            if klen != 0 || vlen != 0 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case RAFT_CODE, LEAD_CODE:
+            if vlen == 0 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case GOSP_CODE:
+            if tlen != 0 || klen != 0 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case SNAP_CODE, UNPN_CODE, DRAN_CODE:
+            if tlen != 0 || klen == 0 || vlen != 0 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case TAIL_CODE:
+            if tlen != 0 || klen != 0 || vlen != 8 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case SUBS_CODE:
+            if tlen == 0 || klen != 0 || vlen != 8 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case FILE_CODE:
+            if tlen == 0 || klen == 0 || vlen != 8 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case RGET_CODE, HLTH_CODE, CMPT_CODE:
+            if klen != 0 || vlen != 0 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        case QUIT_CODE, RALC_CODE, HINT_CODE, TOPO_CODE, STAT_CODE, TABS_CODE, RBAL_CODE,
+             LAG_CODE:
+            if tlen != 0 || klen != 0 || vlen != 0 {
+                return ERR_CODE, opts, nil, nil, nil
+            }
+        default:
+            return ERR_CODE, opts, nil, nil, nil
+    }
+    body, err := readBody(sockfd, tlen + klen + vlen)
+    if errors.Is(err, ErrUnavailable) {
+        reply(sockfd, ERR_CODE, []byte(err.Error()))
+        return ERR_CODE, opts, nil, nil, nil
+    }
+    if err != nil {
+        return QUIT_CODE, opts, nil, nil, nil
+    }
+    return code, opts, body[:tlen], body[tlen : tlen + klen], body[tlen + klen :]
+}
+
+/* Bytes of bodies being read, over all connections */
+var reading atomic.Int64
+
+const READ_CHUNK uint64 = 1 << 16
+
+/* The body is grown as it comes rather than allocated by the head, so that
+   a head alone takes no memory, and all bodies being read stay within
+   MAX_READING. */
+func readBody(sockfd int, size uint64) ([]byte, error) {
+    var body = make([]byte, 0, min(size, READ_CHUNK))
+    defer func() {
+        reading.Add(-int64(len(body)))
+    }()
+    for uint64(len(body)) < size {
+        var n = min(size - uint64(len(body)), READ_CHUNK)
+        if reading.Add(int64(n)) > int64(MAX_READING) {
+            reading.Add(-int64(n))
+            return nil, fmt.Errorf("%w: too many requests being read", ErrUnavailable)
+        }
+        var start = len(body)
+        body = slices.Grow(body, int(n))[:start + int(n)]
+        _, err := readFull(sockfd, body[start:])
+        if err != nil {
+            return nil, err
+        }
+    }
+    return body, nil
+}
+
+func readFull(fd int, buffer []byte) (int, error) {
+    var total int = 0
+    for total < len(buffer) {
+        n, err := Read(fd, buffer[total:])
+        if err == EINTR {
+            continue
+        }
+        if err != nil {
+            return total, err
+        }
+        if n == 0 {
+            return total, EPIPE
+        }
+        total += n
     }
-    return ERR_CODE, nil, nil, nil
+    return total, nil
 }
@@ -0,0 +1,181 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+package meepodb
+
+import (
+    "bytes"
+    "fmt"
+    . "syscall"
+)
+
+const (
+    NO_COMPRESSION    byte = 0
+    FLATE_COMPRESSION byte = 1
+)
+
+/* Format of the records of a table */
+const (
+    RAW_RECORDS       byte = 0      /* Values only */
+    VERSIONED_RECORDS byte = 1      /* Versions and values */
+    UPGRADING_RECORDS byte = 2      /* Versioned copies being put in place */
+)
+
+/* Keys of a table are ordered by its comparator. The name is kept in the
+   conf of the table, and a table cannot be opened with another comparator. */
+type Comparator interface {
+    Compare(a, b []byte) int
+    Name() string
+}
+
+type bytewise struct{}
+
+func (bytewise) Compare(a, b []byte) int {
+    return bytes.Compare(a, b)
+}
+
+func (bytewise) Name() string {
+    return "meepodb.bytewise"
+}
+
+var BytewiseComparator Comparator = bytewise{}
+
+type Options struct {
+    /* Merge policy of new tables; existent tables keep their own */
+    Policy          Policy
+    /* Number of records buffered in blocks before a push-down, at most
+       MAX_RECORDS */
+    WriteBufferSize uint64
+    /* Fsync blx after every write */
+    Sync            bool
+    /* Compression of values in new tables */
+    Compression     byte
+    Comparator      Comparator
+}
+
+func DefaultOptions() *Options {
+    return &Options {
+        Policy          : DEFAULT_POLICY,
+        WriteBufferSize : MAX_RECORDS,
+        Compression     : NO_COMPRESSION,
+        Comparator      : BytewiseComparator,
+    }
+}
+
+/* Fill in the zero fields with defaults. */
+func (opts *Options) complete() (*Options, error) {
+    var result = DefaultOptions()
+    if opts == nil {
+        return result, nil
+    }
+    *result = *opts
+    if result.Policy.Growth == 0 {
+        result.Policy = DEFAULT_POLICY
+    }
+    if result.WriteBufferSize == 0 {
+        result.WriteBufferSize = MAX_RECORDS
+    }
+    if result.Comparator == nil {
+        result.Comparator = BytewiseComparator
+    }
+    if !result.Policy.Valid() {
+        return nil, fmt.Errorf("%w: policy %s", ErrInvalid, result.Policy.String())
+    }
+    if result.WriteBufferSize > MAX_RECORDS {
+        return nil, fmt.Errorf("%w: write buffer of %d records", ErrInvalid,
+                               result.WriteBufferSize)
+    }
+    if result.Compression > FLATE_COMPRESSION {
+        return nil, fmt.Errorf("%w: compression %d", ErrInvalid, result.Compression)
+    }
+    return result, nil
+}
+
+/* What a table keeps in its conf file. */
+type tableConf struct {
+    policy      Policy
+    compression byte
+    comparator  string
+    format      byte
+}
+
+/* Conf format:
+   |  growth  |  merge   |  format  | compress | comparator |
+   |----------|----------|----------|----------|------------|
+   | 8 bytes  | 8 bytes  | 7 bytes  |  1 byte  |  N bytes   |
+   Conf files of early tables have the first two fields only, and those of
+   tables of raw records have no format.
+*/
+func writeConf(path string, conf tableConf) error {
+    var mode int = O_WRONLY | O_CREAT | O_TRUNC
+    fd, err := Open(path + ".1", mode, S_IRALL | S_IWALL)
+    if err != nil {
+        return pathError("open", path + ".1", err)
+    }
+    var buffer = make([]byte, 24 + len(conf.comparator))
+    copy(buffer[0:], Uint64ToBytes(conf.policy.Growth))
+    copy(buffer[8:], Uint64ToBytes(uint64(conf.policy.Merge)))
+    copy(buffer[16:], Uint64ToBytes(uint64(conf.format) << 8 | uint64(conf.compression)))
+    copy(buffer[24:], conf.comparator)
+    err = writeAll(fd, buffer)
+    Close(fd)
+    if err != nil {
+        return pathError("write", path + ".1", err)
+    }
+    err = Rename(path + ".1", path)
+    if err != nil {
+        return pathError("rename", path, err)
+    }
+    return nil
+}
+
+func readConf(path string) (tableConf, error) {
+    var conf tableConf
+    fd, err := Open(path, O_RDONLY, S_IREAD)
+    if err != nil {
+        return conf, pathError("open", path, err)
+    }
+    var buffer = make([]byte, 24 + 256)
+    n, err := Read(fd, buffer)
+    Close(fd)
+    if err != nil {
+        return conf, pathError("read", path, err)
+    }
+    if n < 16 {
+        return conf, pathError("read", path, ErrCorrupt)
+    }
+    conf.policy.Growth = BytesToUint64(buffer[0 : 8])
+    conf.policy.Merge = byte(BytesToUint64(buffer[8 : 16]))
+    conf.comparator = BytewiseComparator.Name()
+    if n >= 24 {
+        var flags = BytesToUint64(buffer[16 : 24])
+        conf.compression = byte(flags)
+        conf.format = byte(flags >> 8)
+        if n > 24 {
+            conf.comparator = string(buffer[24 : n])
+        }
+    }
+    if !conf.policy.Valid() || conf.compression > FLATE_COMPRESSION ||
+       conf.format > UPGRADING_RECORDS {
+        return conf, pathError("read", path, ErrCorrupt)
+    }
+    return conf, nil
+}
@@ -0,0 +1,152 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+package meepodb
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "time"
+)
+
+const PEER_TIMEOUT = 5 * time.Second
+
+/* A connection from one server to another. Requests may be pipelined: send
+   several of them and then read the replies in the same order. A Peer is not
+   safe for concurrent use. */
+type Peer struct {
+    Addr  string
+    conn  net.Conn
+    head  []byte
+}
+
+func DialPeer(addr string) (*Peer, error) {
+    conn, err := net.DialTimeout("tcp", addr, PEER_TIMEOUT)
+    if err != nil {
+        return nil, err
+    }
+    return &Peer{ Addr: addr, conn: conn, head: make([]byte, 8) }, nil
+}
+
+func (peer *Peer) Send(request []byte) error {
+    peer.conn.SetWriteDeadline(time.Now().Add(PEER_TIMEOUT))
+    _, err := peer.conn.Write(request)
+    return err
+}
+
+/* Read the next reply. A value following an ERR head is the error message. */
+func (peer *Peer) Reply() (byte, []byte, error) {
+    peer.conn.SetReadDeadline(time.Now().Add(PEER_TIMEOUT))
+    _, err := io.ReadFull(peer.conn, peer.head)
+    if err != nil {
+        return ERR_CODE, nil, err
+    }
+    code, _, _, vlen := DecodeHead(peer.head)
+    var value = make([]byte, vlen)
+    _, err = io.ReadFull(peer.conn, value)
+    if err != nil {
+        return ERR_CODE, nil, err
+    }
+    return code, value, nil
+}
+
+/* Send a request and wait for an OK. An ERR reply is a *RemoteError. */
+func (peer *Peer) Call(request []byte) ([]byte, error) {
+    err := peer.Send(request)
+    if err != nil {
+        return nil, err
+    }
+    code, value, err := peer.Reply()
+    if err != nil {
+        return nil, err
+    }
+    if code != OK_CODE {
+        return nil, &RemoteError{ Addr: peer.Addr, Msg: string(value) }
+    }
+    return value, nil
+}
+
+func (peer *Peer) Close() error {
+    peer.conn.Write(EncodeSym(QUIT_CODE))
+    return peer.conn.Close()
+}
+
+/* A request refused by a server, as opposed to one that could not be sent or
+   answered. */
+type RemoteError struct {
+    Addr string
+    Msg  string
+}
+
+func (err *RemoteError) Error() string {
+    if len(err.Msg) == 0 {
+        return err.Addr + ": request failed"
+    }
+    return err.Addr + ": " + err.Msg
+}
+
+/* Connections to other servers, kept open between requests. A Pool is not
+   safe for concurrent use. */
+type Pool struct {
+    peers map[string]*Peer
+}
+
+func NewPool() *Pool {
+    return &Pool{ peers: make(map[string]*Peer) }
+}
+
+/* Call a server, dialing it if needed. A kept connection may have been closed
+   by the other side since, so a request failing on it is tried once more on
+   a new one. */
+func (pool *Pool) Call(addr string, request []byte) ([]byte, error) {
+    peer, kept := pool.peers[addr]
+    for {
+        var err error
+        if peer == nil {
+            peer, err = DialPeer(addr)
+            if err != nil {
+                return nil, err
+            }
+            pool.peers[addr] = peer
+        }
+        value, err := peer.Call(request)
+        var remote *RemoteError
+        if err == nil || errors.As(err, &remote) {
+            return value, err
+        }
+        peer.conn.Close()
+        delete(pool.peers, addr)
+        if !kept {
+            return nil, fmt.Errorf("%s: %w", addr, err)
+        }
+        peer, kept = nil, false
+    }
+}
+
+func (pool *Pool) Close() {
+    for addr, peer := range pool.peers {
+        peer.Close()
+        delete(pool.peers, addr)
+    }
+}
@@ -0,0 +1,78 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+package meepodb
+
+import (
+    "strconv"
+)
+
+const (
+    /* Each level holds one run. A pushed-down run is merged into it at once
+       and only moves deeper when the merged run outgrows the level. */
+    MERGE_LEVELED byte = 0
+    /* Each level holds up to (growth - 1) runs of the same size. They are
+       merged together and moved to the next level when another one comes. */
+    MERGE_TIERED  byte = 1
+
+    MAX_LEVELS int    = 64
+    MAX_GROWTH uint64 = 64
+)
+
+type Policy struct {
+    Growth  uint64
+    Merge   byte
+}
+
+/* The original COLA: level sizes double and every level holds one run. */
+var DEFAULT_POLICY = Policy{ Growth: 2, Merge: MERGE_LEVELED }
+
+func (policy Policy) Valid() bool {
+    if policy.Growth < 2 || policy.Growth > MAX_GROWTH {
+        return false
+    }
+    return policy.Merge == MERGE_LEVELED || policy.Merge == MERGE_TIERED
+}
+
+/* Maximum number of runs in one level. */
+func (policy Policy) Runs() int {
+    if policy.Merge == MERGE_TIERED {
+        return int(policy.Growth) - 1
+    }
+    return 1
+}
+
+/* Number of records a run in the level is sized for, MAX_RECORDS * g^level. */
+func (policy Policy) Capacity(level int) uint64 {
+    var capacity uint64 = MAX_RECORDS
+    for i := 0; i < level; i++ {
+        capacity *= policy.Growth
+    }
+    return capacity
+}
+
+func (policy Policy) String() string {
+    if policy.Merge == MERGE_TIERED {
+        return "tiered/" + strconv.FormatUint(policy.Growth, 10)
+    }
+    return "leveled/" + strconv.FormatUint(policy.Growth, 10)
+}
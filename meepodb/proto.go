@@ -22,6 +22,11 @@
 
 package meepodb
 
+import (
+    "fmt"
+    "strings"
+)
+
 const (
 /*
     | CMD_CODE       : 7  bits               |  ========
@@ -44,21 +49,144 @@ const (
     GET_CODE  byte = 0x01
     SET_CODE  byte = 0x02
     DEL_CODE  byte = 0x03
-    SIZE_CODE byte = 0x0D
-    KEYS_CODE byte = 0x0E
+    SCAN_CODE byte = 0x04       /* Records of a range of keys      */
+    STAT_CODE byte = 0x05       /* How a server is doing           */
+    TABS_CODE byte = 0x06       /* Tables a server keeps           */
+    RBAL_CODE byte = 0x07       /* Reallocate in the background    */
+    CMPT_CODE byte = 0x08       /* Compact tables into one run     */
+    TAIL_CODE byte = 0x09       /* Changes from a log position     */
+    LAG_CODE  byte = 0x0A       /* How far behind a follower is    */
+    SUBS_CODE byte = 0x0B       /* Table changes from a position   */
+    TOPO_CODE byte = 0x0C       /* Servers and whether they are up */
+    SIZE_CODE byte = 0x0D       /* Live records of a table         */
+    KEYS_CODE byte = 0x0E       /* Keys of a range of keys         */
     DROP_CODE byte = 0x0F
     MGET_CODE byte = 0x11
     MSET_CODE byte = 0x12
     MDEL_CODE byte = 0x13
-    QUIT_CODE byte = 0x21       /* Client quits */
-    WORK_CODE byte = 0x22       /* Server ready */
-    RALC_CODE byte = 0x23       /* Reallocate   */
-    DSTR_CODE byte = 0x24       /* Distribute   */
-    EXPL_CODE byte = 0x25       /* Expel        */
-    OK_CODE   byte = 0x30
-    ERR_CODE  byte = 0x3F
+    QUIT_CODE byte = 0x21       /* Client quits                    */
+    WORK_CODE byte = 0x22       /* Server ready                    */
+    RALC_CODE byte = 0x23       /* Reallocate all tables           */
+    DSTR_CODE byte = 0x24       /* Distribute a record, acked      */
+    EXPL_CODE byte = 0x25       /* Reallocate and expel one table  */
+    FWRD_CODE byte = 0x26       /* Coordinate a write for a server */
+    REPL_CODE byte = 0x27       /* Write a replica                 */
+    LGET_CODE byte = 0x28       /* Read the local copy             */
+    LDRP_CODE byte = 0x29       /* Drop the local table            */
+    TREE_CODE byte = 0x2A       /* Merkle leaves of shared records */
+    SYNC_CODE byte = 0x2B       /* Records of Merkle buckets       */
+    HINT_CODE byte = 0x2C       /* Hints pending per server        */
+    GOSP_CODE byte = 0x2D       /* Heartbeats known to the sender  */
+    RAFT_CODE byte = 0x2E       /* Message between Raft servers    */
+    LEAD_CODE byte = 0x2F       /* Request to a Raft leader        */
+    OK_CODE   byte = 0x30       /* Value follows                   */
+    LSCN_CODE byte = 0x31       /* Scan the local copy             */
+    RGET_CODE byte = 0x32       /* Ranges known to the server      */
+    RSET_CODE byte = 0x33       /* Owners of a range               */
+    SNAP_CODE byte = 0x34       /* Pin the files of every table    */
+    FILE_CODE byte = 0x35       /* Part of a pinned file           */
+    UNPN_CODE byte = 0x36       /* Release pinned files            */
+    DRAN_CODE byte = 0x37       /* Drain a server, or its progress */
+    HLTH_CODE byte = 0x38       /* Ranges short of copies          */
+    ERR_CODE  byte = 0x3F       /* Error message follows           */
+)
+
+/*
+    A request whose code has OPTS_FLAG set carries an options word between the
+    head and the table name:
+    | CONSISTENCY    : 8  bits               |  ========
+    | FLAGS          : 8  bits               |  64 bits
+    | RESERVED       : 48 bits               |  ========
+*/
+const OPTS_FLAG byte = 0x40
+
+type Consistency byte
+
+const (
+    DEFAULT_LEVEL Consistency = 0   /* Configured by the server */
+    ONE           Consistency = 1
+    QUORUM        Consistency = 2
+    ALL           Consistency = 3
+)
+
+func ParseConsistency(s string) (Consistency, error) {
+    switch strings.ToUpper(s) {
+        case "", "DEFAULT":
+            return DEFAULT_LEVEL, nil
+        case "ONE":
+            return ONE, nil
+        case "QUORUM":
+            return QUORUM, nil
+        case "ALL":
+            return ALL, nil
+    }
+    return DEFAULT_LEVEL, fmt.Errorf("%w: consistency %q", ErrInvalid, s)
+}
+
+func (level Consistency) String() string {
+    switch level {
+        case ONE:
+            return "ONE"
+        case QUORUM:
+            return "QUORUM"
+        case ALL:
+            return "ALL"
+    }
+    return "DEFAULT"
+}
+
+/* Copies that must answer among n. */
+func (level Consistency) Required(n int) int {
+    switch level {
+        case ONE:
+            return 1
+        case QUORUM:
+            return n / 2 + 1
+    }
+    return n
+}
+
+/* Flags of the options word */
+const (
+    VERSION_FLAG byte = 0x01    /* GET and SET reply with versions    */
 )
 
+/* Options of a request. The zero value is what a request without options
+   gets. */
+type RequestOptions struct {
+    Consistency Consistency
+    /* The value of a GET reply is preceded by its version, see Stamp. It is
+       0 if the key was never written. A SET replies with the version it
+       wrote, see Session. */
+    Version     bool
+}
+
+func (opts RequestOptions) Encode() uint64 {
+    var flags byte
+    if opts.Version {
+        flags |= VERSION_FLAG
+    }
+    return uint64(opts.Consistency) << 56 | uint64(flags) << 48
+}
+
+func DecodeOptions(x uint64) RequestOptions {
+    var flags = byte(x >> 48)
+    return RequestOptions {
+        Consistency : Consistency(x >> 56),
+        Version     : flags & VERSION_FLAG != 0,
+    }
+}
+
+/* Add options to an encoded request. */
+func WithOptions(request []byte, opts RequestOptions) []byte {
+    code, tlen, klen, vlen := DecodeHead(request[:8])
+    var result = make([]byte, len(request) + 8)
+    copy(result, EncodeHead(code | OPTS_FLAG, tlen, klen, vlen))
+    copy(result[8:], Uint64ToBytes(opts.Encode()))
+    copy(result[16:], request[8:])
+    return result
+}
+
 /* Check whether a command is 'MXXX'. */
 func MoreCmd(code byte) bool {
     return (code & byte(0x10) > 0)
@@ -97,11 +225,15 @@ func EncodeGet(table, key []byte) []byte {
 }
 
 func EncodeSet(table, key, value []byte) []byte {
+    return EncodeRequest(SET_CODE, table, key, value)
+}
+
+func EncodeRequest(code byte, table, key, value []byte) []byte {
     var tlen   = uint64(len(table))
     var klen   = uint64(len(key))
     var vlen   = uint64(len(value))
     var result = make([]byte, 8 + tlen + klen + vlen)
-    copy(result, EncodeHead(SET_CODE, tlen, klen, vlen))
+    copy(result, EncodeHead(code, tlen, klen, vlen))
     copy(result[8:], table)
     copy(result[8 + tlen :], key)
     copy(result[8 + tlen + klen :], value)
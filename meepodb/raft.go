@@ -0,0 +1,821 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    RAFT_DIR       string        = ".raft"
+    RAFT_HEARTBEAT time.Duration = 100 * time.Millisecond
+    /* Election timeouts are between this and twice this */
+    RAFT_ELECTION  time.Duration = time.Second
+    /* Shorter than RAFT_ELECTION, for followers that have heard from a
+       leader do not vote for another one before that */
+    RAFT_LEASE     time.Duration = 800 * time.Millisecond
+    /* Longest wait for a proposal to be applied */
+    RAFT_WAIT      time.Duration = 3 * time.Second
+    /* Entries or records sent in one message */
+    RAFT_BATCH     int           = 256
+    /* Applied entries kept in the log before it is compacted */
+    RAFT_LOG_MAX   int           = 4096
+)
+
+/* Messages of RAFT, given by the first byte of the value */
+const (
+    RAFT_VOTE     byte = 1
+    RAFT_APPEND   byte = 2
+    RAFT_SNAPSHOT byte = 3
+    RAFT_STATUS   byte = 4
+)
+
+/* Flags of RAFT_SNAPSHOT */
+const (
+    SNAPSHOT_FIRST byte = 1
+    SNAPSHOT_DONE  byte = 2
+)
+
+const (
+    FOLLOWER int = iota
+    CANDIDATE
+    LEADER
+)
+
+var roleNames = []string{ "follower", "candidate", "leader" }
+
+/*
+ *  A table listed in RAFT_TABLES is kept by a Raft group instead of being
+ *  replicated key by key: all of its keys live on the same servers, the
+ *  owners of the table, which elect a leader and replicate a log of writes.
+ *  Entries are applied to the table in log order once a majority has them,
+ *  so every write and read goes through the leader and is linearizable.
+ *
+ *  The leader serves reads from its table while it holds a lease, that is
+ *  while a majority has acknowledged one of its heartbeats within
+ *  RAFT_LEASE. Followers do not vote within RAFT_ELECTION of hearing from a
+ *  leader, so no other leader can be elected before the lease runs out.
+ *  Without a lease a read waits for a no-op entry to be committed.
+ *
+ *  A follower too far behind the compacted log is sent the table itself as
+ *  a snapshot, record by record, and then the entries after it. Versions of
+ *  entries go up along the log, so entries applied again over a snapshot
+ *  taken after them leave the table as it was.
+ *
+ *  The servers of a group are fixed by the ring; reallocation does not move
+ *  Raft tables.
+ */
+type RaftGroup struct {
+    table     []byte
+    self      string
+    members   []string
+    strg      *Storage
+    lock      sync.Mutex
+    log       *raftLog
+
+    term      uint64
+    votedFor  string
+    role      int
+    leader    string
+    commit    uint64
+    applied   uint64
+    heard     time.Time             /* From a leader, or voted            */
+    timeout   time.Duration
+    changed   chan struct{}         /* Closed whenever anything moves on  */
+
+    /* Leader only */
+    next      map[string]uint64
+    match     map[string]uint64
+    acked     map[string]time.Time  /* Sent time of the last heartbeat acked */
+    ready     uint64                /* Index of the no-op of the term     */
+    wake      map[string]chan struct{}
+    stop      chan struct{}
+}
+
+func RaftTable(table []byte) bool {
+    return RAFT_TABLES[string(table)]
+}
+
+func openRaftGroup(strg *Storage, self string, table []byte) (*RaftGroup, error) {
+    log, err := openRaftLog(strg.Dir() + "/" + RAFT_DIR + "/" + string(table))
+    if err != nil {
+        return nil, err
+    }
+    var g = &RaftGroup {
+        table   : table,
+        self    : self,
+        members : Owners(table, nil),
+        strg    : strg,
+        log     : log,
+        changed : make(chan struct{}),
+        heard   : time.Now(),
+    }
+    g.term, g.votedFor, err = log.loadState()
+    if err != nil {
+        log.Close()
+        return nil, err
+    }
+    g.commit, g.applied = log.base, log.base
+    g.timeout = electionTimeout()
+    go g.run()
+    return g, nil
+}
+
+func electionTimeout() time.Duration {
+    return RAFT_ELECTION + time.Duration(rand.Int63n(int64(RAFT_ELECTION)))
+}
+
+func (g *RaftGroup) majority() int {
+    return len(g.members) / 2 + 1
+}
+
+/* Wake whoever waits for the group to move on. Called with the lock held. */
+func (g *RaftGroup) notify() {
+    close(g.changed)
+    g.changed = make(chan struct{})
+}
+
+func (g *RaftGroup) run() {
+    for {
+        time.Sleep(RAFT_HEARTBEAT / 2)
+        g.lock.Lock()
+        if g.role != LEADER && time.Since(g.heard) > g.timeout {
+            g.campaign()
+        }
+        g.lock.Unlock()
+    }
+}
+
+func (g *RaftGroup) setTerm(term uint64, votedFor string) error {
+    g.term, g.votedFor = term, votedFor
+    return g.log.saveState(term, votedFor)
+}
+
+/* Called with the lock held. */
+func (g *RaftGroup) campaign() {
+    err := g.setTerm(g.term + 1, g.self)
+    if err != nil {
+        println("cannot campaign for", string(g.table), "\b:", err.Error())
+        return
+    }
+    g.role = CANDIDATE
+    g.leader = ""
+    g.heard = time.Now()
+    g.timeout = electionTimeout()
+    var term = g.term
+    var request = raftRequest(g.table, g.self, RAFT_VOTE, term,
+                              g.log.last(), g.log.term(g.log.last()))
+    var votes = make(chan bool, len(g.members))
+    for _, member := range g.members {
+        if member == g.self {
+            continue
+        }
+        go func(member string) {
+            value, err := callOnce(member, request)
+            if err != nil || len(value) < 9 {
+                votes <- false
+                return
+            }
+            g.lock.Lock()
+            g.observe(BytesToUint64(value), "")
+            g.lock.Unlock()
+            votes <- value[8] == 1
+        }(member)
+    }
+    go func() {
+        var granted = 1
+        for i := 1; i < len(g.members) && granted < g.majority(); i++ {
+            if <-votes {
+                granted++
+            }
+        }
+        g.lock.Lock()
+        defer g.lock.Unlock()
+        if granted >= g.majority() && g.role == CANDIDATE && g.term == term {
+            g.lead()
+        }
+    }()
+}
+
+/* Step down on a message of a newer term. Called with the lock held. */
+func (g *RaftGroup) observe(term uint64, leader string) {
+    if term > g.term {
+        err := g.setTerm(term, "")
+        if err != nil {
+            println("cannot save term of", string(g.table), "\b:", err.Error())
+        }
+        g.follow(leader)
+    }
+}
+
+func (g *RaftGroup) follow(leader string) {
+    if g.role == LEADER {
+        close(g.stop)
+    }
+    if g.role != FOLLOWER || g.leader != leader {
+        g.notify()
+    }
+    g.role = FOLLOWER
+    g.leader = leader
+}
+
+/* Called with the lock held. */
+func (g *RaftGroup) lead() {
+    println("leader of", string(g.table), "in term", g.term)
+    g.role = LEADER
+    g.leader = g.self
+    g.next = make(map[string]uint64)
+    g.match = make(map[string]uint64)
+    g.acked = make(map[string]time.Time)
+    g.wake = make(map[string]chan struct{})
+    g.stop = make(chan struct{})
+    var noop = raftEntry{ term: g.term, kind: ENTRY_NOOP, version: CLOCK.Now() }
+    err := g.log.append([]raftEntry{ noop })
+    if err != nil {
+        println("cannot append to log of", string(g.table), "\b:", err.Error())
+    }
+    g.ready = g.log.last()
+    for _, member := range g.members {
+        if member == g.self {
+            continue
+        }
+        g.next[member] = g.log.last()
+        g.wake[member] = make(chan struct{}, 1)
+        go g.replicate(member, g.term, g.wake[member], g.stop)
+    }
+    g.advance()
+    g.notify()
+}
+
+/* Send a follower what it lacks of the log, and heartbeats when it lacks
+   nothing. */
+func (g *RaftGroup) replicate(peer string, term uint64, wake, stop chan struct{}) {
+    var pool = NewPool()
+    defer pool.Close()
+    for {
+        g.lock.Lock()
+        if g.role != LEADER || g.term != term {
+            g.lock.Unlock()
+            return
+        }
+        var next = g.next[peer]
+        if next <= g.log.base {
+            g.lock.Unlock()
+            err := g.sendSnapshot(pool, peer, term)
+            if err != nil {
+                /* A follower that is down is retried quietly, like appends */
+                var remote *RemoteError
+                if errors.As(err, &remote) {
+                    println("cannot send snapshot of", string(g.table), "to", peer,
+                            "\b:", err.Error())
+                }
+                time.Sleep(RAFT_HEARTBEAT)
+            }
+            continue
+        }
+        var entries = g.log.slice(next, RAFT_BATCH)
+        var request = raftRequest(g.table, g.self, RAFT_APPEND, term, next - 1,
+                                  g.log.term(next - 1), g.commit)
+        for i := range entries {
+            request = encodeEntry(request, &entries[i])
+        }
+        var behind = next + uint64(len(entries)) <= g.log.last()
+        g.lock.Unlock()
+
+        var sent = time.Now()
+        value, err := pool.Call(peer, fixLength(request))
+        if err == nil && len(value) >= 17 {
+            g.lock.Lock()
+            g.observe(BytesToUint64(value), "")
+            if g.role == LEADER && g.term == term {
+                if value[8] == 1 {
+                    var match = next - 1 + uint64(len(entries))
+                    g.match[peer] = max(g.match[peer], match)
+                    g.next[peer] = g.match[peer] + 1
+                    g.acked[peer] = sent
+                    g.advance()
+                } else {
+                    /* The follower tells how far its log goes */
+                    g.next[peer] = max(1, min(next - 1, BytesToUint64(value[9:]) + 1))
+                    behind = true
+                }
+            }
+            g.lock.Unlock()
+        }
+        if err == nil && behind {
+            continue
+        }
+        select {
+            case <-stop:
+                return
+            case <-wake:
+            case <-time.After(RAFT_HEARTBEAT):
+        }
+    }
+}
+
+/* Stream the table to a follower. The snapshot is taken as of the applied
+   index, though entries applied during the scan may show in it too. */
+func (g *RaftGroup) sendSnapshot(pool *Pool, peer string, term uint64) error {
+    g.lock.Lock()
+    var index, indexTerm = g.applied, g.log.term(g.applied)
+    g.lock.Unlock()
+    cola, err := g.strg.ExistentCOLA(g.table)
+    if err != nil && !errors.Is(err, ErrNotFound) {
+        return err
+    }
+    var start []byte
+    var flags = SNAPSHOT_FIRST
+    for {
+        var records []byte
+        var n int
+        if cola != nil {
+            err = cola.ScanRecords(start, nil, func(k, v []byte, version uint64) bool {
+                records = appendRecord(records, k, Stamp(version, v))
+                start = append(clone(k), 0)
+                n++
+                return n < RAFT_BATCH
+            })
+            if err != nil {
+                return err
+            }
+        }
+        if n < RAFT_BATCH {
+            flags |= SNAPSHOT_DONE
+        }
+        var request = raftRequest(g.table, g.self, RAFT_SNAPSHOT, term, index, indexTerm)
+        request = append(request, flags)
+        value, err := pool.Call(peer, fixLength(append(request, records...)))
+        if err != nil {
+            return err
+        }
+        if len(value) < 8 {
+            return &RemoteError{ Addr: peer, Msg: "bad snapshot reply" }
+        }
+        g.lock.Lock()
+        g.observe(BytesToUint64(value), "")
+        if g.role != LEADER || g.term != term {
+            g.lock.Unlock()
+            return nil
+        }
+        if flags & SNAPSHOT_DONE != 0 {
+            g.match[peer] = max(g.match[peer], index)
+            g.next[peer] = index + 1
+            g.lock.Unlock()
+            println("sent snapshot of", string(g.table), "at", index, "to", peer)
+            return nil
+        }
+        g.lock.Unlock()
+        flags = 0
+    }
+}
+
+/* Commit what a majority has and apply it. Called with the lock held. */
+func (g *RaftGroup) advance() {
+    var matches = []uint64{ g.log.last() }
+    for _, member := range g.members {
+        if member != g.self {
+            matches = append(matches, g.match[member])
+        }
+    }
+    sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+    var index = matches[g.majority() - 1]
+    /* Entries of older terms are committed only along with one of this term */
+    if index > g.commit && g.log.term(index) == g.term {
+        g.commit = index
+        g.apply()
+    }
+}
+
+/* Called with the lock held. */
+func (g *RaftGroup) apply() {
+    if g.applied >= g.commit {
+        return
+    }
+    for g.applied < g.commit {
+        var e = g.log.entry(g.applied + 1)
+        var err error
+        switch e.kind {
+            case ENTRY_SET:
+                _, err = g.strg.Put(g.table, e.key, e.value, e.version)
+            case ENTRY_DROP:
+                err = g.strg.Drop(g.table)
+        }
+        if err != nil {
+            /* The entry stays in the log, so it is applied again on restart */
+            println("cannot apply entry", g.applied + 1, "of", string(g.table),
+                    "\b:", err.Error())
+        }
+        g.applied++
+    }
+    if g.applied - g.log.base > uint64(RAFT_LOG_MAX) {
+        err := g.log.compact(g.applied)
+        if err != nil {
+            println("cannot compact log of", string(g.table), "\b:", err.Error())
+        }
+    }
+    g.notify()
+}
+
+/* The leader's lease runs from the latest heartbeat a majority, itself
+   included, has acknowledged. Called with the lock held. */
+func (g *RaftGroup) leased() bool {
+    var now = time.Now()
+    var acked = []time.Time{ now }
+    for _, member := range g.members {
+        if member != g.self {
+            acked = append(acked, g.acked[member])
+        }
+    }
+    sort.Slice(acked, func(i, j int) bool { return acked[i].After(acked[j]) })
+    return now.Sub(acked[g.majority() - 1]) < RAFT_LEASE
+}
+
+func (g *RaftGroup) notLeader() error {
+    if g.leader == "" || g.leader == g.self {
+        return ErrNotLeader
+    }
+    return fmt.Errorf("%w, try %s", ErrNotLeader, g.leader)
+}
+
+/* Append an entry and wait until it is applied. */
+func (g *RaftGroup) Propose(kind byte, key, value []byte) error {
+    g.lock.Lock()
+    defer g.lock.Unlock()
+    if g.role != LEADER {
+        return g.notLeader()
+    }
+    var e = raftEntry{ term: g.term, kind: kind, version: CLOCK.Now(), key: key, value: value }
+    err := g.log.append([]raftEntry{ e })
+    if err != nil {
+        return err
+    }
+    var index = g.log.last()
+    for _, wake := range g.wake {
+        select {
+            case wake <- struct{}{}:
+            default:
+        }
+    }
+    g.advance()
+    return g.wait(index, e.term)
+}
+
+/* Wait until the entry of term at index is applied. Called with the lock
+   held. */
+func (g *RaftGroup) wait(index, term uint64) error {
+    var deadline = time.After(RAFT_WAIT)
+    for g.applied < index {
+        if g.term != term || g.role != LEADER {
+            return g.notLeader()
+        }
+        var changed = g.changed
+        g.lock.Unlock()
+        select {
+            case <-changed:
+                g.lock.Lock()
+            case <-deadline:
+                g.lock.Lock()
+                return fmt.Errorf("%w: entry %d of %s is not committed",
+                                  ErrUnavailable, index, string(g.table))
+        }
+    }
+    /* Another leader may have replaced it before it was committed */
+    if index > g.log.base && g.log.term(index) != term {
+        return g.notLeader()
+    }
+    return nil
+}
+
+/* Wait until a read at the leader sees every write committed before. */
+func (g *RaftGroup) ReadBarrier() error {
+    g.lock.Lock()
+    if g.role != LEADER {
+        defer g.lock.Unlock()
+        return g.notLeader()
+    }
+    if g.leased() && g.commit >= g.ready {
+        g.lock.Unlock()
+        return nil
+    }
+    g.lock.Unlock()
+    return g.Propose(ENTRY_NOOP, nil, nil)
+}
+
+/* Handle a RAFT message and return the reply. */
+func (g *RaftGroup) Step(from string, message []byte) ([]byte, error) {
+    g.lock.Lock()
+    defer g.lock.Unlock()
+    if message[0] == RAFT_STATUS {
+        return g.status(), nil
+    }
+    if len(message) < 9 {
+        return nil, ErrInvalid
+    }
+    var term = BytesToUint64(message[1:])
+    var body = message[9:]
+    switch message[0] {
+        case RAFT_VOTE:
+            if len(body) < 16 {
+                return nil, ErrInvalid
+            }
+            var granted = g.vote(from, term, BytesToUint64(body), BytesToUint64(body[8:]))
+            return append(Uint64ToBytes(g.term), boolByte(granted)), nil
+        case RAFT_APPEND:
+            if len(body) < 24 {
+                return nil, ErrInvalid
+            }
+            entries, err := decodeEntries(body[24:])
+            if err != nil {
+                return nil, err
+            }
+            ok, err := g.appendEntries(from, term, BytesToUint64(body),
+                                       BytesToUint64(body[8:]), BytesToUint64(body[16:]),
+                                       entries)
+            var result = append(Uint64ToBytes(g.term), boolByte(ok))
+            return append(result, Uint64ToBytes(g.log.last())...), err
+        case RAFT_SNAPSHOT:
+            if len(body) < 17 {
+                return nil, ErrInvalid
+            }
+            err := g.installSnapshot(from, term, BytesToUint64(body),
+                                     BytesToUint64(body[8:]), body[16], body[17:])
+            return Uint64ToBytes(g.term), err
+    }
+    return nil, ErrInvalid
+}
+
+func boolByte(b bool) byte {
+    if b {
+        return 1
+    }
+    return 0
+}
+
+func (g *RaftGroup) vote(candidate string, term, lastIndex, lastTerm uint64) bool {
+    /* A leader heard of lately may still hold its lease */
+    if g.role == LEADER && g.leased() {
+        return false
+    }
+    if g.role == FOLLOWER && g.leader != "" && g.leader != candidate &&
+       time.Since(g.heard) < RAFT_ELECTION {
+        return false
+    }
+    g.observe(term, "")
+    if term < g.term || (g.votedFor != "" && g.votedFor != candidate) {
+        return false
+    }
+    var myLast = g.log.last()
+    var myTerm = g.log.term(myLast)
+    if lastTerm < myTerm || (lastTerm == myTerm && lastIndex < myLast) {
+        return false
+    }
+    err := g.setTerm(term, candidate)
+    if err != nil {
+        println("cannot save vote of", string(g.table), "\b:", err.Error())
+        return false
+    }
+    g.heard = time.Now()
+    return true
+}
+
+/* Accept a message of the leader of term. Called with the lock held. */
+func (g *RaftGroup) accept(leader string, term uint64) bool {
+    g.observe(term, leader)
+    if term < g.term {
+        return false
+    }
+    g.follow(leader)
+    g.heard = time.Now()
+    return true
+}
+
+func (g *RaftGroup) appendEntries(leader string, term, prevIndex, prevTerm, commit uint64,
+                                  entries []raftEntry) (bool, error) {
+    if !g.accept(leader, term) {
+        return false, nil
+    }
+    if prevIndex > g.log.last() {
+        return false, nil
+    }
+    /* Entries up to base are committed, so they match the leader's */
+    for prevIndex < g.log.base && len(entries) > 0 {
+        prevIndex++
+        prevTerm = entries[0].term
+        entries = entries[1:]
+    }
+    if prevIndex > g.log.base && g.log.term(prevIndex) != prevTerm {
+        return false, g.log.truncate(prevIndex)
+    }
+    var index = prevIndex
+    for len(entries) > 0 && index < g.log.last() {
+        if g.log.term(index + 1) != entries[0].term {
+            err := g.log.truncate(index + 1)
+            if err != nil {
+                return false, err
+            }
+            break
+        }
+        index++
+        entries = entries[1:]
+    }
+    if len(entries) > 0 {
+        err := g.log.append(entries)
+        if err != nil {
+            return false, err
+        }
+        index += uint64(len(entries))
+    }
+    if commit > g.commit {
+        g.commit = max(g.commit, min(commit, index))
+        g.apply()
+    }
+    return true, nil
+}
+
+func (g *RaftGroup) installSnapshot(leader string, term, index, indexTerm uint64,
+                                    flags byte, records []byte) error {
+    if !g.accept(leader, term) {
+        return nil
+    }
+    if flags & SNAPSHOT_FIRST != 0 {
+        err := g.strg.Drop(g.table)
+        if err != nil {
+            return err
+        }
+    }
+    var failed error
+    err := DecodeRecords(records, func(k, record []byte) {
+        version, v := Unstamp(record)
+        if _, err := g.strg.Put(g.table, k, v, version); err != nil {
+            failed = err
+        }
+    })
+    if err != nil {
+        return err
+    }
+    if failed != nil {
+        return failed
+    }
+    if flags & SNAPSHOT_DONE == 0 {
+        return nil
+    }
+    err = g.log.reset(index, indexTerm)
+    if err != nil {
+        return err
+    }
+    g.commit = max(g.commit, index)
+    g.applied = max(g.applied, index)
+    println("installed snapshot of", string(g.table), "at", index)
+    g.notify()
+    return nil
+}
+
+/* "role term leader last commit applied" */
+func (g *RaftGroup) status() []byte {
+    var leader = g.leader
+    if leader == "" {
+        leader = "-"
+    }
+    return []byte(roleNames[g.role] + " " + strconv.FormatUint(g.term, 10) + " " +
+                  leader + " " + strconv.FormatUint(g.log.last(), 10) + " " +
+                  strconv.FormatUint(g.commit, 10) + " " +
+                  strconv.FormatUint(g.applied, 10) + "\n")
+}
+
+/* | type 1 byte | term 8 bytes | fields 8 bytes each |, from self. */
+func raftRequest(table []byte, self string, kind byte, term uint64, fields ...uint64) []byte {
+    var value = append([]byte{ kind }, Uint64ToBytes(term)...)
+    for _, x := range fields {
+        value = append(value, Uint64ToBytes(x)...)
+    }
+    return EncodeRequest(RAFT_CODE, table, []byte(self), value)
+}
+
+/* Set vlen of a request whose value has been appended to. */
+func fixLength(request []byte) []byte {
+    code, tlen, klen, _ := DecodeHead(request[:8])
+    copy(request, EncodeHead(code, tlen, klen, uint64(len(request)) - 8 - tlen - klen))
+    return request
+}
+
+func callOnce(addr string, request []byte) ([]byte, error) {
+    peer, err := DialPeer(addr)
+    if err != nil {
+        return nil, err
+    }
+    defer peer.Close()
+    return peer.Call(request)
+}
+
+/* The group of a Raft table on this server, opened on first use. */
+func (srv *Server) raftGroup(table []byte) (*RaftGroup, error) {
+    if !RaftTable(table) || !contains(Owners(table, nil), srv.Addr) {
+        return nil, fmt.Errorf("%w: %s keeps no Raft group of %s", ErrNotLeader,
+                               srv.Addr, string(table))
+    }
+    srv.glock.Lock()
+    defer srv.glock.Unlock()
+    if g, ok := srv.groups[string(table)]; ok {
+        return g, nil
+    }
+    g, err := openRaftGroup(srv.strg, srv.Addr, clone(table))
+    if err != nil {
+        return nil, err
+    }
+    srv.groups[string(table)] = g
+    return g, nil
+}
+
+/* Serve a request for a Raft table as its leader. */
+func (srv *Server) lead(op byte, table, key, value []byte) ([]byte, error) {
+    g, err := srv.raftGroup(table)
+    if err != nil {
+        return nil, err
+    }
+    switch op {
+        case GET_CODE:
+            err = g.ReadBarrier()
+            if err != nil {
+                return nil, err
+            }
+            return srv.localRecord(table, key)
+        case SET_CODE:
+            return nil, g.Propose(ENTRY_SET, key, value)
+        case DROP_CODE:
+            return nil, g.Propose(ENTRY_DROP, nil, nil)
+    }
+    return nil, ErrInvalid
+}
+
+/* Send a request for a Raft table to its leader, found by asking the servers
+   of the group, who point to the leader they know of. */
+func (srv *Server) raftCall(pool *Pool, op byte, table, key, value []byte) ([]byte, error) {
+    var members = Owners(table, nil)
+    var target = members[0]
+    if leader, ok := srv.leaders.Load(string(table)); ok {
+        target = leader.(string)
+    }
+    var request = EncodeRequest(LEAD_CODE, table, key, append([]byte{ op }, value...))
+    var next int
+    for tries := 0; tries < 4 * len(members); tries++ {
+        var result []byte
+        var err error
+        if target == srv.Addr {
+            result, err = srv.lead(op, table, key, value)
+        } else {
+            result, err = pool.Call(target, request)
+        }
+        if err == nil {
+            srv.leaders.Store(string(table), target)
+            return result, nil
+        }
+        var remote *RemoteError
+        var msg = err.Error()
+        if errors.As(err, &remote) {
+            msg = remote.Msg
+        }
+        if errors.As(err, &remote) && !strings.HasPrefix(msg, ErrNotLeader.Error()) {
+            return nil, err
+        }
+        if _, leader, ok := strings.Cut(msg, ErrNotLeader.Error() + ", try "); ok {
+            target = leader
+            continue
+        }
+        /* Down, or no leader yet; an election takes a few heartbeats */
+        target = members[next % len(members)]
+        next++
+        if next % len(members) == 0 {
+            time.Sleep(RAFT_ELECTION / 2)
+        }
+    }
+    return nil, fmt.Errorf("%w: no leader of %s answers", ErrUnavailable, string(table))
+}
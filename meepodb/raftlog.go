@@ -0,0 +1,243 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "fmt"
+    "os"
+    . "syscall"
+)
+
+/* Kinds of log entries */
+const (
+    ENTRY_NOOP byte = 0         /* Written by a new leader to commit its term */
+    ENTRY_SET  byte = 1
+    ENTRY_DROP byte = 2
+)
+
+type raftEntry struct {
+    term     uint64
+    kind     byte
+    version  uint64
+    key      []byte
+    value    []byte
+}
+
+/* Entry format:
+   |  term   | version |  kind  |  klen   |  vlen   |   key   |  value  |
+   |---------|---------|--------|---------|---------|---------|---------|
+   | 8 bytes | 8 bytes | 1 byte | 4 bytes | 4 bytes | N bytes | M bytes |
+*/
+func encodeEntry(buffer []byte, e *raftEntry) []byte {
+    buffer = append(buffer, Uint64ToBytes(e.term)...)
+    buffer = append(buffer, Uint64ToBytes(e.version)...)
+    buffer = append(buffer, e.kind)
+    buffer = append(buffer, Uint64ToBytes(uint64(len(e.key)) << 32 |
+                                          uint64(len(e.value)))...)
+    buffer = append(buffer, e.key...)
+    return append(buffer, e.value...)
+}
+
+/* Entries up to the first one cut short, if any. */
+func decodeEntries(data []byte) ([]raftEntry, error) {
+    var entries []raftEntry
+    for len(data) > 0 {
+        if len(data) < 25 {
+            return entries, ErrCorrupt
+        }
+        var x = BytesToUint64(data[17:])
+        var klen, vlen = x >> 32, x & 0xFFFFFFFF
+        if uint64(len(data)) < 25 + klen + vlen {
+            return entries, ErrCorrupt
+        }
+        entries = append(entries, raftEntry {
+            term    : BytesToUint64(data),
+            version : BytesToUint64(data[8:]),
+            kind    : data[16],
+            key     : clone(data[25 : 25 + klen]),
+            value   : clone(data[25 + klen : 25 + klen + vlen]),
+        })
+        data = data[25 + klen + vlen:]
+    }
+    return entries, nil
+}
+
+/*
+ *  The log of a group lives in DB_DIR/.raft/<table>, as two files:
+ *
+ *      state   | term 8 bytes | voted for |
+ *      log     | base 8 bytes | base term 8 bytes | entries after base |
+ *
+ *  Entries up to base have been applied to the table and compacted away, so
+ *  the table itself is the snapshot they leave. New entries are appended to
+ *  log and synced before they are acknowledged; anything else rewrites the
+ *  whole file. A torn entry at the end of log is dropped when it is read.
+ */
+type raftLog struct {
+    dir       string
+    fd        int
+    base      uint64
+    baseTerm  uint64
+    entries   []raftEntry
+}
+
+func openRaftLog(dir string) (*raftLog, error) {
+    err := os.MkdirAll(dir, os.FileMode(S_IRWXA))
+    if err != nil {
+        return nil, err
+    }
+    var log = &raftLog{ dir: dir, fd: -1 }
+    data, err := os.ReadFile(dir + "/log")
+    if err == nil && len(data) >= 16 {
+        log.base = BytesToUint64(data)
+        log.baseTerm = BytesToUint64(data[8:])
+        log.entries, err = decodeEntries(data[16:])
+        if err != nil {
+            println("dropped torn entries of", dir + "/log")
+            err = log.rewrite()
+        }
+    } else if err == nil || os.IsNotExist(err) {
+        err = log.rewrite()
+    }
+    if err != nil {
+        return nil, err
+    }
+    return log, log.reopen()
+}
+
+func (log *raftLog) reopen() error {
+    if log.fd >= 0 {
+        Close(log.fd)
+    }
+    var path = log.dir + "/log"
+    fd, err := Open(path, O_WRONLY | O_APPEND, S_IRALL | S_IWALL)
+    if err != nil {
+        return pathError("open", path, err)
+    }
+    log.fd = fd
+    return nil
+}
+
+func (log *raftLog) last() uint64 {
+    return log.base + uint64(len(log.entries))
+}
+
+/* Term of the entry at index, 0 if it is compacted away or not there. */
+func (log *raftLog) term(index uint64) uint64 {
+    if index == log.base {
+        return log.baseTerm
+    }
+    if index < log.base || index > log.last() {
+        return 0
+    }
+    return log.entries[index - log.base - 1].term
+}
+
+func (log *raftLog) entry(index uint64) *raftEntry {
+    return &log.entries[index - log.base - 1]
+}
+
+/* Entries from index on, at most n of them. */
+func (log *raftLog) slice(index uint64, n int) []raftEntry {
+    var entries = log.entries[index - log.base - 1:]
+    return entries[:min(len(entries), n)]
+}
+
+func (log *raftLog) append(entries []raftEntry) error {
+    var buffer []byte
+    for i := range entries {
+        buffer = encodeEntry(buffer, &entries[i])
+        CLOCK.Update(entries[i].version)
+    }
+    var path = log.dir + "/log"
+    err := writeAll(log.fd, buffer)
+    if err == nil {
+        err = Fsync(log.fd)
+    }
+    if err != nil {
+        return pathError("write", path, err)
+    }
+    log.entries = append(log.entries, entries...)
+    return nil
+}
+
+/* Drop the entries from index on. */
+func (log *raftLog) truncate(index uint64) error {
+    log.entries = log.entries[:index - log.base - 1]
+    return log.rewrite()
+}
+
+/* Drop the entries up to index, which has been applied. */
+func (log *raftLog) compact(index uint64) error {
+    log.baseTerm = log.term(index)
+    log.entries = append([]raftEntry(nil), log.entries[index - log.base:]...)
+    log.base = index
+    return log.rewrite()
+}
+
+/* Start over from a snapshot ending at index. */
+func (log *raftLog) reset(index, term uint64) error {
+    if log.term(index) == term && index > log.base {
+        return log.compact(index)
+    }
+    log.base, log.baseTerm, log.entries = index, term, nil
+    return log.rewrite()
+}
+
+func (log *raftLog) rewrite() error {
+    var buffer = append(Uint64ToBytes(log.base), Uint64ToBytes(log.baseTerm)...)
+    for i := range log.entries {
+        buffer = encodeEntry(buffer, &log.entries[i])
+    }
+    err := replaceFile(log.dir + "/log", buffer)
+    if err != nil {
+        return err
+    }
+    if log.fd >= 0 {
+        return log.reopen()
+    }
+    return nil
+}
+
+func (log *raftLog) saveState(term uint64, votedFor string) error {
+    return replaceFile(log.dir + "/state", append(Uint64ToBytes(term), votedFor...))
+}
+
+func (log *raftLog) loadState() (uint64, string, error) {
+    data, err := os.ReadFile(log.dir + "/state")
+    if os.IsNotExist(err) {
+        return 0, "", nil
+    }
+    if err != nil {
+        return 0, "", err
+    }
+    if len(data) < 8 {
+        return 0, "", fmt.Errorf("%w: %s/state", ErrCorrupt, log.dir)
+    }
+    return BytesToUint64(data), string(data[8:]), nil
+}
+
+func (log *raftLog) Close() error {
+    return Close(log.fd)
+}
@@ -0,0 +1,546 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "math/rand"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+/* Table of range boundaries, hidden from Tables as its name starts with '.' */
+const RANGES_FILE string = ".ranges"
+
+/* Time between checks for ranges to split and between pulls of the ranges
+   other servers know of */
+const RANGE_INTERVAL time.Duration = 10 * time.Second
+
+/* Intervals after a change of its ranges during which a server keeps
+   handing over the records of a table it no longer owns */
+const RANGE_SETTLE int = 3
+
+const RANGE_SETTLE_TIME time.Duration = time.Duration(RANGE_SETTLE) * RANGE_INTERVAL
+
+/*
+ *  A table in RANGE_TABLES is cut into key ranges, each kept by its own list
+ *  of servers, so that an ordered scan asks only the servers of the ranges it
+ *  covers. A range is recorded by its first key and its owners and ends where
+ *  the next one starts. Keys before the first recorded range belong to the
+ *  owners of the whole table on the ring, so a table starts as one range.
+ *
+ *  The primary owner of a range splits it in the middle once it holds more
+ *  than RANGE_SPLIT records. The upper half goes to the servers following
+ *  its first key on the ring, and a range may also be given to other servers
+ *  with RSET. Every server keeps every record of the boundaries, by version,
+ *  and pulls the ones it missed from another server with RGET now and then.
+ *  Servers that held records of a range before it changed hands send them to
+ *  the new owners and delete them, like a reallocation does, and are read
+ *  from as well until then.
+ */
+type Ranges struct {
+    cola     *COLA
+    lock     sync.RWMutex
+    tables   map[string][]rangeRecord    /* Sorted by start */
+    changed  map[string]time.Time
+}
+
+type rangeRecord struct {
+    start    []byte
+    owners   []string
+    version  uint64
+    previous []string     /* Owners before it changed, not kept on disk */
+    moved    time.Time
+}
+
+/* A range of keys from Start up to End, with no End for the last one. */
+type KeyRange struct {
+    Start    []byte
+    End      []byte
+    Owners   []string
+}
+
+/* The ranges of this server, nil on clients */
+var RANGES *Ranges
+
+func RangeTable(table []byte) bool {
+    return RANGE_TABLES[string(table)]
+}
+
+func OpenRanges(strg *Storage) (*Ranges, error) {
+    var path = strg.Dir() + "/" + RANGES_FILE
+    var r = &Ranges {
+        tables  : make(map[string][]rangeRecord),
+        changed : make(map[string]time.Time),
+    }
+    var err error
+    _, err = os.Stat(path)
+    if err == nil {
+        r.cola, err = OpenCOLA(path, strg.opts)
+    } else if os.IsNotExist(err) {
+        r.cola, err = NewCOLA(path, strg.opts)
+    }
+    if err != nil {
+        return nil, err
+    }
+    err = r.cola.ScanVersions(nil, nil, func(k, v []byte, version uint64) bool {
+        table, start := splitRangeKey(k)
+        r.insert(table, rangeRecord{ start: clone(start), owners: strings.Split(string(v), ","),
+                                     version: version })
+        return true
+    })
+    if err != nil {
+        r.cola.Close()
+        return nil, err
+    }
+    return r, nil
+}
+
+/* | table | 0 | start | */
+func rangeKey(table string, start []byte) []byte {
+    return append(append([]byte(table), 0), start...)
+}
+
+func splitRangeKey(key []byte) (string, []byte) {
+    i := bytes.IndexByte(key, 0)
+    if i < 0 {
+        return string(key), nil
+    }
+    return string(key[:i]), key[i + 1:]
+}
+
+/* Called with the lock held, or before r is shared. */
+func (r *Ranges) insert(table string, record rangeRecord) bool {
+    var records = r.tables[table]
+    i := sort.Search(len(records), func(i int) bool {
+        return bytes.Compare(records[i].start, record.start) >= 0
+    })
+    if i < len(records) && bytes.Equal(records[i].start, record.start) {
+        if records[i].version >= record.version {
+            return false
+        }
+        records[i] = record
+    } else {
+        records = append(records, rangeRecord{})
+        copy(records[i + 1:], records[i:])
+        records[i] = record
+    }
+    r.tables[table] = records
+    return true
+}
+
+/* Record the owners of the range starting at start, unless a newer record of
+   it is known already. The result tells whether it was taken. */
+func (r *Ranges) Put(table string, start []byte, owners []string, version uint64) (bool, error) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    var record = rangeRecord{ start: clone(start), owners: owners, version: version,
+                              moved: time.Now() }
+    /* Whoever held start until now, and before that if it was lately */
+    if held := r.holding(table, start); held == nil {
+        record.previous = initialOwners([]byte(table))
+    } else {
+        record.previous = held.owners
+        if time.Since(held.moved) < RANGE_SETTLE_TIME {
+            record.previous = union(record.previous, held.previous)
+        }
+    }
+    if !r.insert(table, record) {
+        return false, nil
+    }
+    r.changed[table] = record.moved
+    _, err := r.cola.Put(rangeKey(table, start), []byte(strings.Join(owners, ",")), version)
+    return true, err
+}
+
+/* The record of the range holding key, nil if none holds it. Called with the
+   lock held. */
+func (r *Ranges) holding(table string, key []byte) *rangeRecord {
+    var records = r.tables[table]
+    i := sort.Search(len(records), func(i int) bool {
+        return bytes.Compare(records[i].start, key) > 0
+    })
+    if i == 0 {
+        return nil
+    }
+    return &records[i - 1]
+}
+
+/* Owners of the range holding key, nil if no recorded range holds it. */
+func (r *Ranges) Owners(table, key []byte) []string {
+    r.lock.RLock()
+    defer r.lock.RUnlock()
+    if record := r.holding(string(table), key); record != nil {
+        return record.owners
+    }
+    return nil
+}
+
+/* Servers the range holding key has lately moved away from, which may not
+   have handed its records over yet. */
+func (r *Ranges) Previous(table, key []byte) []string {
+    r.lock.RLock()
+    defer r.lock.RUnlock()
+    var record = r.holding(string(table), key)
+    if record == nil || time.Since(record.moved) >= RANGE_SETTLE_TIME {
+        return nil
+    }
+    var result []string
+    for _, server := range record.previous {
+        if !contains(record.owners, server) {
+            result = append(result, server)
+        }
+    }
+    return result
+}
+
+func union(a, b []string) []string {
+    var result = append([]string(nil), a...)
+    for _, s := range b {
+        if !contains(result, s) {
+            result = append(result, s)
+        }
+    }
+    return result
+}
+
+/* All ranges of a table, in key order. */
+func (r *Ranges) Table(table []byte) []KeyRange {
+    r.lock.RLock()
+    var records = append([]rangeRecord(nil), r.tables[string(table)]...)
+    r.lock.RUnlock()
+    var ranges []KeyRange
+    if len(records) == 0 || len(records[0].start) != 0 {
+        ranges = append(ranges, KeyRange{ Start: []byte{}, Owners: initialOwners(table) })
+    }
+    for _, record := range records {
+        if len(ranges) > 0 {
+            ranges[len(ranges) - 1].End = record.start
+        }
+        ranges = append(ranges, KeyRange{ Start: record.start, Owners: record.owners })
+    }
+    return ranges
+}
+
+/* Ranges overlapping [start, end), end being nil for no end. */
+func (r *Ranges) Overlapping(table, start, end []byte) []KeyRange {
+    var result []KeyRange
+    for _, kr := range r.Table(table) {
+        if kr.End != nil && bytes.Compare(kr.End, start) <= 0 {
+            continue
+        }
+        if end != nil && bytes.Compare(kr.Start, end) >= 0 {
+            break
+        }
+        result = append(result, kr)
+    }
+    return result
+}
+
+/* Lines of "start end owners" for a table, with keys quoted and "-" for the
+   end of the last range. */
+func (r *Ranges) Report(table []byte) []byte {
+    var result []byte
+    for _, kr := range r.Table(table) {
+        var end = "-"
+        if kr.End != nil {
+            end = fmt.Sprintf("%q", kr.End)
+        }
+        result = fmt.Appendf(result, "%q %s %s\n", kr.Start, end, strings.Join(kr.Owners, ","))
+    }
+    return result
+}
+
+/* Whether the ranges of a table have changed lately. */
+func (r *Ranges) unsettled(table string) bool {
+    r.lock.RLock()
+    defer r.lock.RUnlock()
+    changed, ok := r.changed[table]
+    return ok && time.Since(changed) < RANGE_SETTLE_TIME
+}
+
+/* Servers a range holding key moved away from lately, see Ranges.Previous. */
+func (srv *Server) previousOwners(table, key []byte) []string {
+    if !RangeTable(table) || RANGES == nil {
+        return nil
+    }
+    return RANGES.Previous(table, key)
+}
+
+/* Every record, keyed by table and start, for RGET. */
+func (r *Ranges) Records() []byte {
+    r.lock.RLock()
+    defer r.lock.RUnlock()
+    var result []byte
+    for table, records := range r.tables {
+        for _, record := range records {
+            var owners = []byte(strings.Join(record.owners, ","))
+            result = appendRecord(result, rangeKey(table, record.start),
+                                  Stamp(record.version, owners))
+        }
+    }
+    return result
+}
+
+/* Take in the records another server knows of. */
+func (r *Ranges) Merge(data []byte) error {
+    var failed error
+    err := DecodeRecords(data, func(k, record []byte) {
+        table, start := splitRangeKey(k)
+        version, owners := Unstamp(record)
+        if _, err := r.Put(table, start, strings.Split(string(owners), ","), version); err != nil {
+            failed = err
+        }
+    })
+    if err != nil {
+        return err
+    }
+    return failed
+}
+
+/* Owners of a table that has no recorded ranges. */
+func initialOwners(table []byte) []string {
+    return CurrentRing().Successors(HashTableKey(table, nil), TableReplicas(string(table)))
+}
+
+/* Record new owners of a range on this and every other server. */
+func (srv *Server) publishRange(pool *Pool, table, start []byte, owners []string) error {
+    var version = CLOCK.Now()
+    _, err := RANGES.Put(string(table), start, owners, version)
+    if err != nil {
+        return err
+    }
+    var value = Stamp(version, []byte(strings.Join(owners, ",")))
+    for _, server := range CurrentRing().Servers() {
+        if server == srv.Addr {
+            continue
+        }
+        _, err := pool.Call(server, EncodeRequest(RSET_CODE, table, start, value))
+        if err != nil {
+            /* It pulls the record later */
+            println("cannot send range of", string(table), "to", server, "\b:", err.Error())
+        }
+    }
+    println("range of", string(table), "from", fmt.Sprintf("%q", start), "on",
+            strings.Join(owners, ","))
+    return nil
+}
+
+/* Give a range to other servers, as asked by RSET without a version. The
+   other servers are told after the reply. */
+func (srv *Server) moveRange(table, start []byte, owners []string) error {
+    if !RangeTable(table) || len(owners) == 0 {
+        return fmt.Errorf("%w: %s is not a range table", ErrInvalid, string(table))
+    }
+    for _, owner := range owners {
+        if !contains(CurrentRing().Servers(), owner) {
+            return fmt.Errorf("%w: %s is not a server", ErrInvalid, owner)
+        }
+    }
+    table, start = clone(table), clone(start)
+    go func() {
+        err := srv.publishRange(NewPool(), table, start, owners)
+        if err != nil {
+            println("cannot move range of", string(table), "\b:", err.Error())
+        }
+    }()
+    return nil
+}
+
+func (srv *Server) rangeLoop() {
+    var pool = NewPool()
+    for {
+        time.Sleep(RANGE_INTERVAL)
+        var others = srv.members.others()
+        if len(others) > 0 {
+            var peer = others[rand.Intn(len(others))]
+            value, err := pool.Call(peer, EncodeRequest(RGET_CODE, nil, nil, nil))
+            if err == nil {
+                err = RANGES.Merge(value)
+            }
+            if err != nil && srv.members.Alive(peer) {
+                println("cannot pull ranges from", peer, "\b:", err.Error())
+            }
+        }
+        for table := range RANGE_TABLES {
+            err := srv.splitRanges(pool, []byte(table))
+            if err != nil {
+                println("cannot split ranges of", table, "\b:", err.Error())
+            }
+            if RANGES.unsettled(table) {
+                err = srv.expelStrays(table)
+                if err != nil {
+                    println("cannot hand over", table, "\b:", err.Error())
+                }
+            }
+        }
+    }
+}
+
+/* Split the ranges this server is the primary of that have grown. */
+func (srv *Server) splitRanges(pool *Pool, table []byte) error {
+    cola, err := srv.strg.ExistentCOLA(table)
+    if errors.Is(err, ErrNotFound) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    for _, kr := range RANGES.Table(table) {
+        if kr.Owners[0] != srv.Addr {
+            continue
+        }
+        var count int
+        err = cola.ScanVersions(kr.Start, kr.End, func(k, v []byte, version uint64) bool {
+            count++
+            return count <= RANGE_SPLIT
+        })
+        if err != nil {
+            return err
+        }
+        if count <= RANGE_SPLIT {
+            continue
+        }
+        var middle []byte
+        count = 0
+        err = cola.ScanVersions(kr.Start, kr.End, func(k, v []byte, version uint64) bool {
+            count++
+            middle = clone(k)
+            return count <= RANGE_SPLIT / 2
+        })
+        if err != nil {
+            return err
+        }
+        if bytes.Equal(middle, kr.Start) {
+            continue
+        }
+        var owners = CurrentRing().Successors(HashTableKey(table, middle), len(kr.Owners))
+        err = srv.publishRange(pool, table, middle, owners)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/* Hand over the records of a table this server does not own, and delete
+   them. Those it owns are left alone. */
+func (srv *Server) expelStrays(table string) error {
+    reallocLock.Lock()
+    defer reallocLock.Unlock()
+    var self = srv.Addr
+    return reallocateTable(srv.strg, self, table, nil, func(t, key []byte) []string {
+        if owners := Owners(t, key); contains(owners, self) {
+            return owners
+        }
+        return nil
+    }, false)
+}
+
+/* Live records of [start, end) in key order, read from one owner of each
+   range the interval covers. */
+func (srv *Server) scanRanges(pool *Pool, table, start, end []byte, limit int) (*ScanPage, error) {
+    var page = &ScanPage{}
+    for _, kr := range RANGES.Overlapping(table, start, end) {
+        if len(page.Keys) >= limit {
+            /* More ranges to read */
+            page.Next = kr.Start
+            break
+        }
+        var s, e = kr.Start, kr.End
+        if bytes.Compare(start, s) > 0 {
+            s = start
+        }
+        if e == nil || (end != nil && bytes.Compare(end, e) < 0) {
+            e = end
+        }
+        part, err := srv.scanRange(pool, table, s, e, limit - len(page.Keys))
+        if err != nil {
+            return nil, err
+        }
+        part = mergeScans([]*ScanPage{ part }, e, limit - len(page.Keys))
+        page.Keys = append(page.Keys, part.Keys...)
+        page.Values = append(page.Values, part.Values...)
+        page.Versions = append(page.Versions, part.Versions...)
+        if part.Next != nil {
+            page.Next = part.Next
+            break
+        }
+    }
+    return page, nil
+}
+
+func (srv *Server) scanRange(pool *Pool, table, start, end []byte, limit int) (*ScanPage, error) {
+    var owners = Owners(table, start)
+    var request = EncodeScan(LSCN_CODE, table, start, end, limit)
+    var page *ScanPage
+    for _, owner := range srv.members.Prefer(owners) {
+        var err error
+        if owner == srv.Addr {
+            page, err = srv.localScan(table, start, end, limit)
+        } else {
+            var value []byte
+            value, err = pool.Call(owner, request)
+            if err == nil {
+                page, err = DecodeScanPage(value)
+            }
+        }
+        if err == nil {
+            break
+        }
+        println("cannot scan", string(table), "on", owner, "\b:", err.Error())
+    }
+    if page == nil {
+        return nil, fmt.Errorf("%w: no owner of the range answers", ErrUnavailable)
+    }
+    /* Servers being drained, and those the range moved away from lately, may
+       still hold records of it */
+    var pages = []*ScanPage{ page }
+    var former = union(srv.members.InState(MEMBER_LEAVING), srv.previousOwners(table, start))
+    for _, server := range former {
+        var more *ScanPage
+        var err error
+        if server == srv.Addr {
+            more, err = srv.localScan(table, start, end, limit)
+        } else if srv.members.Alive(server) {
+            var value []byte
+            value, err = pool.Call(server, request)
+            if err == nil {
+                more, err = DecodeScanPage(value)
+            }
+        }
+        if err == nil && more != nil {
+            pages = append(pages, more)
+        }
+    }
+    if len(pages) == 1 {
+        return page, nil
+    }
+    return mergeScans(pages, end, limit), nil
+}
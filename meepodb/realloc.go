@@ -23,17 +23,353 @@
 package meepodb
 
 import (
-    "hash/fnv"
-    "strconv"
+    "bytes"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    . "syscall"
+    "time"
 )
 
-func Reallocate(addr string) {
+/* Records handed over before progress is saved */
+const REALLOC_BATCH int = 256
+
+/* Servers of the ring the data was last placed on, one per line. Data placed
+   by modulo before the ring has no such file. */
+const SERVERS_FILE string = ".ring"
+
+/* Tag, table and last key handed over by an unfinished reallocation */
+const REALLOC_FILE string = ".realloc"
+
+/* Cluster tag the data was last placed for, see ClusterTag */
+const TAG_FILE string = "tag"
+
+/* One reallocation at a time, whoever starts it */
+var reallocLock sync.Mutex
+
+/* How the last reallocation of this server went, for admins to follow */
+type reallocProgress struct {
+    lock     sync.Mutex
+    running  bool
+    table    string
+    sent     int
+    expelled int
+    started  time.Time
+    finished time.Time
+    err      error
+}
+
+var reallocs reallocProgress
+
+/* Mark a reallocation as running from now, with lock held. */
+func (progress *reallocProgress) start() {
+    progress.running, progress.table, progress.err = true, "", nil
+    progress.sent, progress.expelled = 0, 0
+    progress.started = time.Now()
+}
+
+/*
+ *  Reallocation runs after the servers change. Every table is scanned in key
+ *  order and each record is sent with DSTR to the servers that own it now but
+ *  did not before. Once all of them have acknowledged a batch, the records
+ *  this server no longer owns are deleted. Progress is saved after each batch,
+ *  so an interrupted reallocation resumes where it stopped.
+ *
+ *  Records are sent with their versions, so receivers keep their own copy of
+ *  a record if it is newer.
+ */
+func Reallocate(strg *Storage, self string) error {
+    reallocLock.Lock()
+    defer reallocLock.Unlock()
+    reallocs.lock.Lock()
+    reallocs.start()
+    reallocs.lock.Unlock()
+    err := reallocate(strg, self)
+    reallocs.lock.Lock()
+    reallocs.running, reallocs.err = false, err
+    reallocs.finished = time.Now()
+    reallocs.lock.Unlock()
+    return err
+}
+
+func reallocate(strg *Storage, self string) error {
+    tables, err := strg.Tables()
+    if err != nil {
+        return err
+    }
+    var dir = strg.Dir()
+    var from, after = readProgress(dir)
+    var previous = ringOwners(readServers(dir))
+    for _, table := range tables {
+        /* A Raft group would not know of records moved behind its log */
+        if table < from || RAFT_TABLES[table] {
+            continue
+        }
+        var start []byte
+        if table == from {
+            start = after
+        }
+        reallocs.lock.Lock()
+        reallocs.table = table
+        reallocs.lock.Unlock()
+        err = reallocateTable(strg, self, table, start, previous, true)
+        if err != nil {
+            return err
+        }
+    }
+    err = os.Remove(dir + "/" + REALLOC_FILE)
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return WriteServers(dir)
+}
+
+/* Hand over and expel the records of one table that belong elsewhere. */
+func Expel(strg *Storage, self string, table string) error {
+    if RAFT_TABLES[table] {
+        return nil
+    }
+    reallocLock.Lock()
+    defer reallocLock.Unlock()
+    var previous = ringOwners(readServers(strg.Dir()))
+    return reallocateTable(strg, self, table, nil, previous, false)
+}
+
+/* Owners of keys on the ring of the old servers, unknown if there is none. */
+func ringOwners(old []string) func(table, key []byte) []string {
+    if old == nil {
+        return nil
+    }
+    return NewRing(old).Owners
+}
+
+/* Records are sent to the owners not among the previous ones, and the
+   previous ones are all taken as new if previous is nil. */
+func reallocateTable(strg *Storage, self string, table string, after []byte,
+                     previous func(table, key []byte) []string, save bool) error {
+    cola, err := strg.ExistentCOLA([]byte(table))
+    if errors.Is(err, ErrNotFound) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    var peers = make(map[string]*Peer)
+    defer func() {
+        for _, peer := range peers {
+            peer.Close()
+        }
+    }()
+    var moved, expelled int
+    if save {
+        defer func() {
+            reallocs.lock.Lock()
+            reallocs.sent += moved
+            reallocs.expelled += expelled
+            reallocs.lock.Unlock()
+        }()
+    }
+    for {
+        /* Nothing may be written while the COLA is scanned, so collect a
+           batch first. Keys and values are copied as extents may be unmapped
+           by a push-down. */
+        var keys, values [][]byte
+        var versions []uint64
+        err = cola.ScanVersions(after, nil, func(key, value []byte, version uint64) bool {
+            if after != nil && bytes.Equal(key, after) {
+                return true
+            }
+            keys = append(keys, clone(key))
+            values = append(values, Stamp(version, value))
+            versions = append(versions, version)
+            return len(keys) < REALLOC_BATCH
+        })
+        if err != nil {
+            return err
+        }
+        if len(keys) == 0 {
+            break
+        }
+        var sent = make(map[*Peer]int)
+        var owned = make([]bool, len(keys))
+        for i, key := range keys {
+            owners := Owners([]byte(table), key)
+            var before []string
+            if previous != nil {
+                before = previous([]byte(table), key)
+            }
+            for _, owner := range owners {
+                if owner == self {
+                    owned[i] = true
+                    continue
+                }
+                if contains(before, owner) {
+                    continue
+                }
+                peer, ok := peers[owner]
+                if !ok {
+                    peer, err = DialPeer(owner)
+                    if err != nil {
+                        return err
+                    }
+                    peers[owner] = peer
+                }
+                err = peer.Send(EncodeRequest(DSTR_CODE, []byte(table), key, values[i]))
+                if err != nil {
+                    return fmt.Errorf("%s: %w", owner, err)
+                }
+                sent[peer]++
+                moved++
+            }
+        }
+        for peer, n := range sent {
+            for ; n > 0; n-- {
+                code, msg, err := peer.Reply()
+                if err != nil {
+                    return fmt.Errorf("%s: %w", peer.Addr, err)
+                }
+                if code != OK_CODE {
+                    return &RemoteError{ Addr: peer.Addr, Msg: string(msg) }
+                }
+            }
+        }
+        for i, key := range keys {
+            if owned[i] {
+                continue
+            }
+            /* Deleted at the version of the record, so that the record can
+               come back if the key is given to this server again */
+            _, err = cola.Put(key, nil, versions[i])
+            if err != nil {
+                return err
+            }
+            expelled++
+        }
+        after = keys[len(keys) - 1]
+        if save {
+            err = writeProgress(strg.Dir(), table, after)
+            if err != nil {
+                return err
+            }
+        }
+    }
+    if moved != 0 || expelled != 0 {
+        println("reallocated", table, "\b:", moved, "sent,", expelled, "expelled")
+    }
+    return nil
+}
+
+func contains(list []string, s string) bool {
+    for _, x := range list {
+        if x == s {
+            return true
+        }
+    }
+    return false
+}
+
+/* Reallocate, then take the data as placed for the current cluster tag. */
+func Rebalance(strg *Storage, self string) error {
+    err := Reallocate(strg, self)
+    if err != nil {
+        return err
+    }
+    return replaceFile(strg.Dir() + "/" + TAG_FILE, Uint64ToBytes(CLUSTER_TAG))
+}
+
+/* Tag the data was last placed for, 0 if unknown. */
+func placedTag(dir string) uint64 {
+    data, err := os.ReadFile(dir + "/" + TAG_FILE)
+    if err != nil || len(data) != 8 {
+        return 0
+    }
+    return BytesToUint64(data)
+}
+
+/* How the last reallocation went, on one line. */
+func reallocReport() string {
+    reallocs.lock.Lock()
+    defer reallocs.lock.Unlock()
+    var now = time.Now()
+    switch {
+        case reallocs.running:
+            return fmt.Sprintf("running for %s, table %q, %d sent, %d expelled",
+                               now.Sub(reallocs.started).Round(time.Second),
+                               reallocs.table, reallocs.sent, reallocs.expelled)
+        case reallocs.started.IsZero():
+            return "none"
+        case reallocs.err != nil:
+            return fmt.Sprintf("failed %s ago in table %q: %s",
+                               now.Sub(reallocs.finished).Round(time.Second),
+                               reallocs.table, reallocs.err.Error())
+    }
+    return fmt.Sprintf("done %s ago in %s, %d sent, %d expelled",
+                       now.Sub(reallocs.finished).Round(time.Second),
+                       reallocs.finished.Sub(reallocs.started).Round(time.Millisecond),
+                       reallocs.sent, reallocs.expelled)
+}
+
+/* Remember the servers the data is placed for. */
+func WriteServers(dir string) error {
+    return replaceFile(dir + "/" + SERVERS_FILE, []byte(strings.Join(SERVERS, "\n")))
+}
+
+/* Nil if unknown, in which case records are sent to all other owners. */
+func readServers(dir string) []string {
+    data, err := os.ReadFile(dir + "/" + SERVERS_FILE)
+    if err != nil || len(data) == 0 {
+        return nil
+    }
+    return strings.Split(string(data), "\n")
+}
+
+/* Progress format:
+   |   tag    |   tlen   |  table  |  key   |
+   |----------|----------|---------|--------|
+   | 8 bytes  | 8 bytes  | N bytes | rest   |
+   Progress saved for another cluster tag is ignored.
+*/
+func writeProgress(dir, table string, key []byte) error {
+    var buffer = make([]byte, 16 + len(table) + len(key))
+    copy(buffer[0:], Uint64ToBytes(CLUSTER_TAG))
+    copy(buffer[8:], Uint64ToBytes(uint64(len(table))))
+    copy(buffer[16:], table)
+    copy(buffer[16 + len(table):], key)
+    return replaceFile(dir + "/" + REALLOC_FILE, buffer)
+}
+
+func readProgress(dir string) (string, []byte) {
+    data, err := os.ReadFile(dir + "/" + REALLOC_FILE)
+    if err != nil || len(data) < 16 || BytesToUint64(data[0:8]) != CLUSTER_TAG {
+        return "", nil
+    }
+    var tlen = BytesToUint64(data[8:16])
+    if tlen > uint64(len(data) - 16) {
+        return "", nil
+    }
+    println("resuming reallocation from", string(data[16 : 16 + tlen]))
+    return string(data[16 : 16 + tlen]), data[16 + tlen :]
 }
 
-func HashTableKey(table, key []byte) uint64 {
-    hash := fnv.New64a()
-    hash.Write(table)
-    hash.Write([]byte(strconv.Itoa(len(SERVERS))))
-    hash.Write(key)
-    return hash.Sum64()
+func replaceFile(path string, data []byte) error {
+    var mode int = O_WRONLY | O_CREAT | O_TRUNC
+    fd, err := Open(path + ".1", mode, S_IRALL | S_IWALL)
+    if err != nil {
+        return pathError("open", path + ".1", err)
+    }
+    err = writeAll(fd, data)
+    if err == nil {
+        err = Fsync(fd)
+    }
+    Close(fd)
+    if err != nil {
+        return pathError("write", path + ".1", err)
+    }
+    err = Rename(path + ".1", path)
+    if err != nil {
+        return pathError("rename", path, err)
+    }
+    return nil
 }
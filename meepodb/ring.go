@@ -0,0 +1,308 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+package meepodb
+
+import (
+    "hash/fnv"
+    "sort"
+    "strconv"
+    "sync/atomic"
+)
+
+/* Points of each server on the ring. More points spread the keys more evenly
+   at the cost of a larger ring. */
+const VNODES int = 128
+
+/*
+ *  Consistent hashing ring. Every server is hashed to VNODES points and a key
+ *  belongs to the servers of the first points following its hash, skipping
+ *  points of servers already taken. Adding or removing one of N servers thus
+ *  moves about 1/N of the keys, and the replicas of a key are always on
+ *  distinct servers.
+ *
+ *  Servers in ZONES are grouped by zone. The replicas of a key then skip the
+ *  servers of zones already taken as well, as long as there are zones left,
+ *  so that losing a zone loses no record that has copies in other zones.
+ */
+type Ring struct {
+    servers []string        /* Distinct, sorted */
+    points  []uint64        /* Sorted */
+    owners  []int           /* Server of each point */
+    nodes   int             /* Distinct servers */
+    zones   []int           /* Zone of each server */
+    nzones  int             /* Distinct zones */
+}
+
+func NewRing(servers []string) *Ring {
+    var ring = new(Ring)
+    var distinct = make(map[string]bool)
+    for _, s := range servers {
+        distinct[s] = true
+    }
+    ring.nodes = len(distinct)
+    var sorted = make([]string, 0, len(distinct))
+    for s := range distinct {
+        sorted = append(sorted, s)
+    }
+    sort.Strings(sorted)
+    type point struct {
+        hash  uint64
+        owner int
+    }
+    var points = make([]point, 0, len(sorted) * VNODES)
+    for i, s := range sorted {
+        for j := 0; j < VNODES; j++ {
+            points = append(points, point{ mix64(fnv64(s + "#" + strconv.Itoa(j))), i })
+        }
+    }
+    /* Ties are broken by server, so every ring built from the same servers
+       is the same */
+    sort.Slice(points, func(a, b int) bool {
+        if points[a].hash != points[b].hash {
+            return points[a].hash < points[b].hash
+        }
+        return points[a].owner < points[b].owner
+    })
+    ring.points = make([]uint64, len(points))
+    ring.owners = make([]int, len(points))
+    for i, p := range points {
+        ring.points[i] = p.hash
+        ring.owners[i] = p.owner
+    }
+    ring.servers = sorted
+    /* Servers without a zone are zones of their own */
+    var zoneIds = make(map[string]int)
+    ring.zones = make([]int, len(sorted))
+    for i, s := range sorted {
+        var zone, ok = ZONES[s]
+        if !ok {
+            zone = "\x00" + s
+        }
+        id, ok := zoneIds[zone]
+        if !ok {
+            id = len(zoneIds)
+            zoneIds[zone] = id
+        }
+        ring.zones[i] = id
+    }
+    ring.nzones = len(zoneIds)
+    return ring
+}
+
+/* Number of distinct zones of the servers. */
+func (ring *Ring) Zones() int {
+    return ring.nzones
+}
+
+/* Zone of a server, or the server itself if it has none. */
+func ZoneOf(server string) string {
+    if zone, ok := ZONES[server]; ok {
+        return zone
+    }
+    return server
+}
+
+/* Distinct servers in sorted order. */
+func (ring *Ring) Servers() []string {
+    return ring.servers
+}
+
+/* The first n distinct servers following hash, fewer if the ring is smaller,
+   in distinct zones while there are zones not taken yet. */
+func (ring *Ring) Successors(hash uint64, n int) []string {
+    if n > ring.nodes {
+        n = ring.nodes
+    }
+    var result = make([]string, 0, n)
+    if n == 0 {
+        return result
+    }
+    var taken = make([]bool, ring.nodes)
+    var zoneTaken = make([]bool, ring.nzones)
+    var first = sort.Search(len(ring.points), func(i int) bool {
+        return ring.points[i] >= hash
+    })
+    /* One round of the ring taking new zones only, if there are as many */
+    var spread = min(n, ring.nzones)
+    for k := 0; k < len(ring.points) && len(result) < spread; k++ {
+        var owner = ring.owners[(first + k) % len(ring.points)]
+        if !zoneTaken[ring.zones[owner]] {
+            zoneTaken[ring.zones[owner]] = true
+            taken[owner] = true
+            result = append(result, ring.servers[owner])
+        }
+    }
+    for i := first; len(result) < n; i++ {
+        if i == len(ring.points) {
+            i = 0
+        }
+        if owner := ring.owners[i]; !taken[owner] {
+            taken[owner] = true
+            result = append(result, ring.servers[owner])
+        }
+    }
+    return result
+}
+
+/* Servers holding a record, the first being its primary. All the records of
+   a Raft table live on the servers of its group, and those of a range table
+   on the servers of their range. */
+func (ring *Ring) Owners(table, key []byte) []string {
+    if RangeTable(table) && RANGES != nil {
+        if owners := RANGES.Owners(table, key); owners != nil {
+            return owners
+        }
+    }
+    if RaftTable(table) || RangeTable(table) {
+        key = nil
+    }
+    return ring.Successors(HashTableKey(table, key), TableReplicas(string(table)))
+}
+
+/* Number of copies of every record of tables not in REPLICAS. */
+func Replicas() int {
+    if REPLICA {
+        return REPLICA_FACTOR
+    }
+    return 1
+}
+
+/* Number of copies of every record of a table, before the ring caps it. */
+func TableReplicas(table string) int {
+    if n, ok := REPLICAS[table]; ok {
+        return n
+    }
+    if RAFT_TABLES[table] {
+        return REPLICA_FACTOR
+    }
+    return Replicas()
+}
+
+/* The ring of SERVERS but those leaving or left, rebuilt when either
+   changes, and the ring of all SERVERS. */
+var currentRing, fullRing atomic.Pointer[ringCache]
+
+/* Servers leaving or left, sorted */
+var inactive atomic.Pointer[[]string]
+
+type ringCache struct {
+    source []string
+    ring   *Ring
+}
+
+func cachedRing(cached *atomic.Pointer[ringCache], servers []string) *Ring {
+    var cache = cached.Load()
+    if cache != nil && sameStrings(cache.source, servers) {
+        return cache.ring
+    }
+    cache = &ringCache{ append([]string(nil), servers...), NewRing(servers) }
+    cached.Store(cache)
+    return cache.ring
+}
+
+func CurrentRing() *Ring {
+    var out = inactive.Load()
+    if out == nil || len(*out) == 0 {
+        return cachedRing(&currentRing, SERVERS)
+    }
+    var servers = make([]string, 0, len(SERVERS))
+    for _, s := range SERVERS {
+        if !contains(*out, s) {
+            servers = append(servers, s)
+        }
+    }
+    return cachedRing(&currentRing, servers)
+}
+
+/* The ring as if no server were leaving, to find the copies of records that
+   servers being drained still hold. */
+func FullRing() *Ring {
+    return cachedRing(&fullRing, SERVERS)
+}
+
+func resetRings() {
+    currentRing.Store(nil)
+    fullRing.Store(nil)
+}
+
+func setInactive(servers []string) {
+    inactive.Store(&servers)
+}
+
+/* Servers holding a record now, the first being its primary. */
+func Owners(table, key []byte) []string {
+    return CurrentRing().Owners(table, key)
+}
+
+func HashTableKey(table, key []byte) uint64 {
+    hash := fnv.New64a()
+    hash.Write(table)
+    hash.Write([]byte{ 0 })
+    hash.Write(key)
+    return mix64(hash.Sum64())
+}
+
+/* Tag of the cluster formed by SERVERS. Servers that have placed their data
+   for another tag reallocate it. */
+func ClusterTag() uint64 {
+    var servers = CurrentRing().Servers()
+    hash := fnv.New64a()
+    /* Placement on the ring rather than by modulo */
+    hash.Write([]byte("ring/" + strconv.Itoa(VNODES) + "&"))
+    for _, s := range servers {
+        /* Zones move records too */
+        if zone, ok := ZONES[s]; ok {
+            s += "@" + zone
+        }
+        hash.Write([]byte(s + "&"))
+    }
+    return hash.Sum64()
+}
+
+func fnv64(s string) uint64 {
+    hash := fnv.New64a()
+    hash.Write([]byte(s))
+    return hash.Sum64()
+}
+
+/* Finalizer of splitmix64. FNV alone leaves similar strings close together. */
+func mix64(x uint64) uint64 {
+    x ^= x >> 30
+    x *= 0xBF58476D1CE4E5B9
+    x ^= x >> 27
+    x *= 0x94D049BB133111EB
+    x ^= x >> 31
+    return x
+}
+
+func sameStrings(a, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,296 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "sync"
+)
+
+/*
+ *  SCAN, KEYS and SIZE read a table across the cluster. Each server asked
+ *  returns its own records in key order with LSCN, deleted ones included, and
+ *  the streams are merged keeping the newest version of every key, so that
+ *  copies of a record on several replicas come out once and a deletion hides
+ *  older copies. A server stopping short of the end of the interval tells
+ *  where it stopped, and nothing past the first such key is returned, as
+ *  records of that server after it are not known yet. Where the page stops
+ *  is the cursor the next one starts from.
+ *
+ *  Records of a hashed table may be on any server, so all of them are asked
+ *  at once. Those of a range table are asked of one owner per range.
+ */
+type ScanPage struct {
+    Keys     [][]byte
+    Values   [][]byte
+    Versions []uint64
+    Next     []byte    /* Start of the next page, nil after the last one */
+}
+
+/* | nlen 8 bytes | next | records as by appendRecord | */
+func (page *ScanPage) Encode() []byte {
+    var result = append(Uint64ToBytes(uint64(len(page.Next))), page.Next...)
+    for i, key := range page.Keys {
+        result = appendRecord(result, key, Stamp(page.Versions[i], page.Values[i]))
+    }
+    return result
+}
+
+func DecodeScanPage(data []byte) (*ScanPage, error) {
+    if len(data) < 8 || BytesToUint64(data) > uint64(len(data) - 8) {
+        return nil, errors.New("truncated page")
+    }
+    var page = &ScanPage{}
+    var n = 8 + BytesToUint64(data)
+    if n > 8 {
+        page.Next = data[8:n]
+    }
+    err := DecodeRecords(data[n:], func(k, record []byte) {
+        version, value := Unstamp(record)
+        page.Keys = append(page.Keys, k)
+        page.Values = append(page.Values, value)
+        page.Versions = append(page.Versions, version)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return page, nil
+}
+
+/* SCAN, KEYS or LSCN of [start, end), a nil end leaving it open. */
+func EncodeScan(code byte, table, start, end []byte, limit int) []byte {
+    return EncodeRequest(code, table, start, append(Uint64ToBytes(uint64(limit)), end...))
+}
+
+/* | limit 8 bytes | end |, an empty end meaning no end and no limit meaning
+   MAX_RECORDS. */
+func decodeScan(value []byte) (int, []byte) {
+    var limit = BytesToUint64(value)
+    if limit == 0 || limit > MAX_RECORDS {
+        limit = MAX_RECORDS
+    }
+    var end = value[8:]
+    if len(end) == 0 {
+        end = nil
+    }
+    return int(limit), end
+}
+
+/* The key right after key. */
+func successor(key []byte) []byte {
+    return append(clone(key), 0)
+}
+
+/* Records of [start, end) on this server, deleted ones included, at most
+   limit of them. */
+func (srv *Server) localScan(table, start, end []byte, limit int) (*ScanPage, error) {
+    if srv.booting.Load() {
+        return nil, fmt.Errorf("%w: %s is copying its tables", ErrUnavailable, srv.Addr)
+    }
+    var page = &ScanPage{}
+    cola, err := srv.strg.ExistentCOLA(table)
+    if errors.Is(err, ErrNotFound) {
+        return page, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var size uint64
+    err = cola.ScanRecords(start, end, func(k, v []byte, version uint64) bool {
+        size += uint64(16 + len(k) + len(v))
+        if len(page.Keys) == limit || len(page.Keys) > 0 && size > MAX_VALUE_LEN {
+            page.Next = successor(page.Keys[len(page.Keys) - 1])
+            return false
+        }
+        page.Keys = append(page.Keys, clone(k))
+        page.Values = append(page.Values, clone(v))
+        page.Versions = append(page.Versions, version)
+        return true
+    })
+    if err != nil {
+        return nil, err
+    }
+    return page, nil
+}
+
+/* Merge pages of several servers into one of at most limit live records. */
+func mergeScans(pages []*ScanPage, end []byte, limit int) *ScanPage {
+    var bound []byte
+    for _, page := range pages {
+        if page.Next != nil && (bound == nil || bytes.Compare(page.Next, bound) < 0) {
+            bound = page.Next
+        }
+    }
+    var heads = make([]int, len(pages))
+    var result = &ScanPage{}
+    for {
+        var key []byte
+        for i, page := range pages {
+            if heads[i] < len(page.Keys) &&
+               (key == nil || bytes.Compare(page.Keys[heads[i]], key) < 0) {
+                key = page.Keys[heads[i]]
+            }
+        }
+        if key == nil || bound != nil && bytes.Compare(key, bound) >= 0 {
+            break
+        }
+        if len(result.Keys) == limit {
+            result.Next = key
+            return result
+        }
+        /* A server that handed a record over deletes its copy at the same
+           version, so a live record wins a tie */
+        var best, bestPage = -1, -1
+        for i, page := range pages {
+            if heads[i] < len(page.Keys) && bytes.Equal(page.Keys[heads[i]], key) {
+                var j = heads[i]
+                if best < 0 || page.Versions[j] > pages[bestPage].Versions[best] ||
+                   page.Versions[j] == pages[bestPage].Versions[best] &&
+                   len(pages[bestPage].Values[best]) == 0 {
+                    best, bestPage = j, i
+                }
+                heads[i]++
+            }
+        }
+        var page = pages[bestPage]
+        if len(page.Values[best]) != 0 {
+            result.Keys = append(result.Keys, key)
+            result.Values = append(result.Values, page.Values[best])
+            result.Versions = append(result.Versions, page.Versions[best])
+        }
+    }
+    if bound != nil && (end == nil || bytes.Compare(bound, end) < 0) {
+        result.Next = bound
+    }
+    return result
+}
+
+/*
+ *  Scan a hashed table on the servers given, all at once, as a client program
+ *  may without a server coordinating. Servers that fail are left out as long
+ *  as fewer of them fail than there are replicas of each record.
+ */
+func ScanCluster(servers []string, table, start, end []byte, limit int) (*ScanPage, error) {
+    var fetch = func(server string, start []byte) (*ScanPage, error) {
+        return fetchScan(server, EncodeScan(LSCN_CODE, table, start, end, limit))
+    }
+    return scanServers(servers, table, start, end, limit, fetch)
+}
+
+/* Calls run in parallel and pools are not shared, so each takes its own
+   connection. */
+func fetchScan(server string, request []byte) (*ScanPage, error) {
+    peer, err := DialPeer(server)
+    if err != nil {
+        return nil, err
+    }
+    defer peer.Close()
+    value, err := peer.Call(request)
+    if err != nil {
+        return nil, err
+    }
+    return DecodeScanPage(value)
+}
+
+/* Pages with nothing but deletions are skipped. */
+func scanServers(servers []string, table, start, end []byte, limit int,
+                 fetch func(server string, start []byte) (*ScanPage, error)) (*ScanPage, error) {
+    for {
+        page, err := scatter(servers, table, start, end, limit, fetch)
+        if err != nil || len(page.Keys) > 0 || page.Next == nil {
+            return page, err
+        }
+        start = page.Next
+    }
+}
+
+func scatter(servers []string, table, start, end []byte, limit int,
+             fetch func(server string, start []byte) (*ScanPage, error)) (*ScanPage, error) {
+    var pages = make([]*ScanPage, len(servers))
+    var errs = make([]error, len(servers))
+    var wait sync.WaitGroup
+    for i, server := range servers {
+        wait.Add(1)
+        go func(i int, server string) {
+            defer wait.Done()
+            pages[i], errs[i] = fetch(server, start)
+        }(i, server)
+    }
+    wait.Wait()
+    var answered []*ScanPage
+    var failed error
+    for i, page := range pages {
+        if errs[i] != nil {
+            failed = fmt.Errorf("%s: %w", servers[i], errs[i])
+            continue
+        }
+        answered = append(answered, page)
+    }
+    if failed != nil && len(servers) - len(answered) >= TableReplicas(string(table)) {
+        return nil, fmt.Errorf("%w: %s", ErrUnavailable, failed.Error())
+    }
+    return mergeScans(answered, end, limit), nil
+}
+
+/* Live records of [start, end) in key order, at most limit of them. */
+func (srv *Server) scan(pool *Pool, table, start, end []byte, limit int) (*ScanPage, error) {
+    if RangeTable(table) {
+        for {
+            page, err := srv.scanRanges(pool, table, start, end, limit)
+            if err != nil || len(page.Keys) > 0 || page.Next == nil {
+                return page, err
+            }
+            start = page.Next
+        }
+    }
+    var fetch = func(server string, start []byte) (*ScanPage, error) {
+        if server == srv.Addr {
+            return srv.localScan(table, start, end, limit)
+        }
+        if !srv.members.Alive(server) {
+            return nil, errors.New("server is down")
+        }
+        return fetchScan(server, EncodeScan(LSCN_CODE, table, start, end, limit))
+    }
+    /* Servers being drained may still hold records */
+    var servers = append(CurrentRing().Servers(), srv.members.InState(MEMBER_LEAVING)...)
+    return scanServers(servers, table, start, end, limit, fetch)
+}
+
+/* Number of live records of a table in the cluster. */
+func (srv *Server) size(pool *Pool, table []byte) (uint64, error) {
+    var count uint64
+    var start = []byte{}
+    for start != nil {
+        page, err := srv.scan(pool, table, start, nil, int(MAX_RECORDS))
+        if err != nil {
+            return 0, err
+        }
+        count += uint64(len(page.Keys))
+        start = page.Next
+    }
+    return count, nil
+}
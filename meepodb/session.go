@@ -0,0 +1,124 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "errors"
+    "strings"
+    "sync"
+    "time"
+)
+
+/* Time a read retries for a copy as new as its session token */
+const SESSION_WAIT time.Duration = time.Second
+
+/* Time between reads while it retries */
+const SESSION_RETRY time.Duration = 50 * time.Millisecond
+
+/*
+ *  A session reads its own writes, even at consistency ONE. A SET with the
+ *  Version option replies with the version it wrote, and a GET whose value
+ *  is a version, its token, is answered only with a copy at least that new.
+ *  The server serving the GET asks the other owners, then the servers being
+ *  drained, for such a copy, and fails with ErrBehind at once if none has it,
+ *  so that its worker is not held up; Read asks again for up to SESSION_WAIT
+ *  while hints and repairs bring the copy.
+ *
+ *  Tokens are kept per key, as copies of different keys lag independently,
+ *  and the versions of GET replies are kept too, so that reads of a session
+ *  never go back in time either. Session is safe for concurrent use.
+ */
+type Session struct {
+    lock   sync.Mutex
+    tokens map[string]uint64
+}
+
+func NewSession() *Session {
+    return &Session{ tokens: make(map[string]uint64) }
+}
+
+func sessionKey(table, key []byte) string {
+    return string(table) + "\x00" + string(key)
+}
+
+/* Version a read of key must see, 0 if any will do. */
+func (session *Session) Token(table, key []byte) uint64 {
+    session.lock.Lock()
+    defer session.lock.Unlock()
+    return session.tokens[sessionKey(table, key)]
+}
+
+/* Remember a version of key written or read by the session. */
+func (session *Session) Observe(table, key []byte, version uint64) {
+    if version == 0 {
+        return
+    }
+    session.lock.Lock()
+    defer session.lock.Unlock()
+    var k = sessionKey(table, key)
+    if version > session.tokens[k] {
+        session.tokens[k] = version
+    }
+}
+
+/* A GET of key with its token, replying with the version, see Unstamp. */
+func (session *Session) EncodeGet(table, key []byte, opts RequestOptions) []byte {
+    opts.Version = true
+    var token []byte
+    if version := session.Token(table, key); version != 0 {
+        token = Uint64ToBytes(version)
+    }
+    return WithOptions(EncodeRequest(GET_CODE, table, key, token), opts)
+}
+
+/* Whether a server refused a read as no copy has caught up with its token. */
+func Behind(err error) bool {
+    var remote *RemoteError
+    return errors.Is(err, ErrBehind) ||
+           errors.As(err, &remote) && strings.Contains(remote.Msg, ErrBehind.Error())
+}
+
+/* GET key by call, retrying while the copies are behind, and observe the
+   version read. The reply is a record, see Unstamp. */
+func (session *Session) Read(call func(request []byte) ([]byte, error),
+                             table, key []byte, opts RequestOptions) ([]byte, error) {
+    var deadline = time.Now().Add(SESSION_WAIT)
+    for {
+        record, err := call(session.EncodeGet(table, key, opts))
+        if err == nil {
+            session.Observe(table, key, recordVersion(record))
+            return record, nil
+        }
+        if !Behind(err) || time.Now().After(deadline) {
+            return nil, err
+        }
+        time.Sleep(SESSION_RETRY)
+    }
+}
+
+/* A SET of key replying with the version to observe. */
+func (session *Session) EncodeSet(table, key, value []byte, opts RequestOptions) []byte {
+    opts.Version = true
+    return WithOptions(EncodeSet(table, key, value), opts)
+}
@@ -0,0 +1,156 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+package meepodb
+
+import (
+    "sync/atomic"
+)
+
+/* 2^12 = MAX_RECORDS, so the expected search path stays short. */
+const SKIP_MAX_HEIGHT int = 12
+
+/*
+ *  A skiplist with one writer and any number of readers. Readers never lock:
+ *  a node is fully built before it is linked from the bottom level up, and
+ *  a value is replaced by swapping one pointer.
+ */
+type SkipNode struct {
+    key    []byte
+    value  atomic.Pointer[[]byte]
+    index  uint64                   /* Slot in blx file */
+    next   []atomic.Pointer[SkipNode]
+}
+
+func (node *SkipNode) Key() []byte {
+    return node.key
+}
+
+func (node *SkipNode) Value() []byte {
+    return *node.value.Load()
+}
+
+func (node *SkipNode) Next() *SkipNode {
+    return node.next[0].Load()
+}
+
+type SkipList struct {
+    cmp     Comparator
+    head    *SkipNode
+    height  atomic.Int32
+    length  atomic.Uint64
+    seed    uint64
+}
+
+func NewSkipList(cmp Comparator) *SkipList {
+    var list = new(SkipList)
+    list.cmp = cmp
+    list.head = &SkipNode{ next: make([]atomic.Pointer[SkipNode], SKIP_MAX_HEIGHT) }
+    list.height.Store(1)
+    list.seed = 0x2545F4914F6CDD1D
+    return list
+}
+
+func (list *SkipList) Len() uint64 {
+    return list.length.Load()
+}
+
+/* First node whose key is not less than key. */
+func (list *SkipList) Seek(key []byte) *SkipNode {
+    return list.findGreaterOrEqual(key, nil)
+}
+
+func (list *SkipList) First() *SkipNode {
+    return list.head.next[0].Load()
+}
+
+func (list *SkipList) Find(key []byte) *SkipNode {
+    node := list.Seek(key)
+    if node != nil && list.cmp.Compare(node.key, key) == 0 {
+        return node
+    }
+    return nil
+}
+
+/* Insert a new key or replace the value of an existent one. Callers must not
+   run Put concurrently. */
+func (list *SkipList) Put(key, value []byte, index uint64) *SkipNode {
+    var prev [SKIP_MAX_HEIGHT]*SkipNode
+    node := list.findGreaterOrEqual(key, prev[:])
+    if node != nil && list.cmp.Compare(node.key, key) == 0 {
+        node.value.Store(&value)
+        node.index = index
+        return node
+    }
+    var height = list.randomHeight()
+    var top = int(list.height.Load())
+    if height > top {
+        for i := top; i < height; i++ {
+            prev[i] = list.head
+        }
+        list.height.Store(int32(height))
+    }
+    node = &SkipNode {
+        key   : key,
+        index : index,
+        next  : make([]atomic.Pointer[SkipNode], height),
+    }
+    node.value.Store(&value)
+    for i := 0; i < height; i++ {
+        node.next[i].Store(prev[i].next[i].Load())
+        prev[i].next[i].Store(node)
+    }
+    list.length.Add(1)
+    return node
+}
+
+func (list *SkipList) findGreaterOrEqual(key []byte, prev []*SkipNode) *SkipNode {
+    var x *SkipNode = list.head
+    for level := int(list.height.Load()) - 1; level >= 0; level-- {
+        for {
+            next := x.next[level].Load()
+            if next == nil || list.cmp.Compare(next.key, key) >= 0 {
+                break
+            }
+            x = next
+        }
+        if prev != nil {
+            prev[level] = x
+        }
+    }
+    return x.next[0].Load()
+}
+
+/* Heights are geometric with p = 1/4, as leveldb does. */
+func (list *SkipList) randomHeight() int {
+    var height int = 1
+    for height < SKIP_MAX_HEIGHT {
+        list.seed ^= list.seed << 13
+        list.seed ^= list.seed >> 7
+        list.seed ^= list.seed << 17
+        if list.seed & 3 != 0 {
+            break
+        }
+        height++
+    }
+    return height
+}
@@ -23,114 +23,260 @@
 package meepodb
 
 import (
+    "errors"
+    "io"
     "os"
+    "sort"
+    "strings"
+    "sync"
     . "syscall"
 )
 
+/* Storage is safe for concurrent use. The lock guards the table map only;
+   each COLA has a lock of its own. */
 type Storage struct {
-    colas map[string](*COLA)
+    lock    sync.RWMutex
+    dir     string
+    opts    *Options
+    colas   map[string](*COLA)
+    changes *ChangeLog      /* Writes made by Put and Drop, if any */
 }
 
-func NewStorage() *Storage {
+/* Tables live in subdirectories of dir. A nil opts means DefaultOptions. */
+func NewStorage(dir string, opts *Options) (*Storage, error) {
+    opts, err := opts.complete()
+    if err != nil {
+        return nil, err
+    }
     var strg = new(Storage)
+    strg.dir = dir
+    strg.opts = opts
     strg.colas = make(map[string](*COLA), 16)
-    return strg
-}
-
-func (strg *Storage) COLA(name []byte) *COLA {
-    var str = string(name)
-    cola, ok := strg.colas[str]
-    if !ok {
-        cola, ok = OpenCOLA(DB_DIR + "/" + str)
-        if !ok {
-            cola, ok = NewCOLA(DB_DIR + "/" + str)
-            if !ok {
-                return nil
-            }
-        }
-        strg.colas[str] = cola
+    return strg, nil
+}
+
+func (strg *Storage) Dir() string {
+    return strg.dir
+}
+
+/* Log the writes of Put and Drop from now on, see ChangeLog. */
+func (strg *Storage) LogChanges(log *ChangeLog) {
+    strg.changes = log
+}
+
+/* Options of a table. Policies in config.go win over the default one. */
+func (strg *Storage) tableOptions(name string) *Options {
+    var opts = *strg.opts
+    if policy, ok := POLICIES[name]; ok {
+        opts.Policy = policy
     }
-    return cola
+    return &opts
 }
 
-func (strg *Storage) ExistentCOLA(name []byte) *COLA {
-    var str = string(name)
-    cola, ok := strg.colas[str]
-    if !ok {
-        cola, ok = OpenCOLA(DB_DIR + "/" + str)
-        if !ok {
-            return nil
-        }
-        strg.colas[str] = cola
+/* Open a table, or create it if it does not exist. */
+func (strg *Storage) COLA(name []byte) (*COLA, error) {
+    return strg.open(string(name), true)
+}
+
+/* Open a table. ErrNotFound is returned if it does not exist. */
+func (strg *Storage) ExistentCOLA(name []byte) (*COLA, error) {
+    return strg.open(string(name), false)
+}
+
+func (strg *Storage) open(name string, create bool) (*COLA, error) {
+    if !validTableName(name) {
+        return nil, ErrInvalid
+    }
+    strg.lock.RLock()
+    cola, ok := strg.colas[name]
+    strg.lock.RUnlock()
+    if ok {
+        return cola, nil
+    }
+    strg.lock.Lock()
+    defer strg.lock.Unlock()
+    cola, ok = strg.colas[name]
+    if ok {
+        return cola, nil
     }
-    return cola
+    var path = strg.dir + "/" + name
+    var err error
+    _, err = os.Stat(path)
+    if err == nil {
+        cola, err = OpenCOLA(path, strg.tableOptions(name))
+    } else if !os.IsNotExist(err) {
+        return nil, err
+    } else if create {
+        cola, err = NewCOLA(path, strg.tableOptions(name))
+    } else {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    strg.colas[name] = cola
+    return cola, nil
 }
 
-func (strg *Storage) Get(table, key []byte) []byte {
-    var cola = strg.ExistentCOLA(table)
-    if cola == nil {
-        return nil
+/* ErrNotFound is returned if the table or the key does not exist. */
+func (strg *Storage) Get(table, key []byte) ([]byte, error) {
+    cola, err := strg.ExistentCOLA(table)
+    if err != nil {
+        return nil, err
     }
     return cola.Get(key)
 }
 
-func (strg *Storage) Set(table, key, value []byte) bool {
-    /* Delete a non-existent key always returns true */
-    if len(value) == 0 && len(strg.Get(table, key)) == 0 {
-        return true
+/* ErrNotFound is returned if the table or the key does not exist, along with
+   the version the key was deleted at if it was. */
+func (strg *Storage) GetVersion(table, key []byte) ([]byte, uint64, error) {
+    cola, err := strg.ExistentCOLA(table)
+    if err != nil {
+        return nil, 0, err
     }
-    var cola = strg.COLA(table)
-    if cola == nil {
-        return false
+    return cola.GetVersion(key)
+}
+
+/* Write key at version unless the table has a newer version of it. An empty
+   value deletes the key. */
+func (strg *Storage) Put(table, key, value []byte, version uint64) (bool, error) {
+    cola, err := strg.COLA(table)
+    if err != nil {
+        return false, err
+    }
+    if strg.changes == nil {
+        return cola.Put(key, value, version)
+    }
+    return cola.PutThen(key, value, version, func() {
+        strg.logChange(SET_CODE, table, key, Stamp(version, value))
+    })
+}
+
+/* A change not logged is missed by followers and subscribers, yet the write
+   is made, so it is not failed for that. */
+func (strg *Storage) logChange(code byte, table, key, record []byte) {
+    err := strg.changes.Append(code, table, key, record)
+    if err != nil {
+        println("cannot log change of", string(table), "\b:", err.Error())
+    }
+}
+
+/* An empty value deletes the key. */
+func (strg *Storage) Set(table, key, value []byte) error {
+    /* Delete a non-existent key always succeeds */
+    if len(value) == 0 {
+        _, err := strg.Get(table, key)
+        if errors.Is(err, ErrNotFound) {
+            return nil
+        }
+    }
+    cola, err := strg.COLA(table)
+    if err != nil {
+        return err
     }
     return cola.Set(key, value)
 }
 
 func (strg *Storage) Size(table []byte) uint64 {
-    var cola = strg.ExistentCOLA(table)
-    if cola == nil {
+    cola, err := strg.ExistentCOLA(table)
+    if err != nil {
         return 0
     }
     return cola.Size()
 }
 
 func (strg *Storage) Keys(table []byte) []string {
-    var cola = strg.ExistentCOLA(table)
-    if cola == nil {
+    cola, err := strg.ExistentCOLA(table)
+    if err != nil {
         return nil
     }
     return cola.Keys()
 }
 
-func (strg *Storage) Drop(table []byte) bool {
-    var cola = strg.ExistentCOLA(table)
-    if cola == nil {
-        return true
+func (strg *Storage) Drop(table []byte) error {
+    cola, err := strg.ExistentCOLA(table)
+    if errors.Is(err, ErrNotFound) {
+        return nil
     }
+    if err != nil {
+        return err
+    }
+    strg.lock.Lock()
+    defer strg.lock.Unlock()
+    /* Another Drop got here first, and the table may even be made again */
+    if strg.colas[string(table)] != cola {
+        return nil
+    }
+    /* Goroutines still holding the COLA see it closed */
     cola.Close()
     delete(strg.colas, string(table))
-    return os.RemoveAll(DB_DIR + "/" + string(table)) == nil
+    var path = strg.dir + "/" + string(table)
+    err = os.RemoveAll(path)
+    if err != nil {
+        return pathError("remove", path, err)
+    }
+    /* Still under the lock, before the table can be made again */
+    if strg.changes != nil {
+        strg.logChange(DROP_CODE, table, nil, Stamp(CLOCK.Now(), nil))
+    }
+    return nil
 }
 
-func (strg *Storage) OpenAll() bool {
-    fd, err := Open(DB_DIR, O_RDONLY, S_IREAD)
+/* Names of all tables on disk, sorted. */
+func (strg *Storage) Tables() ([]string, error) {
+    fd, err := Open(strg.dir, O_RDONLY, S_IREAD)
     if err != nil {
-        return false
+        return nil, pathError("open", strg.dir, err)
     }
-    dir := os.NewFile(uintptr(fd), DB_DIR)
+    dir := os.NewFile(uintptr(fd), strg.dir)
     names, err := dir.Readdirnames(MAX_TABLES)
+    dir.Close()
+    if err != nil && err != io.EOF {
+        return nil, pathError("readdir", strg.dir, err)
+    }
+    var tables = make([]string, 0, len(names))
+    for _, name := range names {
+        if validTableName(name) {
+            tables = append(tables, name)
+        }
+    }
+    sort.Strings(tables)
+    return tables, nil
+}
+
+func (strg *Storage) OpenAll() error {
+    names, err := strg.Tables()
     if err != nil {
-        return false
+        return err
     }
     for _, name := range names {
-        if name != "tag" {
-            cola, ok := OpenCOLA(DB_DIR + "/" + name)
-            if ok {
-                strg.colas[name] = cola
-            }
+        _, err := strg.ExistentCOLA([]byte(name))
+        if err != nil {
+            println("cannot open", name, "\b:", err.Error())
         }
     }
-    dir.Close()
-    Close(fd)
-    return true
+    return nil
+}
+
+/* Files of the server itself share the directory with the tables: "tag" and
+   those beginning with a dot. */
+func validTableName(name string) bool {
+    if len(name) == 0 || uint64(len(name)) > MAX_TABLE_NAME_LEN {
+        return false
+    }
+    return name[0] != '.' && name != "tag" && !strings.Contains(name, "/")
+}
+
+func (strg *Storage) Close() error {
+    strg.lock.Lock()
+    defer strg.lock.Unlock()
+    var result error
+    for name, cola := range strg.colas {
+        err := cola.Close()
+        if result == nil {
+            result = err
+        }
+        delete(strg.colas, name)
+    }
+    return result
 }
@@ -0,0 +1,215 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+
+package meepodb
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+/* Position of a subscription starting with the oldest changes kept */
+const SUBSCRIBE_OLDEST string = "oldest"
+
+/* Keys whose last version a subscription remembers to skip repeats */
+const SUBSCRIBE_SEEN int = 1 << 16
+
+/* A change of a table: a record written, a deletion or a drop. */
+type Event struct {
+    Server  string      /* Server whose change log had it      */
+    Key     []byte
+    Value   []byte      /* Empty for a deletion                */
+    Version uint64
+    Dropped bool        /* The server dropped the whole table  */
+}
+
+func (event *Event) Deleted() bool {
+    return !event.Dropped && len(event.Value) == 0
+}
+
+/* Wall time the change was made at. */
+func (event *Event) Time() time.Time {
+    return VersionTime(event.Version)
+}
+
+/*
+ *  A subscription streams the changes of a table by tailing the change log
+ *  of every server with SUBS, see ChangeLog. Delivery is at least once: a
+ *  copy of a change is logged by every replica that stores it, and only the
+ *  versions last delivered of the latest SUBSCRIBE_SEEN keys are remembered,
+ *  in memory, to skip the copies. While a key is remembered its events come
+ *  in the order of their versions and once each; after it is forgotten, or
+ *  the subscription is resumed from a Position, the copies of other replicas
+ *  may be delivered again. Consumers take an event of a key at a version
+ *  they have seen as a repeat. A drop is delivered by every server that had
+ *  the table.
+ *
+ *  Position gives a position per server to resume from. A consumer that
+ *  saves it after handling the events of Next loses none of them when it
+ *  stops, as long as it resumes within RETAIN_CHANGES seconds, after which
+ *  Next reports the changes gone. Servers unreachable are tailed again on
+ *  the next call, from where they were left.
+ */
+type Subscription struct {
+    table     []byte
+    servers   []string
+    positions map[string]uint64
+    oldest    bool                  /* Servers without a position start at
+                                       their oldest change, else at the head */
+    pool      *Pool
+    seen      map[string]uint64
+    order     []string              /* Keys of seen, oldest first */
+}
+
+/* Subscribe to the changes of table on servers, from position: a Position of
+   an earlier subscription, SUBSCRIBE_OLDEST, or "" for the changes made from
+   now on. */
+func Subscribe(servers []string, table string, position string) (*Subscription, error) {
+    var sub = &Subscription{
+        table     : []byte(table),
+        servers   : append([]string(nil), servers...),
+        positions : make(map[string]uint64),
+        pool      : NewPool(),
+        seen      : make(map[string]uint64),
+    }
+    sort.Strings(sub.servers)
+    switch position {
+        case "":
+        case SUBSCRIBE_OLDEST:
+            sub.oldest = true
+        default:
+            /* Servers added since have all their changes new */
+            sub.oldest = true
+            for _, pair := range strings.Split(position, ",") {
+                server, offset, ok := strings.Cut(pair, "=")
+                n, err := strconv.ParseUint(offset, 10, 64)
+                if !ok || err != nil {
+                    return nil, fmt.Errorf("%w: position %q, not server=offset", ErrInvalid, pair)
+                }
+                sub.positions[server] = n
+            }
+    }
+    return sub, nil
+}
+
+/* Where the subscription is, as server=offset pairs, to resume from. */
+func (sub *Subscription) Position() string {
+    var pairs []string
+    for _, server := range sub.servers {
+        if position, ok := sub.positions[server]; ok {
+            pairs = append(pairs, server + "=" + strconv.FormatUint(position, 10))
+        }
+    }
+    return strings.Join(pairs, ",")
+}
+
+/* Events since the last call, none if nothing changed. An error is returned
+   when no server could be reached or changes were gone; in the latter case
+   the subscription carries on from the oldest change kept. */
+func (sub *Subscription) Next() ([]Event, error) {
+    var events []Event
+    var reached int
+    var lastErr, gone error
+    for _, server := range sub.servers {
+        position, known := sub.positions[server]
+        v, err := sub.pool.Call(server, EncodeRequest(SUBS_CODE, sub.table, nil,
+                                                     Uint64ToBytes(position)))
+        if err == nil && len(v) < 24 {
+            err = fmt.Errorf("%w: SUBS reply of %d bytes", ErrCorrupt, len(v))
+        }
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        reached++
+        var oldest, head = BytesToUint64(v[0:8]), BytesToUint64(v[8:16])
+        switch {
+            case !known && sub.oldest:
+                sub.positions[server] = oldest
+            case !known:
+                sub.positions[server] = head
+            case position < oldest || position > head:
+                sub.positions[server] = oldest
+                gone = fmt.Errorf("%w: changes of %s from %d are gone, the oldest is %d",
+                                     ErrNotFound, server, position, oldest)
+            default:
+                events = sub.decode(server, v[24:], events)
+                sub.positions[server] = BytesToUint64(v[16:24])
+        }
+    }
+    if gone != nil {
+        return events, gone
+    }
+    if reached == 0 {
+        return nil, lastErr
+    }
+    return events, nil
+}
+
+/* Append the events of changes not delivered yet. */
+func (sub *Subscription) decode(server string, changes []byte, events []Event) []Event {
+    for len(changes) >= 8 {
+        code, tlen, klen, vlen := DecodeHead(changes[:8])
+        var size = 8 + tlen + klen + vlen
+        if uint64(len(changes)) < size {
+            break
+        }
+        var key = changes[8 + tlen : 8 + tlen + klen]
+        var record = changes[8 + tlen + klen : size]
+        changes = changes[size:]
+        version, value := Unstamp(record)
+        if code == DROP_CODE {
+            events = append(events, Event{ Server: server, Version: version, Dropped: true })
+            continue
+        }
+        if version <= sub.seen[string(key)] {
+            continue
+        }
+        sub.remember(string(key), version)
+        events = append(events, Event{
+            Server  : server,
+            Key     : append([]byte(nil), key...),
+            Value   : append([]byte(nil), value...),
+            Version : version,
+        })
+    }
+    return events
+}
+
+func (sub *Subscription) remember(key string, version uint64) {
+    if _, ok := sub.seen[key]; !ok {
+        sub.order = append(sub.order, key)
+        if len(sub.order) > SUBSCRIBE_SEEN {
+            delete(sub.seen, sub.order[0])
+            sub.order = sub.order[1:]
+        }
+    }
+    sub.seen[key] = version
+}
+
+func (sub *Subscription) Close() {
+    sub.pool.Close()
+}
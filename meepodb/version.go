@@ -0,0 +1,112 @@
+/*
+ *  Copyright (c) 2013 Hualiang Wu <wizawu@gmail.com>
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to
+ *  deal in the Software without restriction, including without limitation the
+ *  rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ *  sell copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in
+ *  all copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ *  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ *  IN THE SOFTWARE.
+ */
+
+package meepodb
+
+import (
+    "sync"
+    "time"
+)
+
+/*
+ *  Every stored record begins with its version, and a record with nothing
+ *  after the version is a deleted one:
+ *  | version | value   |
+ *  |---------|---------|
+ *  | 8 bytes | N bytes |
+ *  Of two records of a key the one of the higher version wins, wherever they
+ *  meet: in a write, a merge or a read of several replicas.
+ */
+const VERSION_LEN int = 8
+
+/*
+ *  Versions come from a hybrid logical clock: milliseconds since the epoch in
+ *  the upper 48 bits and a counter in the lower 16. It never goes backwards
+ *  and stays ahead of every version it has seen, so a write is always newer
+ *  than the writes it may have read, whichever server made them.
+ */
+type Clock struct {
+    lock  sync.Mutex
+    last  uint64
+}
+
+/* The clock of this process, shared by all tables. */
+var CLOCK Clock
+
+func (clock *Clock) Now() uint64 {
+    var physical = uint64(time.Now().UnixMilli()) << 16
+    clock.lock.Lock()
+    defer clock.lock.Unlock()
+    if physical > clock.last {
+        clock.last = physical
+    } else {
+        clock.last++
+    }
+    return clock.last
+}
+
+/* Move the clock past a version made elsewhere. */
+func (clock *Clock) Update(version uint64) {
+    clock.lock.Lock()
+    if version > clock.last {
+        clock.last = version
+    }
+    clock.lock.Unlock()
+}
+
+/* Wall time a version was made at. */
+func VersionTime(version uint64) time.Time {
+    return time.UnixMilli(int64(version >> 16))
+}
+
+/* A record of value at version. An empty value makes a deleted record. */
+func Stamp(version uint64, value []byte) []byte {
+    var result = make([]byte, VERSION_LEN + len(value))
+    copy(result, Uint64ToBytes(version))
+    copy(result[VERSION_LEN:], value)
+    return result
+}
+
+/* Version and value of a record. Anything shorter than a version is taken
+   as no record at all, of version 0. */
+func Unstamp(record []byte) (uint64, []byte) {
+    if len(record) < VERSION_LEN {
+        return 0, nil
+    }
+    return BytesToUint64(record), record[VERSION_LEN:]
+}
+
+func deleted(record []byte) bool {
+    return len(record) <= VERSION_LEN
+}
+
+/* Versions below it are of deletions that compactions may drop, made over
+   TOMBSTONE_GRACE seconds ago. */
+func tombstoneHorizon() uint64 {
+    var grace = time.Duration(TOMBSTONE_GRACE) * time.Second
+    return uint64(time.Now().Add(-grace).UnixMilli()) << 16
+}
+
+func recordVersion(record []byte) uint64 {
+    version, _ := Unstamp(record)
+    return version
+}
@@ -0,0 +1,96 @@
+#!/bin/sh
+#
+#  Runs three meepodb-server processes on localhost with a Raft table, stops
+#  the leader between two batches of writes and checks that nothing
+#  committed is lost, that a new leader takes the second batch and that the
+#  old leader catches up once it is back. Writes in flight while the leader
+#  goes down are not tested. Run "make raft-test".
+#
+
+SERVER=./meepodb-server
+CLI=./meepodb-cli
+PORTS="7401 7402 7403"
+TABLE=meta
+KEYS=100
+DIR=$(mktemp -d "${TMPDIR:-/tmp}/meepodb-raft.XXXXXX")
+SERVERS=$(echo $PORTS | sed 's/\([0-9]*\)/127.0.0.1:\1/g; s/ /,/g')
+
+trap 'kill $(cat "$DIR"/*.pid 2>/dev/null) 2>/dev/null; rm -rf "$DIR"' EXIT
+
+start() {
+    $SERVER -config /dev/null -dir "$DIR/$1" -servers $SERVERS -raft $TABLE $1 \
+        >> "$DIR/$1.log" 2>&1 &
+    echo $! > "$DIR/$1.pid"
+}
+
+stop() {
+    kill $(cat "$DIR/$1.pid")
+    rm "$DIR/$1.pid"
+}
+
+# Commands from stdin, sent to the server on port $1
+cli() {
+    (cat; echo QUIT) | $CLI -config /dev/null -servers 127.0.0.1:$1 2>/dev/null
+}
+
+# Port of the leader as seen by the servers on the ports given
+leader() {
+    for port in "$@"; do
+        echo "RAFT $TABLE" | cli $port
+    done | awk '$2 == "leader" { sub(/:$/, "", $1); sub(/.*:/, "", $1); print $1; exit }'
+}
+
+wait_leader() {
+    for i in $(seq 50); do
+        LEADER=$(leader "$@")
+        [ -n "$LEADER" ] && return 0
+        sleep 0.2
+    done
+    return 1
+}
+
+fail() {
+    echo "FAIL: $*"
+    exit 1
+}
+
+# Check that keys $1 to $2 read back through the server on port $3
+check() {
+    got=$(seq $1 $2 | sed "s/.*/GET $TABLE k& /" | cli $3 | grep -c '^v')
+    [ "$got" -eq $(($2 - $1 + 1)) ] || fail "$got of keys $1..$2 read back on $3"
+}
+
+for port in $PORTS; do
+    start $port
+done
+wait_leader $PORTS || fail "no leader elected"
+echo "leader elected on $LEADER"
+
+seq 1 $KEYS | sed "s/.*/SET $TABLE k& v&/" | cli $LEADER > /dev/null
+check 1 $KEYS $LEADER
+
+OLD=$LEADER
+stop $OLD
+REST=$(echo $PORTS | tr ' ' '\n' | grep -v $OLD | tr '\n' ' ')
+sleep 1
+wait_leader $REST || fail "no leader elected after $OLD stopped"
+echo "leader moved from $OLD to $LEADER"
+for port in $REST; do
+    check 1 $KEYS $port
+done
+
+seq $((KEYS + 1)) $((2 * KEYS)) | sed "s/.*/SET $TABLE k& v&/" | cli $LEADER > /dev/null
+check 1 $((2 * KEYS)) $LEADER
+
+start $OLD
+for i in $(seq 50); do
+    status=$(echo "RAFT $TABLE" | cli $OLD)
+    set -- $status
+    [ "$2" = "follower" ] && [ "$7" -ge $((2 * KEYS + 2)) ] && break
+    sleep 0.2
+done
+[ "$2" = "follower" ] || fail "$OLD did not rejoin: $status"
+echo "$OLD rejoined as follower, applied up to $7"
+check 1 $((2 * KEYS)) $OLD
+
+echo PASS